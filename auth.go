@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	jwtware "github.com/gofiber/jwt/v3"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// isPasswordHash reports whether a stored password is already a bcrypt hash.
+// Rows created before /register existed still hold the plaintext password.
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$")
+}
+
+// checkPassword compares a login attempt against the stored password and
+// reports whether the stored value should be rehashed (legacy plaintext).
+func checkPassword(stored, password string) (ok bool, needsRehash bool) {
+	// Users merged from the old admin list have no password and can't log in
+	if stored == "" {
+		return false, false
+	}
+
+	if isPasswordHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, false
+	}
+
+	ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	return ok, ok
+}
+
+const (
+	roleAdmin     = "admin"
+	roleStaff     = "staff"
+	roleConsignor = "consignor"
+	roleCustomer  = "customer"
+)
+
+func isValidRole(role string) bool {
+	switch role {
+	case roleAdmin, roleStaff, roleConsignor, roleCustomer:
+		return true
+	}
+	return false
+}
+
+// tokenClaims returns the claims of the JWT validated by jwtware, or nil when
+// the request did not go through the JWT middleware.
+func tokenClaims(c *fiber.Ctx) jwt.MapClaims {
+	token, ok := c.Locals("user").(*jwt.Token)
+	if !ok {
+		return nil
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil
+	}
+
+	return claims
+}
+
+// tokenUserID returns the uid claim, JSON numbers come back as float64
+func tokenUserID(c *fiber.Ctx) (int, bool) {
+	uid, ok := tokenClaims(c)["uid"].(float64)
+	if !ok || uid <= 0 {
+		return 0, false
+	}
+
+	return int(uid), true
+}
+
+// requireRole only lets the request through when the JWT carries one of the
+// given roles. It must be registered after the jwtware middleware.
+func requireRole(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims := tokenClaims(c)
+		if claims == nil {
+			return unauthorized("missing or invalid token")
+		}
+
+		if hasRole(c, roles...) {
+			return c.Next()
+		}
+
+		return forbidden("you do not have permission to access this resource")
+	}
+}
+
+// requireOwnerAccount finds the owner linked to the signed in user and
+// keeps it for accountOwner. Routes behind it only ever use that owner and
+// take no owner id from the request, so a consignor can't reach another
+// owner's data. It must be registered after the jwtware middleware.
+func requireOwnerAccount(owners OwnerRepository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID, ok := tokenUserID(c)
+		if !ok {
+			return unauthorized("missing or invalid token")
+		}
+
+		owner, err := owners.FindByUser(userID)
+		if errors.Is(err, ErrNotFound) {
+			return forbidden("your account isn't linked to an owner")
+		}
+		if err != nil {
+			return err
+		}
+
+		c.Locals("owner", owner)
+		return c.Next()
+	}
+}
+
+// accountOwner returns the owner found by requireOwnerAccount
+func accountOwner(c *fiber.Ctx) Owner {
+	owner, _ := c.Locals("owner").(Owner)
+	return owner
+}
+
+// newAccessToken mints a short lived access token. The jti lets a single token
+// be denylisted on logout and fam ties it to the refresh token family it came from.
+func newAccessToken(user User, family string) (string, error) {
+	token := jwt.New(jwt.SigningMethodHS256)
+	claims := token.Claims.(jwt.MapClaims)
+	claims["jti"] = uuid.NewString()
+	claims["fam"] = family
+	claims["uid"] = user.ID
+	claims["email"] = user.Email
+	claims["role"] = user.Role
+	claims["exp"] = time.Now().Add(cfg.AccessTokenTTL).Unix()
+
+	return token.SignedString(jwtSecret)
+}
+
+// newRefreshToken returns an opaque refresh token for the client and the hash
+// we keep in the database, so a leaked table can't be replayed.
+func newRefreshToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	raw := base64.RawURLEncoding.EncodeToString(b)
+	return raw, hashRefreshToken(raw), nil
+}
+
+func hashRefreshToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func login(users UserRepository, login *Login) (Token, error) {
+	user, err := users.FindByEmail(login.Email)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return Token{}, errInvalidCredentials
+		}
+		return Token{}, err
+	}
+
+	ok, needsRehash := checkPassword(user.Password, login.Password)
+	if !ok {
+		return Token{}, errInvalidCredentials
+	}
+
+	// Legacy rows still store the plaintext password, upgrade them now that we know it
+	if needsRehash {
+		hash, err := hashPassword(login.Password)
+		if err != nil {
+			return Token{}, err
+		}
+
+		if err := users.SetPassword(user.ID, hash); err != nil {
+			return Token{}, err
+		}
+	}
+
+	raw, hash, err := newRefreshToken()
+	if err != nil {
+		return Token{}, err
+	}
+
+	family := uuid.NewString()
+	err = users.CreateRefreshToken(RefreshToken{
+		UserID:    user.ID,
+		FamilyID:  family,
+		Hash:      hash,
+		ExpiresAt: time.Now().Add(cfg.RefreshTokenTTL),
+	})
+	if err != nil {
+		return Token{}, err
+	}
+
+	return issueTokens(user, family, raw)
+}
+
+// refreshTokens rotates a refresh token. Every refresh token can be used once,
+// presenting one that was already rotated means it leaked so the whole family is revoked.
+func refreshTokens(users UserRepository, raw string) (Token, error) {
+	next, hash, err := newRefreshToken()
+	if err != nil {
+		return Token{}, err
+	}
+
+	user, stored, err := users.RotateRefreshToken(hashRefreshToken(raw), RefreshToken{
+		Hash:      hash,
+		ExpiresAt: time.Now().Add(cfg.RefreshTokenTTL),
+	})
+	if err != nil {
+		return Token{}, err
+	}
+
+	return issueTokens(user, stored.FamilyID, next)
+}
+
+// issueTokens mints the access token that goes with a stored refresh token
+func issueTokens(user User, family, refreshToken string) (Token, error) {
+	access, err := newAccessToken(user, family)
+	if err != nil {
+		return Token{}, err
+	}
+
+	return Token{
+		Token:        access,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(cfg.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// createUser hashes the password and stores the user
+func createUser(users UserRepository, user *User) (User, error) {
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		return User{}, err
+	}
+
+	created := *user
+	created.Password = hash
+
+	return users.Create(&created)
+}
+
+// updateUser overwrites a user, a new password is hashed and an empty one
+// keeps the current password.
+func updateUser(users UserRepository, id int, user *User) (User, error) {
+	updated := *user
+
+	if updated.Password != "" {
+		hash, err := hashPassword(updated.Password)
+		if err != nil {
+			return User{}, err
+		}
+		updated.Password = hash
+	}
+
+	return users.Update(id, &updated)
+}
+
+// newJWTMiddleware validates the signature like before and then rejects
+// tokens that were revoked through /logout or a session revoke.
+func newJWTMiddleware(users UserRepository) fiber.Handler {
+	return jwtware.New(jwtConfig(users))
+}
+
+// newOptionalJWTMiddleware is for public routes that show more to some
+// roles. Requests without a token pass through anonymously, a token that is
+// sent must still be valid.
+func newOptionalJWTMiddleware(users UserRepository) fiber.Handler {
+	config := jwtConfig(users)
+	config.Filter = func(c *fiber.Ctx) bool {
+		return c.Get(fiber.HeaderAuthorization) == ""
+	}
+
+	return jwtware.New(config)
+}
+
+func jwtConfig(users UserRepository) jwtware.Config {
+	return jwtware.Config{
+		SigningKey: jwtSecret,
+		// jwtware answers a missing token with 400, treat it like any other bad token
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			return unauthorized("missing or invalid token")
+		},
+		SuccessHandler: func(c *fiber.Ctx) error {
+			claims := tokenClaims(c)
+			jti, _ := claims["jti"].(string)
+			family, _ := claims["fam"].(string)
+
+			// Tokens minted before revocation existed can't be revoked, so don't accept them
+			if jti == "" || family == "" {
+				return unauthorized("missing or invalid token")
+			}
+
+			revoked, err := users.IsAccessTokenRevoked(jti, family)
+			if err != nil {
+				return err
+			}
+			if revoked {
+				return unauthorized("token has been revoked")
+			}
+
+			return c.Next()
+		},
+	}
+}
+
+func hasRole(c *fiber.Ctx, roles ...string) bool {
+	claims := tokenClaims(c)
+	if claims == nil {
+		return false
+	}
+
+	role, _ := claims["role"].(string)
+	for _, r := range roles {
+		if role == r {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+const (
+	bulkModeAtomic     = "atomic"
+	bulkModeBestEffort = "best-effort"
+)
+
+const (
+	bulkStatusUpdated    = "updated"
+	bulkStatusNotFound   = "not_found"
+	bulkStatusConflict   = "conflict"
+	bulkStatusForbidden  = "forbidden"
+	bulkStatusInvalid    = "validation_error"
+	bulkStatusError      = "error"
+	bulkStatusRolledBack = "rolled_back"
+)
+
+func checkBulkProduct(product *Product, seen map[int]bool) string {
+	switch {
+	case product.ID <= 0:
+		return "product id is required"
+	case seen[product.ID]:
+		return "product appears more than once in the request"
+	}
+	return ""
+}
+
+// bulkErrorStatus reports why one item of a batch failed. Every message is
+// fixed or written for the client, driver messages name tables and
+// constraints and never reach the response.
+func bulkErrorStatus(err error) (string, string) {
+	if verr, ok := asValidationError(err); ok {
+		return bulkStatusInvalid, verr.Error()
+	}
+
+	var derr *DomainError
+	if errors.As(err, &derr) {
+		switch derr.Kind {
+		case ErrNotFound:
+			return bulkStatusNotFound, "product not found"
+		case ErrConflict, ErrPreconditionFailed, ErrPreconditionRequired:
+			return bulkStatusConflict, derr.Message
+		case ErrValidation:
+			return bulkStatusInvalid, derr.Message
+		case ErrUnauthorized, ErrForbidden:
+			return bulkStatusForbidden, derr.Message
+		}
+	}
+
+	if pqErr, ok := err.(*pq.Error); ok {
+		// Foreign key, check constraint, not null and bad input values are the client's fault
+		switch {
+		case pqErr.Code.Name() == "foreign_key_violation":
+			return bulkStatusInvalid, "references a missing type, status or owner"
+		case pqErr.Code.Name() == "unique_violation":
+			return bulkStatusConflict, "conflicts with another product"
+		case pqErr.Code.Class() == "22" || pqErr.Code.Class() == "23":
+			return bulkStatusInvalid, "invalid value"
+		}
+	}
+
+	return bulkStatusError, "failed to update product"
+}
+
+// invalidBulkResult reports a product that failed validation
+func invalidBulkResult(id int, err error) (BulkUpdateResult, bool) {
+	verr, ok := asValidationError(err)
+	if !ok {
+		return BulkUpdateResult{}, false
+	}
+
+	return BulkUpdateResult{
+		ID:     id,
+		Status: bulkStatusInvalid,
+		Error:  "product is invalid",
+		Errors: verr.Errors,
+	}, true
+}
+
+// rollBackResults rewrites the report of an atomic batch that wasn't committed
+func rollBackResults(results []BulkUpdateResult) {
+	for i := range results {
+		if results[i].Status == bulkStatusUpdated {
+			results[i].Status = bulkStatusRolledBack
+			results[i].Product = nil
+		}
+	}
+}
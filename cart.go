@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// CartItem is a product a customer holds. Price is what they would pay for it
+// now, HeldUntil when the hold runs out and the product goes back on sale.
+type CartItem struct {
+	ProductID   int    `json:"productid"`
+	ProductName string `json:"productname"`
+	Price       int    `json:"price"`
+	HeldUntil   string `json:"helduntil"`
+}
+
+// Cart is the body of the /me/cart routes, the items oldest hold first
+type Cart struct {
+	Items []CartItem `json:"items"`
+	Total int        `json:"total"`
+}
+
+// AddToCart is the body of POST /me/cart
+type AddToCart struct {
+	ProductID int `json:"productid"`
+}
+
+// CartCheckout is the optional body of POST /me/cart/checkout
+type CartCheckout struct {
+	Note string `json:"note"`
+}
+
+// checkHoldable only lets an available product nobody holds into a cart.
+// holder is whoever holds p now, 0 when nobody does.
+func checkHoldable(p Product, holder, userID int) error {
+	if err := checkOrderable(p); err != nil {
+		return err
+	}
+	if holder == userID {
+		return conflictf("product %d is already in your cart", p.ID)
+	}
+	return checkHolder(p.ID, holder, userID)
+}
+
+// checkHolder keeps other customers' held products out of a checkout, the
+// customer's own holds are what their checkout is for
+func checkHolder(productID, holder, userID int) error {
+	if holder != 0 && holder != userID {
+		return conflictf("product %d is held in another customer's cart", productID)
+	}
+	return nil
+}
+
+// checkCartSize caps a cart at what one checkout may order
+func checkCartSize(held int) error {
+	if held >= maxOrderItems {
+		return conflictf("your cart is full, it holds at most %d products", maxOrderItems)
+	}
+	return nil
+}
+
+// newCart adds up the items, an empty cart still has an empty list
+func newCart(items []CartItem) Cart {
+	cart := Cart{Items: []CartItem{}}
+	for _, item := range items {
+		cart.Items = append(cart.Items, item)
+		cart.Total += item.Price
+	}
+	return cart
+}
+
+// cartProductIDs is what checking the cart out orders
+func cartProductIDs(cart Cart) []int {
+	ids := make([]int, len(cart.Items))
+	for i, item := range cart.Items {
+		ids[i] = item.ProductID
+	}
+	return ids
+}
+
+// runHoldSweeper deletes expired holds every interval until ctx is done.
+// Expired holds already stop counting the moment they run out, the sweeper
+// only keeps the table small.
+func runHoldSweeper(ctx context.Context, carts CartRepository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			released, err := carts.ReleaseExpired()
+			if err != nil {
+				log.Printf("release expired cart holds: %v", err)
+				continue
+			}
+			if released > 0 {
+				log.Printf("released %d expired cart holds", released)
+			}
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// placeholderJWTSecret is only accepted when running with env "dev"
+const placeholderJWTSecret = "your_secret_key"
+
+type DBConfig struct {
+	Host            string        `yaml:"host"`
+	Port            int           `yaml:"port"`
+	User            string        `yaml:"user"`
+	Password        string        `yaml:"password"`
+	Name            string        `yaml:"name"`
+	SSLMode         string        `yaml:"sslmode"`
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+}
+
+// StorageConfig picks where uploaded images go, see storage.go
+type StorageConfig struct {
+	Driver      string `yaml:"driver"`
+	LocalDir    string `yaml:"local_dir"`
+	PublicURL   string `yaml:"public_url"`
+	S3Endpoint  string `yaml:"s3_endpoint"`
+	S3Region    string `yaml:"s3_region"`
+	S3Bucket    string `yaml:"s3_bucket"`
+	S3AccessKey string `yaml:"s3_access_key"`
+	S3SecretKey string `yaml:"s3_secret_key"`
+	S3UseSSL    bool   `yaml:"s3_use_ssl"`
+}
+
+// PromptPayConfig is where customers pay, see promptpay.go. ID is a mobile
+// number, a national or tax id or an e-wallet id, without one there are no
+// QR codes. The webhook checks signatures with WebhookSecret, the local
+// driver takes every request as it comes and is only allowed in dev.
+type PromptPayConfig struct {
+	ID            string `yaml:"id"`
+	WebhookDriver string `yaml:"webhook_driver"`
+	WebhookSecret string `yaml:"webhook_secret"`
+}
+
+type Config struct {
+	Env             string        `yaml:"env"`
+	ListenAddr      string        `yaml:"listen_addr"`
+	JWTSecret       string        `yaml:"jwt_secret"`
+	AccessTokenTTL  time.Duration `yaml:"access_token_ttl"`
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl"`
+	AutoMigrate     bool          `yaml:"auto_migrate"`
+	DB              DBConfig      `yaml:"db"`
+	Storage         StorageConfig `yaml:"storage"`
+
+	// CartHoldTTL is how long adding a product to a cart keeps it from
+	// everyone else, the sweeper deletes expired holds every CartSweepInterval
+	CartHoldTTL       time.Duration `yaml:"cart_hold_ttl"`
+	CartSweepInterval time.Duration `yaml:"cart_sweep_interval"`
+
+	PromptPay PromptPayConfig `yaml:"promptpay"`
+}
+
+var cfg Config
+
+func defaultConfig() Config {
+	return Config{
+		Env:             "production",
+		ListenAddr:      ":8080",
+		JWTSecret:       placeholderJWTSecret,
+		AccessTokenTTL:  15 * time.Minute,
+		RefreshTokenTTL: 30 * 24 * time.Hour,
+		DB: DBConfig{
+			Host:            "localhost",
+			Port:            5432,
+			User:            "wearlab",
+			Name:            "wearlabdatabase",
+			SSLMode:         "disable",
+			MaxOpenConns:    25,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+		},
+		Storage: StorageConfig{
+			Driver:   storageDriverLocal,
+			LocalDir: "uploads",
+			S3Region: "us-east-1",
+		},
+		PromptPay: PromptPayConfig{
+			WebhookDriver: webhookDriverHMAC,
+		},
+		CartHoldTTL:       15 * time.Minute,
+		CartSweepInterval: time.Minute,
+	}
+}
+
+func (c Config) isDev() bool {
+	return c.Env == "dev"
+}
+
+// dsn quotes every value, so a password with spaces or quotes in it still
+// reaches Postgres as it was written
+func (c DBConfig) dsn() string {
+	return fmt.Sprintf("host=%s port=%d user=%s "+
+		"password=%s dbname=%s sslmode=%s",
+		dsnQuote(c.Host), c.Port, dsnQuote(c.User), dsnQuote(c.Password), dsnQuote(c.Name), dsnQuote(c.SSLMode))
+}
+
+// dsnQuote makes s a single quoted key/value connection string value, the
+// way lib/pq reads them back
+func dsnQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `\'`)
+	return "'" + s + "'"
+}
+
+// loadConfig starts from the defaults, applies the optional YAML file and
+// then environment variables, so the environment always wins.
+func loadConfig(path string) (Config, error) {
+	c := defaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("read config file: %w", err)
+		}
+
+		if err := yaml.Unmarshal(data, &c); err != nil {
+			return Config{}, fmt.Errorf("parse config file %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(&c); err != nil {
+		return Config{}, err
+	}
+
+	if err := c.validate(); err != nil {
+		return Config{}, err
+	}
+
+	return c, nil
+}
+
+func applyEnv(c *Config) error {
+	envString("APP_ENV", &c.Env)
+	envString("LISTEN_ADDR", &c.ListenAddr)
+	envString("JWT_SECRET", &c.JWTSecret)
+	envString("DB_HOST", &c.DB.Host)
+	envString("DB_USER", &c.DB.User)
+	envString("DB_PASSWORD", &c.DB.Password)
+	envString("DB_NAME", &c.DB.Name)
+	envString("DB_SSLMODE", &c.DB.SSLMode)
+	envString("STORAGE_DRIVER", &c.Storage.Driver)
+	envString("STORAGE_LOCAL_DIR", &c.Storage.LocalDir)
+	envString("STORAGE_PUBLIC_URL", &c.Storage.PublicURL)
+	envString("S3_ENDPOINT", &c.Storage.S3Endpoint)
+	envString("S3_REGION", &c.Storage.S3Region)
+	envString("S3_BUCKET", &c.Storage.S3Bucket)
+	envString("S3_ACCESS_KEY", &c.Storage.S3AccessKey)
+	envString("S3_SECRET_KEY", &c.Storage.S3SecretKey)
+	envString("PROMPTPAY_ID", &c.PromptPay.ID)
+	envString("PROMPTPAY_WEBHOOK_DRIVER", &c.PromptPay.WebhookDriver)
+	envString("PROMPTPAY_WEBHOOK_SECRET", &c.PromptPay.WebhookSecret)
+
+	return errors.Join(
+		envBool("AUTO_MIGRATE", &c.AutoMigrate),
+		envBool("S3_USE_SSL", &c.Storage.S3UseSSL),
+		envInt("DB_PORT", &c.DB.Port),
+		envInt("DB_MAX_OPEN_CONNS", &c.DB.MaxOpenConns),
+		envInt("DB_MAX_IDLE_CONNS", &c.DB.MaxIdleConns),
+		envDuration("DB_CONN_MAX_LIFETIME", &c.DB.ConnMaxLifetime),
+		envDuration("DB_CONN_MAX_IDLE_TIME", &c.DB.ConnMaxIdleTime),
+		envDuration("ACCESS_TOKEN_TTL", &c.AccessTokenTTL),
+		envDuration("REFRESH_TOKEN_TTL", &c.RefreshTokenTTL),
+		envDuration("CART_HOLD_TTL", &c.CartHoldTTL),
+		envDuration("CART_SWEEP_INTERVAL", &c.CartSweepInterval),
+	)
+}
+
+func envString(key string, dst *string) {
+	if v, ok := os.LookupEnv(key); ok {
+		*dst = v
+	}
+}
+
+func envBool(key string, dst *bool) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("%s must be true or false, got %q", key, v)
+	}
+
+	*dst = b
+	return nil
+}
+
+func envInt(key string, dst *int) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%s must be an integer, got %q", key, v)
+	}
+
+	*dst = n
+	return nil
+}
+
+func envDuration(key string, dst *time.Duration) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("%s must be a duration like 15m, got %q", key, v)
+	}
+
+	*dst = d
+	return nil
+}
+
+func (c Config) validate() error {
+	var problems []string
+
+	if c.ListenAddr == "" {
+		problems = append(problems, "listen address is required")
+	}
+	if c.JWTSecret == "" {
+		problems = append(problems, "JWT secret is required")
+	}
+	if c.JWTSecret == placeholderJWTSecret && !c.isDev() {
+		problems = append(problems, "JWT secret is still the placeholder, set JWT_SECRET or use APP_ENV=dev")
+	}
+	if c.AccessTokenTTL <= 0 || c.RefreshTokenTTL <= 0 {
+		problems = append(problems, "token TTLs must be positive")
+	}
+	if c.CartHoldTTL < time.Second || c.CartSweepInterval <= 0 {
+		problems = append(problems, "cart hold TTL must be at least 1s and the sweep interval positive")
+	}
+	if c.DB.Host == "" || c.DB.User == "" || c.DB.Name == "" {
+		problems = append(problems, "database host, user and name are required")
+	}
+	if c.DB.Password == "" {
+		problems = append(problems, "database password is required")
+	}
+	if c.DB.Port <= 0 {
+		problems = append(problems, "database port must be positive")
+	}
+	if c.DB.MaxOpenConns < 0 || c.DB.MaxIdleConns < 0 {
+		problems = append(problems, "database pool sizes can't be negative")
+	}
+
+	switch c.Storage.Driver {
+	case storageDriverLocal:
+		if c.Storage.LocalDir == "" {
+			problems = append(problems, "storage local_dir is required for the local driver")
+		}
+	case storageDriverS3:
+		if c.Storage.S3Endpoint == "" || c.Storage.S3Bucket == "" || c.Storage.S3AccessKey == "" || c.Storage.S3SecretKey == "" {
+			problems = append(problems, "storage s3 endpoint, bucket and keys are required for the s3 driver")
+		}
+	default:
+		problems = append(problems, `storage driver must be "local" or "s3"`)
+	}
+
+	if c.PromptPay.ID != "" {
+		if _, err := promptPayAccount(c.PromptPay.ID); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	switch c.PromptPay.WebhookDriver {
+	case webhookDriverHMAC:
+	case webhookDriverLocal:
+		if !c.isDev() {
+			problems = append(problems, "the local payment webhook accepts unsigned requests and is only allowed with env dev")
+		}
+	default:
+		problems = append(problems, `promptpay webhook_driver must be "hmac" or "local"`)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// configEnv is every variable applyEnv reads
+var configEnv = []string{
+	"APP_ENV", "LISTEN_ADDR", "JWT_SECRET", "ACCESS_TOKEN_TTL", "REFRESH_TOKEN_TTL", "AUTO_MIGRATE",
+	"DB_HOST", "DB_PORT", "DB_USER", "DB_PASSWORD", "DB_NAME", "DB_SSLMODE",
+	"DB_MAX_OPEN_CONNS", "DB_MAX_IDLE_CONNS", "DB_CONN_MAX_LIFETIME", "DB_CONN_MAX_IDLE_TIME",
+	"STORAGE_DRIVER", "STORAGE_LOCAL_DIR", "STORAGE_PUBLIC_URL",
+	"S3_ENDPOINT", "S3_REGION", "S3_BUCKET", "S3_ACCESS_KEY", "S3_SECRET_KEY", "S3_USE_SSL",
+	"CART_HOLD_TTL", "CART_SWEEP_INTERVAL",
+	"PROMPTPAY_ID", "PROMPTPAY_WEBHOOK_DRIVER", "PROMPTPAY_WEBHOOK_SECRET",
+}
+
+// clearConfigEnv keeps the environment the tests run in out of loadConfig,
+// the variables come back when the test ends
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	for _, key := range configEnv {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+}
+
+// minimalConfig is the least a config file needs to load
+const minimalConfig = "env: dev\ndb:\n  password: secret\n"
+
+func writeConfigFile(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	cases := []struct {
+		name string
+		yaml string
+		env  map[string]string
+		want func(Config) Config
+	}{
+		{
+			name: "file over defaults",
+			yaml: minimalConfig + "listen_addr: \":9000\"\ncart_hold_ttl: 5m\n",
+			want: func(c Config) Config {
+				c.Env = "dev"
+				c.DB.Password = "secret"
+				c.ListenAddr = ":9000"
+				c.CartHoldTTL = 5 * time.Minute
+				return c
+			},
+		},
+		{
+			name: "env over file",
+			yaml: "env: dev\nlisten_addr: \":9000\"\ndb:\n  password: secret\n  port: 5433\n",
+			env: map[string]string{
+				"LISTEN_ADDR":   ":7000",
+				"DB_PORT":       "6000",
+				"DB_PASSWORD":   "from-env",
+				"AUTO_MIGRATE":  "true",
+				"CART_HOLD_TTL": "30m",
+			},
+			want: func(c Config) Config {
+				c.Env = "dev"
+				c.ListenAddr = ":7000"
+				c.DB.Port = 6000
+				c.DB.Password = "from-env"
+				c.AutoMigrate = true
+				c.CartHoldTTL = 30 * time.Minute
+				return c
+			},
+		},
+		{
+			name: "env without a file",
+			env: map[string]string{
+				"JWT_SECRET":  "a-real-secret",
+				"DB_PASSWORD": "secret",
+			},
+			want: func(c Config) Config {
+				c.JWTSecret = "a-real-secret"
+				c.DB.Password = "secret"
+				return c
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+
+			path := ""
+			if tc.yaml != "" {
+				path = writeConfigFile(t, tc.yaml)
+			}
+
+			got, err := loadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tc.want(defaultConfig()); got != want {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigExample(t *testing.T) {
+	clearConfigEnv(t)
+
+	c, err := loadConfig("config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Env != "dev" || c.DB.Password != "wearlabbro30102001" || c.RefreshTokenTTL != 720*time.Hour {
+		t.Errorf("example config not read: %+v", c)
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	clearConfigEnv(t)
+
+	_, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "read config file") {
+		t.Errorf("got %v, want a read error", err)
+	}
+}
+
+func TestLoadConfigRejectsInvalidValues(t *testing.T) {
+	cases := []struct {
+		name    string
+		yaml    string
+		env     map[string]string
+		wantErr string
+	}{
+		{"bad yaml", "db: [", nil, "parse config file"},
+		{"bad yaml duration", minimalConfig + "access_token_ttl: soon\n", nil, "parse config file"},
+		{"bad int", minimalConfig, map[string]string{"DB_PORT": "five"}, "DB_PORT must be an integer"},
+		{"bad bool", minimalConfig, map[string]string{"AUTO_MIGRATE": "maybe"}, "AUTO_MIGRATE must be true or false"},
+		{"bad duration", minimalConfig, map[string]string{"CART_HOLD_TTL": "soon"}, "CART_HOLD_TTL must be a duration"},
+		{"placeholder secret", "db:\n  password: secret\n", nil, "JWT secret is still the placeholder"},
+		{"no password", "env: dev\n", nil, "database password is required"},
+		{"negative port", minimalConfig, map[string]string{"DB_PORT": "-1"}, "database port must be positive"},
+		{"negative pool", minimalConfig, map[string]string{"DB_MAX_OPEN_CONNS": "-1"}, "pool sizes can't be negative"},
+		{"short hold", minimalConfig, map[string]string{"CART_HOLD_TTL": "10ms"}, "cart hold TTL must be at least 1s"},
+		{"storage driver", minimalConfig, map[string]string{"STORAGE_DRIVER": "ftp"}, `storage driver must be "local" or "s3"`},
+		{"s3 without bucket", minimalConfig, map[string]string{"STORAGE_DRIVER": "s3"}, "storage s3 endpoint, bucket and keys are required"},
+		{"promptpay id", minimalConfig, map[string]string{"PROMPTPAY_ID": "12ab"}, "must only have digits"},
+		{"local webhook outside dev", "jwt_secret: real\ndb:\n  password: secret\n", map[string]string{"PROMPTPAY_WEBHOOK_DRIVER": "local"}, "only allowed with env dev"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+
+			_, err := loadConfig(writeConfigFile(t, tc.yaml))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("got %v, want an error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDSNQuotesValues(t *testing.T) {
+	cases := map[string]struct {
+		password string
+		want     string
+	}{
+		"plain":     {"secret", `password='secret'`},
+		"space":     {"two words", `password='two words'`},
+		"quote":     {"it's", `password='it\'s'`},
+		"backslash": {`back\slash`, `password='back\\slash'`},
+		"empty":     {"", `password=''`},
+		"injection": {"x sslmode=disable", `password='x sslmode=disable'`},
+	}
+
+	for name, tc := range cases {
+		c := defaultConfig().DB
+		c.Password = tc.password
+
+		dsn := c.dsn()
+		want := "host='localhost' port=5432 user='wearlab' " + tc.want + " dbname='wearlabdatabase' sslmode='disable'"
+		if dsn != want {
+			t.Errorf("%s: got %s, want %s", name, dsn, want)
+		}
+		if _, err := pq.NewConnector(dsn); err != nil {
+			t.Errorf("%s: lib/pq can't parse %s: %v", name, dsn, err)
+		}
+	}
+}
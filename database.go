@@ -6,436 +6,2568 @@ import (
 	"strings"
 	"time"
 
-	"github.com/golang-jwt/jwt/v4"
 	"github.com/lib/pq"
 
 	_ "github.com/lib/pq"
 )
 
-func login(login *Login) (string, error) {
-	var dbUser User
+var (
+	errInvalidCredentials  error = &DomainError{Kind: ErrUnauthorized, Message: "invalid email or password"}
+	errEmailTaken          error = &DomainError{Kind: ErrConflict, Message: "email is already registered"}
+	errInvalidRefreshToken error = &DomainError{Kind: ErrUnauthorized, Message: "invalid or expired refresh token"}
+	errVersionMismatch     error = &DomainError{Kind: ErrPreconditionFailed, Message: "product was modified since it was read"}
+)
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type pgProductRepo struct {
+	db *sql.DB
+}
+
+type pgOwnerRepo struct {
+	db *sql.DB
+}
+
+type pgUserRepo struct {
+	db *sql.DB
+}
+
+// pgImageRepo keeps the image rows, the files themselves are in Storage
+type pgImageRepo struct {
+	db *sql.DB
+}
+
+type pgLedgerRepo struct {
+	db *sql.DB
+}
+
+type pgWithdrawalRepo struct {
+	db *sql.DB
+}
+
+type pgOrderRepo struct {
+	db *sql.DB
+}
+
+type pgCartRepo struct {
+	db *sql.DB
+}
+
+// pgLookupRepo runs on a dbtx so validation inside a transaction sees the
+// same rows as the write that follows it.
+type pgLookupRepo struct {
+	q dbtx
+}
+
+func newPostgresStore(db *sql.DB) Store {
+	return Store{
+		Products:    &pgProductRepo{db: db},
+		Owners:      &pgOwnerRepo{db: db},
+		Users:       &pgUserRepo{db: db},
+		Lookups:     &pgLookupRepo{q: db},
+		Images:      &pgImageRepo{db: db},
+		Ledger:      &pgLedgerRepo{db: db},
+		Withdrawals: &pgWithdrawalRepo{db: db},
+		Orders:      &pgOrderRepo{db: db},
+		Carts:       &pgCartRepo{db: db},
+	}
+}
+
+func (r *pgUserRepo) FindByEmail(email string) (User, error) {
+	var u User
+
+	err := r.db.QueryRow(
+		`SELECT id, email, COALESCE(password, ''), role FROM public.users WHERE email=$1`,
+		email,
+	).Scan(&u.ID, &u.Email, &u.Password, &u.Role)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return User{}, notFoundf("no user found with email %s", email)
+		}
+		return User{}, err
+	}
+
+	return u, nil
+}
+
+func (r *pgUserRepo) SetPassword(id int, hash string) error {
+	_, err := r.db.Exec(`UPDATE public.users SET password = $1 WHERE id = $2`, hash, id)
+
+	return err
+}
+
+func (r *pgUserRepo) CreateRefreshToken(token RefreshToken) error {
+	return insertRefreshToken(r.db, token)
+}
+
+func insertRefreshToken(q dbtx, token RefreshToken) error {
+	_, err := q.Exec(
+		`INSERT INTO public.refresh_token(user_id, family_id, token_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5);`,
+		token.UserID, token.FamilyID, token.Hash, token.ExpiresAt, time.Now(),
+	)
+
+	return err
+}
+
+func (r *pgUserRepo) RotateRefreshToken(oldHash string, next RefreshToken) (User, RefreshToken, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return User{}, RefreshToken{}, err
+	}
+	defer tx.Rollback()
+
+	var (
+		id        int
+		family    string
+		expiresAt time.Time
+		usedAt    sql.NullTime
+		revokedAt sql.NullTime
+		u         User
+	)
+
+	err = tx.QueryRow(
+		`SELECT rt.id, rt.family_id, rt.expires_at, rt.used_at, rt.revoked_at,
+			u.id, COALESCE(u.email, ''), u.role
+		FROM public.refresh_token rt
+		JOIN public.users u ON u.id = rt.user_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE OF rt;`,
+		oldHash,
+	).Scan(&id, &family, &expiresAt, &usedAt, &revokedAt, &u.ID, &u.Email, &u.Role)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return User{}, RefreshToken{}, errInvalidRefreshToken
+		}
+		return User{}, RefreshToken{}, err
+	}
+
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		return User{}, RefreshToken{}, errInvalidRefreshToken
+	}
+
+	if usedAt.Valid {
+		if err := revokeTokenFamily(tx, family); err != nil {
+			return User{}, RefreshToken{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return User{}, RefreshToken{}, err
+		}
+		return User{}, RefreshToken{}, errInvalidRefreshToken
+	}
+
+	_, err = tx.Exec(`UPDATE public.refresh_token SET used_at = $1 WHERE id = $2`, time.Now(), id)
+	if err != nil {
+		return User{}, RefreshToken{}, err
+	}
+
+	next.UserID = u.ID
+	next.FamilyID = family
+	if err := insertRefreshToken(tx, next); err != nil {
+		return User{}, RefreshToken{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return User{}, RefreshToken{}, err
+	}
+
+	return u, next, nil
+}
+
+func revokeTokenFamily(q dbtx, family string) error {
+	_, err := q.Exec(
+		`UPDATE public.refresh_token SET revoked_at = $1 WHERE family_id = $2 AND revoked_at IS NULL`,
+		time.Now(), family,
+	)
+
+	return err
+}
+
+func (r *pgUserRepo) RevokeSession(family, jti string, expiresAt time.Time) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeTokenFamily(tx, family); err != nil {
+		return err
+	}
+
+	// Drop denylist entries that can't match a valid token anymore
+	_, err = tx.Exec(`DELETE FROM public.revoked_token WHERE expires_at < $1`, time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO public.revoked_token(jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING`,
+		jti, expiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *pgUserRepo) RevokeUserSessions(userID int) error {
+	_, err := r.db.Exec(
+		`UPDATE public.refresh_token SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL`,
+		time.Now(), userID,
+	)
+
+	return err
+}
+
+// IsAccessTokenRevoked also rejects tokens whose session is gone, e.g. because
+// the user was deleted.
+func (r *pgUserRepo) IsAccessTokenRevoked(jti, family string) (bool, error) {
+	var revoked bool
+
+	err := r.db.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM public.revoked_token WHERE jti = $1)
+			OR EXISTS(SELECT 1 FROM public.refresh_token WHERE family_id = $2 AND revoked_at IS NOT NULL)
+			OR NOT EXISTS(SELECT 1 FROM public.refresh_token WHERE family_id = $2)`,
+		jti, family,
+	).Scan(&revoked)
+
+	return revoked, err
+}
+
+// userColumns is what every user query returns, never the password. Users
+// merged from the old admin list have no email.
+const userColumns = `id, COALESCE(email, ''), firstname, lastname, phone, address, role, country, zipcode`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner) (User, error) {
+	var u User
+
+	err := row.Scan(&u.ID, &u.Email, &u.Firstname, &u.Lastname, &u.Phone, &u.Address, &u.Role, &u.Country, &u.Zipcode)
+
+	return u, err
+}
+
+// userWriteError turns a unique violation on email into errEmailTaken
+func userWriteError(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return errEmailTaken
+	}
+	return err
+}
+
+func (r *pgUserRepo) List() ([]User, error) {
+	rows, err := r.db.Query("SELECT " + userColumns + " FROM public.users ORDER BY id")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var users []User
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+
+	// Check for errors from iterating over rows
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (r *pgUserRepo) Get(id int) (User, error) {
+	u, err := scanUser(r.db.QueryRow("SELECT "+userColumns+" FROM public.users WHERE id = $1", id))
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return User{}, notFoundf("no user found with id %d", id)
+		}
+		return User{}, err
+	}
+
+	return u, nil
+}
+
+func (r *pgUserRepo) Create(user *User) (User, error) {
+	row := r.db.QueryRow(
+		`INSERT INTO public.users(email, password, firstname, lastname, phone, address, role, country, zipcode)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING `+userColumns,
+		user.Email, user.Password, user.Firstname, user.Lastname, user.Phone, user.Address, user.Role, user.Country, user.Zipcode,
+	)
+
+	u, err := scanUser(row)
+	if err != nil {
+		return User{}, userWriteError(err)
+	}
+
+	return u, nil
+}
+
+func (r *pgUserRepo) Update(id int, user *User) (User, error) {
+	row := r.db.QueryRow(
+		`UPDATE public.users
+		SET email = $1, firstname = $2, lastname = $3, phone = $4, address = $5,
+		    role = $6, country = $7, zipcode = $8, password = COALESCE(NULLIF($9, ''), password)
+		WHERE id = $10
+		RETURNING `+userColumns,
+		user.Email, user.Firstname, user.Lastname, user.Phone, user.Address,
+		user.Role, user.Country, user.Zipcode, user.Password, id,
+	)
+
+	u, err := scanUser(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return User{}, notFoundf("no user found with id %d", id)
+		}
+		return User{}, userWriteError(err)
+	}
+
+	return u, nil
+}
+
+// Delete removes a user for good, their sessions go with them
+func (r *pgUserRepo) Delete(id int) error {
+	result, err := r.db.Exec("DELETE FROM public.users WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return notFoundf("no user found with id %d", id)
+	}
+
+	return nil
+}
+
+func (r *pgProductRepo) Create(product *Product) error {
+	if err := checkNewProductStatus(product); err != nil {
+		return err
+	}
+
+	currentTime := (time.Now())
+
+	_, err := r.db.Exec(
+		"INSERT INTO public.product(name, description, defect, type_id, waist, length, chest, owner, status_id, price, saleprice, image, createdate, updatedate) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14);",
+		product.Name, product.Description, product.Defect, product.TypeID, product.Waist, product.Length, product.Chest, product.Owner, product.StatusID, product.Price, product.SalePrice, pq.Array(product.Image), currentTime, currentTime,
+	)
+
+	return err
+}
+
+func (r *pgOwnerRepo) Create(owner *Owner) error {
+
+	_, err := r.db.Exec(
+		"INSERT INTO public.owner(name, commission, user_id) VALUES ($1, $2, NULLIF($3, 0));",
+		owner.Name, owner.Commission, owner.UserID,
+	)
+
+	return ownerWriteError(owner, err)
+}
+
+// Delete soft deletes a product, the row stays for sales history and can be
+// brought back with Restore. The product is locked so an order can't reserve
+// it between the status check and the delete.
+func (r *pgProductRepo) Delete(id int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := queryProductById(tx, id, false, true)
+	if err != nil {
+		return err
+	}
+	if err := checkDeletable(current); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`UPDATE public.product SET deleted_at = $1, updatedate = $1, version = version + 1
+		WHERE id = $2`, time.Now(), id,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *pgProductRepo) Restore(id int) (Product, error) {
+	result, err := r.db.Exec(
+		`UPDATE public.product SET deleted_at = NULL, updatedate = $1, version = version + 1
+		WHERE id = $2 AND deleted_at IS NOT NULL`, time.Now(), id,
+	)
+
+	if err != nil {
+		return Product{}, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+
+	if err != nil {
+		return Product{}, err
+	}
+	if rowsAffected == 0 {
+		return Product{}, notFoundf("no deleted product found with id %d", id)
+	}
+
+	return r.Get(id, false)
+}
+
+// Transition locks the product, checks the move against the lifecycle and
+// writes the new status and its history row in one transaction.
+func (r *pgProductRepo) Transition(id int, change StatusTransition, userID int, expectedVersion int) (Product, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return Product{}, err
+	}
+	defer tx.Rollback()
+
+	updated, err := transitionProduct(tx, id, change, userID, 0, expectedVersion)
+	if err != nil {
+		return Product{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Product{}, err
+	}
+
+	return updated, nil
+}
+
+// transitionProduct does the work of Transition inside the caller's
+// transaction. orderID is the order moving the product, 0 for every other
+// move, which may not touch a product a pending order reserved.
+func transitionProduct(tx *sql.Tx, id int, change StatusTransition, userID, orderID int, expectedVersion int) (Product, error) {
+	current, err := queryProductById(tx, id, false, true)
+	if err != nil {
+		return Product{}, err
+	}
+	if expectedVersion != 0 && current.Version != expectedVersion {
+		return Product{}, errVersionMismatch
+	}
+	if current.Status == statusReserved {
+		holder, err := reservingOrder(tx, id)
+		if err != nil {
+			return Product{}, err
+		}
+		if err := checkOrderHold(current, holder, orderID); err != nil {
+			return Product{}, err
+		}
+	}
+	if err := checkTransition(id, current.Status, change.Status); err != nil {
+		return Product{}, err
+	}
+
+	target, err := findLookup(tx, "status", 0, change.Status)
+	if err != nil {
+		return Product{}, err
+	}
+	if target.ID == 0 {
+		return Product{}, fmt.Errorf("lifecycle status %q is missing, run the migrations", change.Status)
+	}
+
+	currentTime := time.Now()
+
+	_, err = tx.Exec(
+		`UPDATE public.product SET status_id = $1, updatedate = $2, version = version + 1 WHERE id = $3`,
+		target.ID, currentTime, id,
+	)
+	if err != nil {
+		return Product{}, err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO public.product_status_history(product_id, from_status_id, to_status_id, changed_by, note, changed_at)
+		VALUES ($1, $2, $3, NULLIF($4, 0), $5, $6)`,
+		id, current.StatusID, target.ID, userID, change.Note, currentTime,
+	)
+	if err != nil {
+		return Product{}, err
+	}
+
+	if err := recordLedgerEntry(tx, current, change, currentTime); err != nil {
+		return Product{}, err
+	}
+
+	// Only available products are held, whoever held it lost it
+	if current.Status == statusAvailable {
+		if _, err := tx.Exec(`DELETE FROM public.cart_hold WHERE product_id = $1`, id); err != nil {
+			return Product{}, err
+		}
+	}
+
+	return queryProductById(tx, id, false, false)
+}
+
+// History includes deleted products, their history is still worth reading
+func (r *pgProductRepo) History(id int) ([]StatusChange, error) {
+	if _, err := queryProductById(r.db, id, true, false); err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.Query(
+		`SELECT h.id, h.product_id, COALESCE(f.name, ''), t.name, COALESCE(h.changed_by, 0), h.note, h.changed_at
+		FROM public.product_status_history h
+		LEFT JOIN public.status f ON h.from_status_id = f.id
+		JOIN public.status t ON h.to_status_id = t.id
+		WHERE h.product_id = $1
+		ORDER BY h.changed_at, h.id`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []StatusChange{}
+
+	for rows.Next() {
+		var sc StatusChange
+		if err := rows.Scan(&sc.ID, &sc.ProductID, &sc.From, &sc.To, &sc.ChangedBy, &sc.Note, &sc.ChangedAt); err != nil {
+			return nil, err
+		}
+		changes = append(changes, sc)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+func (r *pgProductRepo) Get(id int, includeDeleted bool) (Product, error) {
+	return queryProductById(r.db, id, includeDeleted, false)
+}
+
+// productSelect reads products with the names of their owner, type and
+// status, queries that need more columns put productColumns and productFrom
+// together themselves.
+const productSelect = `
+	SELECT` + productColumns + productFrom
+
+const productColumns = `
+		p.id, p.name, p.description, p.defect, p.type_id, t.name, p.waist, p.length, p.chest, p.owner,
+		p.status_id, s.name, p.price, p.saleprice, p.image, p.createdate, p.updatedate, p.version, p.deleted_at,
+		o.name as ownername, ` + productHeld + ` AS held`
+
+// productHeld is true while someone holds the product in their cart
+const productHeld = `EXISTS (SELECT 1 FROM public.cart_hold h WHERE h.product_id = p.id AND h.expires_at > now())`
+
+const productFrom = `
+	FROM
+		product p
+	JOIN
+		owner o ON p.owner = o.id
+	JOIN
+		type t ON p.type_id = t.id
+	JOIN
+		status s ON p.status_id = s.id
+`
+
+// scanProduct reads the productColumns, followed by extra columns if any
+func scanProduct(row rowScanner, extra ...interface{}) (Product, error) {
+	var p Product
+
+	dest := []interface{}{&p.ID, &p.Name, &p.Description, &p.Defect, &p.TypeID, &p.Type, &p.Waist, &p.Length, &p.Chest, &p.Owner,
+		&p.StatusID, &p.Status, &p.Price, &p.SalePrice, pq.Array(&p.Image), &p.Create_Date, &p.Update_Date, &p.Version, &p.Delete_Date, &p.Owner_Name, &p.Held}
+
+	err := row.Scan(append(dest, extra...)...)
+
+	return p, err
+}
+
+// queryProductById loads one product on q. With lock the row stays locked
+// until q's transaction ends, so a read-modify-write can't interleave.
+func queryProductById(q dbtx, id int, includeDeleted bool, lock bool) (Product, error) {
+	lockSQL := ""
+	if lock {
+		lockSQL = "FOR UPDATE OF p"
+	}
+
+	p, err := scanProduct(q.QueryRow(productSelect+`
+		WHERE
+			p.id = $1 AND ($2 OR p.deleted_at IS NULL)
+		`+lockSQL, id, includeDeleted))
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Product{}, notFoundf("no product found with id %d", id)
+		}
+		return Product{}, err
+	}
+
+	return p, err
+}
+
+func (r *pgOwnerRepo) Get(id int) (Owner, error) {
+	var o Owner
+
+	row := r.db.QueryRow(
+		"SELECT id, name, commission, COALESCE(user_id, 0) FROM public.owner WHERE id = $1;",
+		id,
+	)
+
+	err := row.Scan(&o.ID, &o.Name, &o.Commission, &o.UserID)
+
+	// Handle the case where no rows were found
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// Return a custom error indicating no owner found
+			return Owner{}, notFoundf("no owner found with id %d", id)
+		}
+		// Return any other errors encountered during scanning
+		return Owner{}, err
+	}
+
+	return o, err
+}
+
+func (r *pgOwnerRepo) FindByUser(userID int) (Owner, error) {
+	var o Owner
+
+	err := r.db.QueryRow(
+		"SELECT id, name, commission, user_id FROM public.owner WHERE user_id = $1;",
+		userID,
+	).Scan(&o.ID, &o.Name, &o.Commission, &o.UserID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Owner{}, notFoundf("no owner is linked to user %d", userID)
+		}
+		return Owner{}, err
+	}
+
+	return o, nil
+}
+
+func ownerWriteError(owner *Owner, err error) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "unique_violation" {
+		return conflictf("user %d is already linked to another owner", owner.UserID)
+	}
+	return err
+}
+
+func (r *pgProductRepo) Update(id int, product *Product, expectedVersion int) (Product, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return Product{}, err
+	}
+	defer tx.Rollback()
+
+	updated, err := updateProductTx(tx, id, product, expectedVersion)
+	if err != nil {
+		return Product{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Product{}, err
+	}
+
+	return updated, nil
+}
+
+// updateProductTx overwrites a product, q must be a transaction so the row
+// stays locked between the status check and the update. When expectedVersion
+// isn't 0 the update only happens if nobody changed the row since that
+// version was read.
+func updateProductTx(q dbtx, id int, product *Product, expectedVersion int) (Product, error) {
+	current, err := queryProductById(q, id, false, true)
+	if err != nil {
+		return Product{}, err
+	}
+	if expectedVersion != 0 && current.Version != expectedVersion {
+		return Product{}, errVersionMismatch
+	}
+	if err := checkStatusKept(&current, product); err != nil {
+		return Product{}, err
+	}
+
+	var updatedID int
+	currentTime := time.Now()
+
+	row := q.QueryRow(
+		`UPDATE public.product
+		SET name = $1, description = $2, defect = $3, type_id = $4,
+		    waist = $5, length = $6, chest = $7, owner = $8,
+		    status_id = $9, price = $10, saleprice = $11,
+		    image = $12, updatedate = $13, version = version + 1
+		WHERE id = $14
+		RETURNING id;`,
+		product.Name, product.Description, product.Defect, product.TypeID,
+		product.Waist, product.Length, product.Chest, product.Owner,
+		product.StatusID, product.Price, product.SalePrice,
+		pq.Array(product.Image),
+		currentTime, id,
+	)
+
+	err = row.Scan(&updatedID)
+	if err != nil {
+		return Product{}, err
+	}
+
+	return queryProductById(q, updatedID, false, false)
+}
+
+// Patch only updates the given columns and returns the full product
+// afterwards, including the owner name. The patch is merged into the locked
+// row and validated as a whole, expectedVersion works like in updateProductTx.
+func (r *pgProductRepo) Patch(id int, values []columnValue, expectedVersion int) (Product, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return Product{}, err
+	}
+	defer tx.Rollback()
+
+	current, err := queryProductById(tx, id, false, true)
+	if err != nil {
+		return Product{}, err
+	}
+
+	if expectedVersion != 0 && current.Version != expectedVersion {
+		return Product{}, errVersionMismatch
+	}
+
+	if len(values) == 0 {
+		return current, nil
+	}
+
+	merged := applyProductPatch(current, values)
+	if err := validateProductPatch(&pgLookupRepo{q: tx}, &merged, values); err != nil {
+		return Product{}, err
+	}
+	if err := checkStatusKept(&current, &merged); err != nil {
+		return Product{}, err
+	}
+
+	setClauses := make([]string, 0, len(values)+2)
+	args := make([]interface{}, 0, len(values)+2)
+	seen := map[string]bool{}
+
+	// Values come from the validated product, type and typeid share a column
+	for _, v := range values {
+		if seen[v.column] {
+			continue
+		}
+		seen[v.column] = true
+
+		value := productColumn(&merged, v.column)
+		if arr, ok := value.([]string); ok {
+			args = append(args, pq.Array(arr))
+		} else {
+			args = append(args, value)
+		}
+		setClauses = append(setClauses, fmt.Sprintf("%s = $%d", v.column, len(args)))
+	}
+
+	setClauses = append(setClauses, fmt.Sprintf("updatedate = $%d", len(args)+1), "version = version + 1")
+	args = append(args, time.Now(), id)
+
+	query := fmt.Sprintf("UPDATE public.product SET %s WHERE id = $%d",
+		strings.Join(setClauses, ", "), len(args))
+
+	if _, err := tx.Exec(query, args...); err != nil {
+		return Product{}, err
+	}
+
+	updated, err := queryProductById(tx, id, false, false)
+	if err != nil {
+		return Product{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Product{}, err
+	}
+
+	return updated, nil
+}
+
+// UpdateMany updates every product inside one transaction. Each item runs
+// in its own savepoint so one bad row doesn't abort the rest of the transaction.
+// In atomic mode nothing is committed unless every item was updated, in
+// best-effort mode the items that succeeded are committed.
+func (r *pgProductRepo) UpdateMany(products []Product, mode string) ([]BulkUpdateResult, bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	lookups := &pgLookupRepo{q: tx}
+	results := make([]BulkUpdateResult, 0, len(products))
+	seen := map[int]bool{}
+	failed := false
+
+	for i := range products {
+		product := products[i]
+		result := BulkUpdateResult{ID: product.ID}
+
+		if msg := checkBulkProduct(&product, seen); msg != "" {
+			result.Status = bulkStatusInvalid
+			result.Error = msg
+			results = append(results, result)
+			failed = true
+			continue
+		}
+		seen[product.ID] = true
+
+		if err := validateProduct(lookups, &product); err != nil {
+			invalid, ok := invalidBulkResult(product.ID, err)
+			if !ok {
+				return nil, false, err
+			}
+
+			results = append(results, invalid)
+			failed = true
+			continue
+		}
+
+		if _, err := tx.Exec("SAVEPOINT bulk_item"); err != nil {
+			return nil, false, err
+		}
+
+		// A version in the body guards the item the same way If-Match does
+		updated, err := updateProductTx(tx, product.ID, &product, product.Version)
+		if err != nil {
+			if _, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT bulk_item"); rbErr != nil {
+				return nil, false, rbErr
+			}
+
+			failed = true
+			result.Status, result.Error = bulkErrorStatus(err)
+			results = append(results, result)
+			continue
+		}
+
+		if _, err := tx.Exec("RELEASE SAVEPOINT bulk_item"); err != nil {
+			return nil, false, err
+		}
+
+		result.Status = bulkStatusUpdated
+		result.Product = &updated
+		results = append(results, result)
+	}
+
+	if failed && mode == bulkModeAtomic {
+		rollBackResults(results)
+		return results, false, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+
+	return results, true, nil
+}
+
+func (r *pgOwnerRepo) Update(id int, owner *Owner) (Owner, error) {
+	var o Owner
+
+	// Update the owner table (change name, commission and linked user)
+	row := r.db.QueryRow(
+		`UPDATE public.owner SET name = $1, commission = $2, user_id = NULLIF($3, 0) WHERE id = $4
+		RETURNING id, name, commission, COALESCE(user_id, 0);`,
+		owner.Name, owner.Commission, owner.UserID, id,
+	)
+
+	err := row.Scan(&o.ID, &o.Name, &o.Commission, &o.UserID)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Owner{}, notFoundf("no owner found with id %d", id)
+		}
+		return Owner{}, ownerWriteError(owner, err)
+	}
+
+	return o, nil
+}
+
+func (r *pgProductRepo) ListFiltered(filter ProductFilter, limit, offset int) ([]Product, int, error) {
+	var (
+		products     []Product
+		args         []interface{}
+		whereClauses []string
+	)
+
+	argID := 1
+
+	if !filter.IncludeDeleted {
+		whereClauses = append(whereClauses, "p.deleted_at IS NULL")
+	}
+	if len(filter.Status) > 0 {
+		whereClauses = append(whereClauses, fmt.Sprintf("s.name = ANY($%d)", argID))
+		args = append(args, pq.Array(filter.Status))
+		argID++
+	}
+	if len(filter.Type) > 0 {
+		whereClauses = append(whereClauses, fmt.Sprintf("t.name = ANY($%d)", argID))
+		args = append(args, pq.Array(filter.Type))
+		argID++
+	}
+	if len(filter.Owner) > 0 {
+		whereClauses = append(whereClauses, fmt.Sprintf("p.owner = ANY($%d::int[])", argID))
+		args = append(args, pq.Array(filter.Owner))
+		argID++
+	}
+	if filter.Name != "" {
+		whereClauses = append(whereClauses, fmt.Sprintf("p.name ILIKE $%d", argID))
+		args = append(args, "%"+filter.Name+"%")
+		argID++
+	}
+	if filter.Held != nil {
+		whereClauses = append(whereClauses, fmt.Sprintf("%s = $%d", productHeld, argID))
+		args = append(args, *filter.Held)
+		argID++
+	}
+	// The dates are inclusive, createdto=2024-05-31 still matches that evening
+	for _, r := range []struct {
+		column string
+		dates  DateRange
+	}{
+		{"p.createdate", filter.Created},
+		{"p.updatedate", filter.Updated},
+	} {
+		if r.dates.From != "" {
+			whereClauses = append(whereClauses, fmt.Sprintf("%s >= $%d::date", r.column, argID))
+			args = append(args, r.dates.From)
+			argID++
+		}
+		if r.dates.To != "" {
+			whereClauses = append(whereClauses, fmt.Sprintf("%s < $%d::date + 1", r.column, argID))
+			args = append(args, r.dates.To)
+			argID++
+		}
+	}
+	for _, r := range []struct {
+		column string
+		bounds IntRange
+	}{
+		{"p.waist", filter.Waist},
+		{"p.length", filter.Length},
+		{"p.chest", filter.Chest},
+		{"p.price", filter.Price},
+		{"p.saleprice", filter.SalePrice},
+	} {
+		if r.bounds.Min != nil {
+			whereClauses = append(whereClauses, fmt.Sprintf("%s >= $%d", r.column, argID))
+			args = append(args, *r.bounds.Min)
+			argID++
+		}
+		if r.bounds.Max != nil {
+			whereClauses = append(whereClauses, fmt.Sprintf("%s <= $%d", r.column, argID))
+			args = append(args, *r.bounds.Max)
+			argID++
+		}
+	}
+
+	// The sort column comes from productSortColumns, never from the request
+	var orderBy []string
+	if column, ok := productSortColumns[filter.Sort]; ok {
+		if filter.SortDesc {
+			column += " DESC"
+		}
+		orderBy = append(orderBy, column)
+	}
+
+	// Fits-me keeps products within the tolerance of every given measurement
+	// and orders them by how far off they are in total
+	if fit := filter.Fit; fit != nil {
+		toleranceArg := argID
+		args = append(args, fit.Tolerance)
+		argID++
+
+		var distances []string
+		for _, m := range []struct {
+			column string
+			value  int
+		}{
+			{"p.waist", fit.Waist},
+			{"p.length", fit.Length},
+			{"p.chest", fit.Chest},
+		} {
+			if m.value == 0 {
+				continue
+			}
+			whereClauses = append(whereClauses, fmt.Sprintf("%s BETWEEN $%d::int - $%d::int AND $%d::int + $%d::int",
+				m.column, argID, toleranceArg, argID, toleranceArg))
+			distances = append(distances, fmt.Sprintf("abs(%s - $%d::int)", m.column, argID))
+			args = append(args, m.value)
+			argID++
+		}
+		orderBy = append(orderBy, strings.Join(distances, " + "))
+	}
+	orderSQL := strings.Join(append(orderBy, "p.id"), ", ")
+
+	whereSQL := ""
+	if len(whereClauses) > 0 {
+		whereSQL = "WHERE " + strings.Join(whereClauses, " AND ")
+	}
+
+	// Count query
+	countQuery := `SELECT COUNT(*) FROM product p
+		JOIN type t ON p.type_id = t.id
+		JOIN status s ON p.status_id = s.id ` + whereSQL
+	var count int
+	err := r.db.QueryRow(countQuery, args...).Scan(&count)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	args = append(args, limit, offset)
+	limitArg := argID
+	offsetArg := argID + 1
+
+	query := fmt.Sprintf(`%s
+		%s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d
+	`, productSelect, whereSQL, orderSQL, limitArg, offsetArg)
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		products = append(products, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return products, count, nil
+}
+
+// headlineOptions keep snippets short, the markers become <mark> in headlineHTML
+var headlineOptions = "StartSel=" + headlineStart + ", StopSel=" + headlineStop + ", MinWords=8, MaxWords=25, MaxFragments=2"
+
+// Search tries the full text index first and only falls back to trigram
+// similarity when that finds nothing, typos and Thai text mostly end up there.
+// Both only return products that aren't deleted, best match first.
+func (r *pgProductRepo) Search(query string, limit, offset int) ([]ProductSearchResult, int, string, error) {
+	var total int
+
+	err := r.db.QueryRow(
+		`SELECT COUNT(*) FROM product p
+		WHERE p.deleted_at IS NULL AND p.search_vector @@ websearch_to_tsquery('simple', $1)`,
+		query,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	if total > 0 {
+		results, err := searchRows(r.db, `
+			SELECT`+productColumns+`,
+				ts_rank(p.search_vector, q.query) AS rank,
+				ts_headline('simple', concat_ws(' ', p.name, p.description), q.query, $4)
+			`+productFrom+`
+			CROSS JOIN websearch_to_tsquery('simple', $1) AS q(query)
+			WHERE p.deleted_at IS NULL AND p.search_vector @@ q.query
+			ORDER BY rank DESC, p.id
+			LIMIT $2 OFFSET $3`,
+			nil, query, limit, offset, headlineOptions,
+		)
+		return results, total, searchModeFullText, err
+	}
+
+	// The default threshold of 0.6 misses most single letter typos in short words
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("SET LOCAL pg_trgm.word_similarity_threshold = %g", fuzzySearchThreshold)); err != nil {
+		return nil, 0, "", err
+	}
+
+	pattern := "%" + escapeLike(strings.ToLower(query)) + "%"
+
+	err = tx.QueryRow(
+		`SELECT COUNT(*) FROM product p
+		WHERE p.deleted_at IS NULL AND ($1::text <% p.search_text OR p.search_text LIKE $2)`,
+		query, pattern,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	results, err := searchRows(tx, `
+		SELECT`+productColumns+`,
+			word_similarity($1, p.search_text) AS rank,
+			concat_ws(' ', p.name, p.description)
+		`+productFrom+`
+		WHERE p.deleted_at IS NULL AND ($1::text <% p.search_text OR p.search_text LIKE $2)
+		ORDER BY rank DESC, p.id
+		LIMIT $3 OFFSET $4`,
+		searchTerms(query), query, pattern, limit, offset,
+	)
+
+	return results, total, searchModeFuzzy, err
+}
+
+// searchRows runs a search query whose last two columns are the rank and the
+// snippet. Without terms the snippet is a ts_headline, otherwise plain text
+// that gets highlighted here.
+func searchRows(q dbtx, query string, terms []string, args ...interface{}) ([]ProductSearchResult, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []ProductSearchResult{}
+
+	for rows.Next() {
+		var result ProductSearchResult
+
+		result.Product, err = scanProduct(rows, &result.Rank, &result.Snippet)
+		if err != nil {
+			return nil, err
+		}
+
+		if terms == nil {
+			result.Snippet = headlineHTML(result.Snippet)
+		} else {
+			result.Snippet = highlightSnippet(result.Snippet, terms)
+		}
+		results = append(results, result)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// escapeLike makes s match literally inside a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func (r *pgProductRepo) List(limit int, offset int, includeDeleted bool) ([]Product, int, error) {
+	// Get total count
+	var count int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM product WHERE $1 OR deleted_at IS NULL", includeDeleted).Scan(&count)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Get paginated products
+	rows, err := r.db.Query(productSelect+`
+		WHERE
+			$3 OR p.deleted_at IS NULL
+		ORDER BY p.id
+		LIMIT $1 OFFSET $2;
+	`, limit, offset, includeDeleted)
+
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var products []Product
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		products = append(products, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return products, count, nil
+}
+
+func (r *pgOwnerRepo) List() ([]Owner, error) {
+	rows, err := r.db.Query("SELECT id, name, commission, COALESCE(user_id, 0) FROM owner")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var owners []Owner
+
+	for rows.Next() {
+		var o Owner
+		err := rows.Scan(&o.ID, &o.Name, &o.Commission, &o.UserID)
+		if err != nil {
+			return nil, err
+		}
+		owners = append(owners, o)
+	}
+
+	// Check for errors from iterating over rows
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return owners, nil
+}
+
+// Types and statuses are both id/name tables, these helpers take the table
+// name from the callers below and never from a request.
+
+func listLookups(q dbtx, table string) ([]Type, error) {
+	rows, err := q.Query("SELECT id, name FROM " + table + " ORDER BY id")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var lookups []Type
+
+	for rows.Next() {
+		var t Type
+		err := rows.Scan(&t.ID, &t.Name)
+		if err != nil {
+			return nil, err
+		}
+		lookups = append(lookups, t)
+	}
+
+	// Check for errors from iterating over rows
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return lookups, nil
+}
+
+func getLookup(q dbtx, table string, id int) (Type, error) {
+	var t Type
+
+	err := q.QueryRow("SELECT id, name FROM "+table+" WHERE id = $1", id).Scan(&t.ID, &t.Name)
+	if err == sql.ErrNoRows {
+		return Type{}, notFoundf("no %s found with id %d", table, id)
+	}
+
+	return t, err
+}
+
+// findLookup looks a row up by id when one is given and by name otherwise,
+// a row that doesn't exist comes back as the zero value.
+func findLookup(q dbtx, table string, id int, name string) (Type, error) {
+	var t Type
+
+	err := q.QueryRow(
+		"SELECT id, name FROM "+table+" WHERE ($1 <> 0 AND id = $1) OR ($1 = 0 AND name = $2) ORDER BY id LIMIT 1",
+		id, name,
+	).Scan(&t.ID, &t.Name)
+	if err == sql.ErrNoRows {
+		return Type{}, nil
+	}
+
+	return t, err
+}
+
+func createLookup(q dbtx, table, name string) (Type, error) {
+	var t Type
+
+	err := q.QueryRow("INSERT INTO "+table+"(name) VALUES ($1) RETURNING id, name", name).Scan(&t.ID, &t.Name)
+	if err != nil {
+		return Type{}, lookupWriteError(table, name, err)
+	}
+
+	return t, nil
+}
+
+func updateLookup(q dbtx, table string, id int, name string) (Type, error) {
+	var t Type
+
+	err := q.QueryRow("UPDATE "+table+" SET name = $1 WHERE id = $2 RETURNING id, name", name, id).Scan(&t.ID, &t.Name)
+	if err == sql.ErrNoRows {
+		return Type{}, notFoundf("no %s found with id %d", table, id)
+	}
+	if err != nil {
+		return Type{}, lookupWriteError(table, name, err)
+	}
+
+	return t, nil
+}
+
+// deleteLookup relies on the product foreign key to refuse deleting a row
+// that is still in use, which also covers products created concurrently.
+func deleteLookup(q dbtx, table string, id int) error {
+	result, err := q.Exec("DELETE FROM "+table+" WHERE id = $1", id)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "foreign_key_violation" {
+			return conflictf("%s %d is still used by products", table, id)
+		}
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return notFoundf("no %s found with id %d", table, id)
+	}
+
+	return nil
+}
+
+func lookupWriteError(table, name string, err error) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "unique_violation" {
+		return conflictf("%s %q already exists", table, name)
+	}
+	return err
+}
+
+func (r *pgLookupRepo) ListTypes() ([]Type, error) {
+	return listLookups(r.q, "type")
+}
+
+func (r *pgLookupRepo) GetType(id int) (Type, error) {
+	return getLookup(r.q, "type", id)
+}
+
+func (r *pgLookupRepo) CreateType(name string) (Type, error) {
+	return createLookup(r.q, "type", name)
+}
+
+func (r *pgLookupRepo) UpdateType(id int, name string) (Type, error) {
+	return updateLookup(r.q, "type", id, name)
+}
+
+func (r *pgLookupRepo) DeleteType(id int) error {
+	return deleteLookup(r.q, "type", id)
+}
+
+func (r *pgLookupRepo) ListStatuses() ([]Status, error) {
+	rows, err := listLookups(r.q, "status")
+	if err != nil {
+		return nil, err
+	}
+
+	var allStatus []Status
+	for _, t := range rows {
+		allStatus = append(allStatus, Status(t))
+	}
+
+	return allStatus, nil
+}
+
+func (r *pgLookupRepo) GetStatus(id int) (Status, error) {
+	t, err := getLookup(r.q, "status", id)
+	return Status(t), err
+}
+
+func (r *pgLookupRepo) CreateStatus(name string) (Status, error) {
+	t, err := createLookup(r.q, "status", name)
+	return Status(t), err
+}
+
+func (r *pgLookupRepo) UpdateStatus(id int, name string) (Status, error) {
+	if err := r.checkStatusEditable(id); err != nil {
+		return Status{}, err
+	}
+
+	t, err := updateLookup(r.q, "status", id, name)
+	return Status(t), err
+}
+
+func (r *pgLookupRepo) DeleteStatus(id int) error {
+	if err := r.checkStatusEditable(id); err != nil {
+		return err
+	}
+
+	return deleteLookup(r.q, "status", id)
+}
+
+func (r *pgLookupRepo) checkStatusEditable(id int) error {
+	t, err := getLookup(r.q, "status", id)
+	if err != nil {
+		return err
+	}
+
+	return checkStatusEditable(Status(t))
+}
+
+func (r *pgLookupRepo) ProductReferences(p *Product) (ProductRefs, error) {
+	var refs ProductRefs
+
+	t, err := findLookup(r.q, "type", p.TypeID, p.Type)
+	if err != nil {
+		return ProductRefs{}, err
+	}
+	refs.Type = t
+
+	s, err := findLookup(r.q, "status", p.StatusID, p.Status)
+	if err != nil {
+		return ProductRefs{}, err
+	}
+	refs.Status = Status(s)
+
+	err = r.q.QueryRow(`SELECT EXISTS(SELECT 1 FROM public.owner WHERE id = $1)`, p.Owner).Scan(&refs.Owner)
+
+	return refs, err
+}
+
+const productImageColumns = `id, product_id, position, content_type, size, width, height, created_at, storage_key, web_key, thumb_key`
+
+func scanProductImage(row rowScanner) (ProductImage, error) {
+	var pi ProductImage
+
+	err := row.Scan(&pi.ID, &pi.ProductID, &pi.Position, &pi.ContentType, &pi.Size, &pi.Width, &pi.Height,
+		&pi.Create_Date, &pi.Key, &pi.WebKey, &pi.ThumbKey)
+
+	return pi, err
+}
+
+func listProductImages(q dbtx, productID int) ([]ProductImage, error) {
+	rows, err := q.Query(
+		"SELECT "+productImageColumns+" FROM public.product_image WHERE product_id = $1 ORDER BY position, id",
+		productID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := []ProductImage{}
+
+	for rows.Next() {
+		pi, err := scanProductImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, pi)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+func (r *pgImageRepo) List(productID int) ([]ProductImage, error) {
+	if _, err := queryProductById(r.db, productID, false, false); err != nil {
+		return nil, err
+	}
+
+	return listProductImages(r.db, productID)
+}
+
+// Add locks the product so two uploads can't take the same positions
+func (r *pgImageRepo) Add(productID int, images []ProductImage) ([]ProductImage, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := queryProductById(tx, productID, false, true); err != nil {
+		return nil, err
+	}
+
+	var last int
+	err = tx.QueryRow(`SELECT COALESCE(MAX(position), 0) FROM public.product_image WHERE product_id = $1`, productID).Scan(&last)
+	if err != nil {
+		return nil, err
+	}
+
+	added := make([]ProductImage, 0, len(images))
+
+	for i, pi := range images {
+		stored, err := scanProductImage(tx.QueryRow(
+			`INSERT INTO public.product_image(product_id, position, content_type, size, width, height, storage_key, web_key, thumb_key)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			RETURNING `+productImageColumns,
+			productID, last+i+1, pi.ContentType, pi.Size, pi.Width, pi.Height, pi.Key, pi.WebKey, pi.ThumbKey,
+		))
+		if err != nil {
+			return nil, err
+		}
+		added = append(added, stored)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return added, nil
+}
+
+// Reorder relies on the unique (product_id, position) constraint being
+// deferred, positions are briefly taken twice while they are rewritten.
+func (r *pgImageRepo) Reorder(productID int, order []int) ([]ProductImage, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := queryProductById(tx, productID, false, true); err != nil {
+		return nil, err
+	}
+
+	current, err := listProductImages(tx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(current))
+	for _, pi := range current {
+		ids = append(ids, pi.ID)
+	}
+	if err := checkImageOrder(ids, order); err != nil {
+		return nil, err
+	}
+
+	for i, id := range order {
+		if _, err := tx.Exec(`UPDATE public.product_image SET position = $1 WHERE id = $2`, i+1, id); err != nil {
+			return nil, err
+		}
+	}
+
+	images, err := listProductImages(tx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+func (r *pgImageRepo) Delete(productID, imageID int) (ProductImage, error) {
+	if _, err := queryProductById(r.db, productID, false, false); err != nil {
+		return ProductImage{}, err
+	}
+
+	pi, err := scanProductImage(r.db.QueryRow(
+		`DELETE FROM public.product_image WHERE id = $1 AND product_id = $2 RETURNING `+productImageColumns,
+		imageID, productID,
+	))
+	if err == sql.ErrNoRows {
+		return ProductImage{}, notFoundf("no image %d on product %d", imageID, productID)
+	}
+
+	return pi, err
+}
+
+// recordLedgerEntry writes the ledger side of a transition inside its
+// transaction: the owner's share when the product is sold, and the reverse of
+// the last sale when a sold product is returned. The share is worked out by
+// ownerShare, like in the memory store, so both round the same way.
+func recordLedgerEntry(tx *sql.Tx, current Product, change StatusTransition, at time.Time) error {
+	switch {
+	case change.Status == statusSold:
+		var commission int
+		err := tx.QueryRow(`SELECT commission FROM public.owner WHERE id = $1`, current.Owner).Scan(&commission)
+		if err == sql.ErrNoRows {
+			return notFoundf("no owner found with id %d", current.Owner)
+		}
+		if err != nil {
+			return err
+		}
+
+		price := salePrice(current)
+		_, err = tx.Exec(
+			`INSERT INTO public.owner_ledger(owner_id, product_id, kind, sale_price, commission, amount, note, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			current.Owner, current.ID, ledgerSale, price, commission, ownerShare(price, commission), change.Note, at,
+		)
+		return err
+	case current.Status == statusSold && change.Status == statusReturned:
+		_, err := tx.Exec(
+			`INSERT INTO public.owner_ledger(owner_id, product_id, kind, sale_price, commission, amount, note, created_at)
+			SELECT owner_id, product_id, $2, sale_price, commission, -amount, $3, $4
+			FROM public.owner_ledger
+			WHERE product_id = $1 AND kind = $5
+			ORDER BY id DESC
+			LIMIT 1`,
+			current.ID, ledgerReturn, change.Note, at, ledgerSale,
+		)
+		return err
+	}
+
+	return nil
+}
+
+func (r *pgLedgerRepo) Balance(ownerID int) (OwnerBalance, error) {
+	b := OwnerBalance{OwnerID: ownerID}
+
+	err := r.db.QueryRow(
+		`SELECT o.commission,
+			COALESCE(SUM(l.amount) FILTER (WHERE l.kind <> $2), 0),
+			COALESCE(-SUM(l.amount) FILTER (WHERE l.kind = $2), 0)
+		FROM public.owner o
+		LEFT JOIN public.owner_ledger l ON l.owner_id = o.id
+		WHERE o.id = $1
+		GROUP BY o.id`,
+		ownerID, ledgerPayout,
+	).Scan(&b.Commission, &b.Earned, &b.PaidOut)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return OwnerBalance{}, notFoundf("no owner found with id %d", ownerID)
+		}
+		return OwnerBalance{}, err
+	}
+
+	b.Balance = b.Earned - b.PaidOut
+	return b, nil
+}
+
+func (r *pgLedgerRepo) Statements(ownerID int) ([]OwnerStatement, error) {
+	if _, err := (&pgOwnerRepo{db: r.db}).Get(ownerID); err != nil {
+		return nil, err
+	}
+
+	payouts, err := queryPayouts(r.db, "p.owner_id = $1", ownerID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.Query(
+		`SELECT l.id, l.owner_id, l.kind, COALESCE(l.product_id, 0), COALESCE(p.name, ''), COALESCE(l.payout_id, 0),
+			l.sale_price, l.commission, l.amount, l.note, l.created_at
+		FROM public.owner_ledger l
+		LEFT JOIN public.product p ON p.id = l.product_id
+		WHERE l.owner_id = $1
+		ORDER BY l.created_at, l.id`,
+		ownerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []LedgerEntry
+	for rows.Next() {
+		var e LedgerEntry
+		err := rows.Scan(&e.ID, &e.OwnerID, &e.Kind, &e.ProductID, &e.ProductName, &e.PayoutID,
+			&e.SalePrice, &e.Commission, &e.Amount, &e.Note, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return buildStatements(payouts, entries), nil
+}
+
+// CreatePayoutBatch locks the owners it pays, so two batches can't settle the
+// same entries. Sales recorded while it runs stay open for the next batch.
+func (r *pgLedgerRepo) CreatePayoutBatch(req PayoutRequest, userID int) (PayoutBatch, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return PayoutBatch{}, err
+	}
+	defer tx.Rollback()
+
+	var owners []int
+	err = func() error {
+		rows, err := tx.Query(
+			`SELECT id FROM public.owner WHERE COALESCE(cardinality($1::int[]), 0) = 0 OR id = ANY($1::int[]) ORDER BY id FOR UPDATE`,
+			pq.Array(req.Owners),
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			owners = append(owners, id)
+		}
+		return rows.Err()
+	}()
+	if err != nil {
+		return PayoutBatch{}, err
+	}
+	if err := checkPayoutOwners(req.Owners, owners); err != nil {
+		return PayoutBatch{}, err
+	}
+
+	type openEntries struct {
+		ids    []int64
+		amount int
+	}
+	open := map[int]*openEntries{}
+
+	err = func() error {
+		rows, err := tx.Query(
+			`SELECT id, owner_id, amount FROM public.owner_ledger WHERE payout_id IS NULL AND owner_id = ANY($1::int[])`,
+			pq.Array(owners),
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id int64
+			var ownerID, amount int
+			if err := rows.Scan(&id, &ownerID, &amount); err != nil {
+				return err
+			}
+			if open[ownerID] == nil {
+				open[ownerID] = &openEntries{}
+			}
+			open[ownerID].ids = append(open[ownerID].ids, id)
+			open[ownerID].amount += amount
+		}
+		return rows.Err()
+	}()
+	if err != nil {
+		return PayoutBatch{}, err
+	}
+
+	currentTime := time.Now()
+
+	var batchID int
+	err = tx.QueryRow(
+		`INSERT INTO public.payout_batch(note, created_by, created_at) VALUES ($1, NULLIF($2, 0), $3) RETURNING id`,
+		req.Note, userID, currentTime,
+	).Scan(&batchID)
+	if err != nil {
+		return PayoutBatch{}, err
+	}
+
+	var payoutIDs []int64
+	for _, ownerID := range owners {
+		entries := open[ownerID]
+		// A negative balance, more returned than sold, is carried over
+		if entries == nil || entries.amount <= 0 {
+			continue
+		}
+
+		var payoutID int64
+		err := tx.QueryRow(
+			`INSERT INTO public.payout(batch_id, owner_id, amount, created_at) VALUES ($1, $2, $3, $4) RETURNING id`,
+			batchID, ownerID, entries.amount, currentTime,
+		).Scan(&payoutID)
+		if err != nil {
+			return PayoutBatch{}, err
+		}
+		payoutIDs = append(payoutIDs, payoutID)
+
+		_, err = tx.Exec(`UPDATE public.owner_ledger SET payout_id = $1 WHERE id = ANY($2::int[])`, payoutID, pq.Array(entries.ids))
+		if err != nil {
+			return PayoutBatch{}, err
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO public.owner_ledger(owner_id, payout_id, kind, amount, note, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			ownerID, payoutID, ledgerPayout, -entries.amount, req.Note, currentTime,
+		)
+		if err != nil {
+			return PayoutBatch{}, err
+		}
+	}
+
+	if len(payoutIDs) == 0 {
+		return PayoutBatch{}, conflictf("no owner has a balance to pay out")
+	}
+
+	sold, err := findLookup(tx, "status", 0, statusSold)
+	if err != nil {
+		return PayoutBatch{}, err
+	}
+	paidOut, err := findLookup(tx, "status", 0, statusPaidOut)
+	if err != nil {
+		return PayoutBatch{}, err
+	}
+	if sold.ID == 0 || paidOut.ID == 0 {
+		return PayoutBatch{}, fmt.Errorf("lifecycle statuses are missing, run the migrations")
+	}
+
+	_, err = tx.Exec(
+		`WITH moved AS (
+			UPDATE public.product SET status_id = $2, updatedate = $3, version = version + 1
+			WHERE status_id = $1 AND id IN (
+				SELECT product_id FROM public.owner_ledger WHERE payout_id = ANY($4::int[]) AND kind = $5
+			)
+			RETURNING id
+		)
+		INSERT INTO public.product_status_history(product_id, from_status_id, to_status_id, changed_by, note, changed_at)
+		SELECT id, $1, $2, NULLIF($6, 0), $7, $3 FROM moved`,
+		sold.ID, paidOut.ID, currentTime, pq.Array(payoutIDs), ledgerSale, userID, payoutNote(batchID),
+	)
+	if err != nil {
+		return PayoutBatch{}, err
+	}
+
+	batch, err := queryPayoutBatch(tx, batchID)
+	if err != nil {
+		return PayoutBatch{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return PayoutBatch{}, err
+	}
+
+	return batch, nil
+}
+
+func (r *pgLedgerRepo) GetPayoutBatch(id int) (PayoutBatch, error) {
+	return queryPayoutBatch(r.db, id)
+}
+
+func queryPayoutBatch(q dbtx, id int) (PayoutBatch, error) {
+	var b PayoutBatch
+
+	err := q.QueryRow(
+		`SELECT id, note, COALESCE(created_by, 0), created_at FROM public.payout_batch WHERE id = $1`,
+		id,
+	).Scan(&b.ID, &b.Note, &b.CreatedBy, &b.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return PayoutBatch{}, notFoundf("no payout batch found with id %d", id)
+		}
+		return PayoutBatch{}, err
+	}
+
+	b.Payouts, err = queryPayouts(q, "p.batch_id = $1", id)
+	if err != nil {
+		return PayoutBatch{}, err
+	}
+	for _, p := range b.Payouts {
+		b.Total += p.Amount
+	}
+
+	return b, nil
+}
+
+// queryPayouts reads payouts oldest first, where is a fixed condition on p
+func queryPayouts(q dbtx, where string, args ...interface{}) ([]Payout, error) {
+	rows, err := q.Query(
+		`SELECT p.id, p.batch_id, p.owner_id, o.name, p.amount, p.created_at
+		FROM public.payout p
+		JOIN public.owner o ON o.id = p.owner_id
+		WHERE `+where+`
+		ORDER BY p.id`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payouts := []Payout{}
+	for rows.Next() {
+		var p Payout
+		if err := rows.Scan(&p.ID, &p.BatchID, &p.OwnerID, &p.OwnerName, &p.Amount, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		payouts = append(payouts, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return payouts, nil
+}
+
+const withdrawalSelect = `
+	SELECT w.id, w.product_id, p.name, w.owner_id, w.status, w.note, COALESCE(w.requested_by, 0),
+		COALESCE(w.decided_by, 0), w.decision_note, w.created_at, w.decided_at
+	FROM public.withdrawal_request w
+	JOIN public.product p ON p.id = w.product_id
+`
+
+func scanWithdrawal(row rowScanner) (WithdrawalRequest, error) {
+	var (
+		w         WithdrawalRequest
+		decidedAt sql.NullString
+	)
+	err := row.Scan(&w.ID, &w.ProductID, &w.ProductName, &w.OwnerID, &w.Status, &w.Note, &w.RequestedBy,
+		&w.DecidedBy, &w.DecisionNote, &w.CreatedAt, &decidedAt)
+	w.DecidedAt = decidedAt.String
+	return w, err
+}
+
+func queryWithdrawal(q dbtx, id int, lock bool) (WithdrawalRequest, error) {
+	query := withdrawalSelect + " WHERE w.id = $1"
+	if lock {
+		query += " FOR UPDATE OF w"
+	}
+
+	w, err := scanWithdrawal(q.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return WithdrawalRequest{}, notFoundf("no withdrawal request found with id %d", id)
+	}
+	return w, err
+}
+
+// Create locks the product so it can't be sold between the check and the insert
+func (r *pgWithdrawalRepo) Create(ownerID int, req NewWithdrawal, userID int) (WithdrawalRequest, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return WithdrawalRequest{}, err
+	}
+	defer tx.Rollback()
+
+	p, err := queryProductById(tx, req.ProductID, false, true)
+	if err != nil {
+		return WithdrawalRequest{}, err
+	}
+	if p.Owner != ownerID {
+		return WithdrawalRequest{}, notFoundf("no product found with id %d", req.ProductID)
+	}
+	if err := checkWithdrawable(p); err != nil {
+		return WithdrawalRequest{}, err
+	}
+
+	var id int
+	err = tx.QueryRow(
+		`INSERT INTO public.withdrawal_request(product_id, owner_id, status, note, requested_by, created_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6) RETURNING id`,
+		p.ID, ownerID, withdrawalPending, req.Note, userID, time.Now(),
+	).Scan(&id)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "unique_violation" {
+			return WithdrawalRequest{}, conflictf("product %d already has a pending withdrawal request", p.ID)
+		}
+		return WithdrawalRequest{}, err
+	}
+
+	w, err := queryWithdrawal(tx, id, false)
+	if err != nil {
+		return WithdrawalRequest{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return WithdrawalRequest{}, err
+	}
+
+	return w, nil
+}
+
+func (r *pgWithdrawalRepo) List(ownerID int, status string) ([]WithdrawalRequest, error) {
+	rows, err := r.db.Query(withdrawalSelect+`
+		WHERE ($1 = 0 OR w.owner_id = $1) AND ($2 = '' OR w.status = $2)
+		ORDER BY w.created_at DESC, w.id DESC`,
+		ownerID, status,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []WithdrawalRequest{}
+	for rows.Next() {
+		w, err := scanWithdrawal(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, w)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+func (r *pgWithdrawalRepo) Decide(id int, approve bool, decision WithdrawalDecision, userID int) (WithdrawalRequest, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return WithdrawalRequest{}, err
+	}
+	defer tx.Rollback()
+
+	w, err := queryWithdrawal(tx, id, true)
+	if err != nil {
+		return WithdrawalRequest{}, err
+	}
+	if w.Status != withdrawalPending {
+		return WithdrawalRequest{}, conflictf("withdrawal request %d is already %s", id, w.Status)
+	}
+
+	status := withdrawalRejected
+	if approve {
+		status = withdrawalApproved
+
+		// The product may have been ordered since the request was made
+		current, err := queryProductById(tx, w.ProductID, false, true)
+		if err != nil {
+			return WithdrawalRequest{}, err
+		}
+		if err := checkWithdrawable(current); err != nil {
+			return WithdrawalRequest{}, err
+		}
+		if _, err := transitionProduct(tx, w.ProductID, withdrawalTransition(id, decision.Note), userID, 0, 0); err != nil {
+			return WithdrawalRequest{}, err
+		}
+	}
 
-	err := db.QueryRow(
-		`SELECT id, email, password FROM public.user WHERE email=$1 AND password=$2`,
-		login.Email, login.Password,
-	).Scan(&dbUser.ID, &dbUser.Email, &dbUser.Password)
+	_, err = tx.Exec(
+		`UPDATE public.withdrawal_request SET status = $1, decided_by = NULLIF($2, 0), decision_note = $3, decided_at = $4
+		WHERE id = $5`,
+		status, userID, decision.Note, time.Now(), id,
+	)
+	if err != nil {
+		return WithdrawalRequest{}, err
+	}
 
+	w, err = queryWithdrawal(tx, id, false)
 	if err != nil {
-		return "", err
+		return WithdrawalRequest{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return WithdrawalRequest{}, err
 	}
 
-	// Create JWT token
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := token.Claims.(jwt.MapClaims)
-	claims["email"] = dbUser.Email
-	claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+	return w, nil
+}
 
-	t, err := token.SignedString(jwtSecret)
+// Checkout locks the products in id order, so two checkouts sharing products
+// wait for each other instead of deadlocking. The loser finds them reserved.
+func (r *pgOrderRepo) Checkout(userID int, checkout Checkout) (Order, error) {
+	tx, err := r.db.Begin()
 	if err != nil {
-		return "", err
+		return Order{}, err
 	}
+	defer tx.Rollback()
 
-	return t, nil
-}
+	ids := checkoutOrder(checkout.ProductIDs)
+	products := make([]Product, 0, len(ids))
+	total := 0
+	for _, id := range ids {
+		p, err := queryProductById(tx, id, false, true)
+		if err != nil {
+			return Order{}, err
+		}
+		if err := checkOrderable(p); err != nil {
+			return Order{}, err
+		}
+		holder, err := queryHolder(tx, id)
+		if err != nil {
+			return Order{}, err
+		}
+		if err := checkHolder(id, holder, userID); err != nil {
+			return Order{}, err
+		}
+		products = append(products, p)
+		total += salePrice(p)
+	}
 
-func getUsers() ([]User, error) {
-	rows, err := db.Query("SELECT id, firstname, lastname FROM users")
+	currentTime := time.Now()
 
+	var orderID int
+	err = tx.QueryRow(
+		`INSERT INTO public.orders(user_id, status, total, note, created_at, updated_at)
+		VALUES (NULLIF($1, 0), $2, $3, $4, $5, $5) RETURNING id`,
+		userID, orderPending, total, checkout.Note, currentTime,
+	).Scan(&orderID)
 	if err != nil {
-		return nil, err
+		return Order{}, err
 	}
 
-	defer rows.Close()
-
-	var users []User
+	for _, p := range products {
+		change := StatusTransition{Status: statusReserved, Note: orderNote(orderID, "")}
+		if _, err := transitionProduct(tx, p.ID, change, userID, orderID, 0); err != nil {
+			return Order{}, err
+		}
 
-	for rows.Next() {
-		var u User
-		err := rows.Scan(&u.ID, &u.Firstname, &u.Lastname)
+		_, err := tx.Exec(
+			`INSERT INTO public.order_item(order_id, product_id, price) VALUES ($1, $2, $3)`,
+			orderID, p.ID, salePrice(p),
+		)
 		if err != nil {
-			return nil, err
+			return Order{}, err
 		}
-		users = append(users, u)
 	}
 
-	// Check for errors from iterating over rows
-	if err = rows.Err(); err != nil {
-		return nil, err
+	if err := insertOrderChange(tx, orderID, "", orderPending, userID, checkout.Note, currentTime); err != nil {
+		return Order{}, err
 	}
 
-	return users, nil
-}
-
-func createProduct(product *Product) error {
-	currentTime := (time.Now())
+	order, err := queryOrder(tx, orderID, false)
+	if err != nil {
+		return Order{}, err
+	}
 
-	_, err := db.Exec(
-		"INSERT INTO public.product(name, description, defect, type, waist, length, chest, owner, status, price, saleprice, image, createdate, updatedate) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14);",
-		product.Name, product.Description, product.Defect, product.Type, product.Waist, product.Length, product.Chest, product.Owner, product.Status, product.Price, product.SalePrice, pq.Array(product.Image), currentTime, currentTime,
-	)
+	if err := tx.Commit(); err != nil {
+		return Order{}, err
+	}
 
-	return err
+	return order, nil
 }
 
-func createOwner(owner *Owner) error {
-
-	_, err := db.Exec(
-		"INSERT INTO public.owner(name) VALUES ($1);",
-		owner.Name,
-	)
-
-	return err
+func (r *pgOrderRepo) Get(id int) (Order, error) {
+	return queryOrder(r.db, id, false)
 }
 
-func createUser(user *User) error {
-	_, err := db.Exec(
-		"INSERT INTO public.users(firstname, lastname) VALUES ($1, $2);",
-		user.Firstname, user.Lastname,
-	)
+func (r *pgOrderRepo) List(filter OrderFilter, limit, offset int) ([]Order, int, error) {
+	const where = `WHERE ($1 = 0 OR user_id = $1) AND ($2 = '' OR status = $2)`
 
-	return err
-}
+	var count int
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM public.orders `+where, filter.UserID, filter.Status).Scan(&count)
+	if err != nil {
+		return nil, 0, err
+	}
 
-func deleteProduct(id int) error {
-	result, err := db.Exec(
-		"DELETE FROM public.product WHERE id = $1 ", id,
+	rows, err := r.db.Query(orderSelect+where+`
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3 OFFSET $4`,
+		filter.UserID, filter.Status, limit, offset,
 	)
-
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
+	defer rows.Close()
 
-	rowsAffected, err := result.RowsAffected()
+	orders := []Order{}
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		orders = append(orders, o)
+	}
 
-	if err != nil {
-		return err
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
 	}
-	if rowsAffected == 0 {
-		return fmt.Errorf("no record found to delete")
+
+	if err := loadOrderItems(r.db, orders); err != nil {
+		return nil, 0, err
 	}
 
-	return nil
+	return orders, count, nil
 }
 
-func getProductById(id int) (Product, error) {
-	var p Product
+// Transition locks the order and then its products in id order, like Checkout
+func (r *pgOrderRepo) Transition(id int, change OrderTransition, userID int) (Order, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return Order{}, err
+	}
+	defer tx.Rollback()
 
-	row := db.QueryRow(`
-		SELECT 
-			p.id, p.name, p.description, p.defect, p.type, p.waist, p.length, p.chest, p.owner,
-			p.status, p.price, p.saleprice, p.image, p.createdate, p.updatedate,
-			o.name as ownername
-		FROM 
-			product p
-		JOIN 
-			owner o ON p.owner = o.id
-		WHERE 
-			p.id = $1;
-	`, id)
+	order, err := queryOrder(tx, id, true)
+	if err != nil {
+		return Order{}, err
+	}
+	if err := checkOrderTransition(id, order.Status, change.Status); err != nil {
+		return Order{}, err
+	}
 
-	err := row.Scan(&p.ID, &p.Name, &p.Description, &p.Defect, &p.Type, &p.Waist, &p.Length, &p.Chest, &p.Owner,
-		&p.Status, &p.Price, &p.SalePrice, pq.Array(&p.Image), &p.Create_Date, &p.Update_Date, &p.Owner_Name)
+	if err := moveOrder(tx, order, change, userID, time.Now()); err != nil {
+		return Order{}, err
+	}
 
+	updated, err := queryOrder(tx, id, false)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return Product{}, fmt.Errorf("no product found with id %d", id)
-		}
-		return Product{}, err
+		return Order{}, err
 	}
 
-	return p, err
-}
-
-func getOwnerById(id int) (Owner, error) {
-	var o Owner
+	if err := tx.Commit(); err != nil {
+		return Order{}, err
+	}
 
-	row := db.QueryRow(
-		"SELECT id, name FROM public.owner WHERE id = $1;",
-		id,
-	)
+	return updated, nil
+}
 
-	err := row.Scan(&o.ID, &o.Name)
+// moveOrder does the work of Transition on an order the caller locked and
+// checked the move of
+func moveOrder(tx *sql.Tx, order Order, change OrderTransition, userID int, at time.Time) error {
+	if status, ok := orderProductStatus(order.Status, change.Status); ok {
+		ids := make([]int, 0, len(order.Items))
+		for _, item := range order.Items {
+			ids = append(ids, item.ProductID)
+		}
+		for _, productID := range checkoutOrder(ids) {
+			pc := StatusTransition{Status: status, Note: orderNote(order.ID, change.Note)}
+			if _, err := transitionProduct(tx, productID, pc, userID, order.ID, 0); err != nil {
+				return err
+			}
+		}
+	}
 
-	// Handle the case where no rows were found
+	_, err := tx.Exec(`UPDATE public.orders SET status = $1, updated_at = $2 WHERE id = $3`, change.Status, at, order.ID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			// Return a custom error indicating no product found
-			return Owner{}, fmt.Errorf("no owner found with id %d", id)
-		}
-		// Return any other errors encountered during scanning
-		return Owner{}, err
+		return err
 	}
 
-	return o, err
+	return insertOrderChange(tx, order.ID, order.Status, change.Status, userID, change.Note, at)
 }
 
-func updateProduct(id int, product *Product) (Product, error) {
-	var p Product
-	currentTime := time.Now()
+// reservingOrder is the pending order a product is reserved for, 0 when there
+// is none
+func reservingOrder(q dbtx, productID int) (int, error) {
+	var orderID int
+	err := q.QueryRow(
+		`SELECT o.id FROM public.order_item i
+		JOIN public.orders o ON o.id = i.order_id
+		WHERE i.product_id = $1 AND o.status = $2
+		ORDER BY o.id DESC
+		LIMIT 1`,
+		productID, orderPending,
+	).Scan(&orderID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
 
-	row := db.QueryRow(
-		`UPDATE public.product
-		SET name = $1, description = $2, defect = $3, type = $4,
-		    waist = $5, length = $6, chest = $7, owner = $8,
-		    status = $9, price = $10, saleprice = $11,
-		    image = $12, updatedate = $13
-		WHERE id = $14
-		RETURNING id, name, description, defect, type, waist, length, chest,
-		          owner, status, price, saleprice, image, createdate, updatedate;`,
-		product.Name, product.Description, product.Defect, product.Type,
-		product.Waist, product.Length, product.Chest, product.Owner,
-		product.Status, product.Price, product.SalePrice,
-		pq.Array(product.Image),
-		currentTime, id,
-	)
+	return orderID, err
+}
 
-	err := row.Scan(
-		&p.ID, &p.Name, &p.Description, &p.Defect, &p.Type, &p.Waist, &p.Length,
-		&p.Chest, &p.Owner, &p.Status, &p.Price, &p.SalePrice,
-		pq.Array(&p.Image),
-		&p.Create_Date, &p.Update_Date,
-	)
+// ConfirmPayment locks the order like Transition, so a webhook and staff
+// confirming at the same time can't both pay it
+func (r *pgOrderRepo) ConfirmPayment(id int, payment PaymentConfirmation, userID int) (Order, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return Order{}, err
+	}
+	defer tx.Rollback()
 
+	order, err := queryOrder(tx, id, true)
 	if err != nil {
-		return Product{}, err
+		return Order{}, err
 	}
 
-	return p, nil
-}
+	done, err := checkPayment(order, payment)
+	if err != nil || done {
+		return order, err
+	}
 
-func updateOwner(id int, owner *Owner) (Owner, error) {
-	var o Owner
+	currentTime := time.Now()
 
-	// Update the owner table (change name)
-	row := db.QueryRow(
-		"UPDATE public.owner SET name = $1 WHERE id = $2 RETURNING id, name;",
-		owner.Name, id,
+	_, err = tx.Exec(
+		`INSERT INTO public.order_payment(order_id, amount, source, reference, confirmed_by, note, created_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6, $7)`,
+		id, payment.Amount, payment.Source, payment.Reference, userID, payment.Note, currentTime,
 	)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "unique_violation" {
+			return Order{}, conflictf("payment reference %s was already used for another order", payment.Reference)
+		}
+		return Order{}, err
+	}
 
-	err := row.Scan(&o.ID, &o.Name)
+	if err := moveOrder(tx, order, paymentTransition(payment), userID, currentTime); err != nil {
+		return Order{}, err
+	}
 
+	updated, err := queryOrder(tx, id, false)
 	if err != nil {
-		return Owner{}, err
+		return Order{}, err
 	}
 
-	return o, nil
+	if err := tx.Commit(); err != nil {
+		return Order{}, err
+	}
+
+	return updated, nil
 }
 
-func getProductWithFilter(limit, offset int, status, prodType, name string) ([]Product, int, error) {
-	var (
-		products     []Product
-		args         []interface{}
-		whereClauses []string
-	)
+const orderSelect = `
+	SELECT id, COALESCE(user_id, 0), status, total, note, created_at, updated_at
+	FROM public.orders
+`
 
-	argID := 1
+func scanOrder(row rowScanner) (Order, error) {
+	var o Order
+	err := row.Scan(&o.ID, &o.UserID, &o.Status, &o.Total, &o.Note, &o.CreatedAt, &o.UpdatedAt)
+	return o, err
+}
 
-	if status != "" {
-		whereClauses = append(whereClauses, fmt.Sprintf("p.status = $%d", argID))
-		args = append(args, status)
-		argID++
-	}
-	if prodType != "" {
-		whereClauses = append(whereClauses, fmt.Sprintf("p.type = $%d", argID))
-		args = append(args, prodType)
-		argID++
-	}
-	if name != "" {
-		whereClauses = append(whereClauses, fmt.Sprintf("p.name ILIKE $%d", argID))
-		args = append(args, "%"+name+"%")
-		argID++
-	}
+func insertOrderChange(tx *sql.Tx, orderID int, from, to string, userID int, note string, at time.Time) error {
+	_, err := tx.Exec(
+		`INSERT INTO public.order_status_history(order_id, from_status, to_status, changed_by, note, changed_at)
+		VALUES ($1, $2, $3, NULLIF($4, 0), $5, $6)`,
+		orderID, from, to, userID, note, at,
+	)
+	return err
+}
 
-	whereSQL := ""
-	if len(whereClauses) > 0 {
-		whereSQL = "WHERE " + strings.Join(whereClauses, " AND ")
+// queryOrder reads an order with its items, history and payment, lock
+// takes the row lock Transition needs
+func queryOrder(q dbtx, id int, lock bool) (Order, error) {
+	query := orderSelect + " WHERE id = $1"
+	if lock {
+		query += " FOR UPDATE"
 	}
 
-	// Count query
-	countQuery := "SELECT COUNT(*) FROM product p " + whereSQL
-	var count int
-	err := db.QueryRow(countQuery, args...).Scan(&count)
+	o, err := scanOrder(q.QueryRow(query, id))
 	if err != nil {
-		return nil, 0, err
+		if err == sql.ErrNoRows {
+			return Order{}, notFoundf("no order found with id %d", id)
+		}
+		return Order{}, err
 	}
 
-	args = append(args, limit, offset)
-	limitArg := argID
-	offsetArg := argID + 1
-
-	query := fmt.Sprintf(`
-		SELECT 
-			p.id, p.name, p.description, p.defect, p.type, p.waist, p.length, p.chest, p.owner,
-			p.status, p.price, p.saleprice, p.image, p.createdate, p.updatedate,
-			o.name as ownername
-		FROM 
-			product p
-		JOIN 
-			owner o ON p.owner = o.id
-		%s
-		ORDER BY p.id
-		LIMIT $%d OFFSET $%d
-	`, whereSQL, limitArg, offsetArg)
+	orders := []Order{o}
+	if err := loadOrderItems(q, orders); err != nil {
+		return Order{}, err
+	}
+	o = orders[0]
 
-	rows, err := db.Query(query, args...)
+	rows, err := q.Query(
+		`SELECT from_status, to_status, COALESCE(changed_by, 0), note, changed_at
+		FROM public.order_status_history
+		WHERE order_id = $1
+		ORDER BY changed_at, id`,
+		id,
+	)
 	if err != nil {
-		return nil, 0, err
+		return Order{}, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var p Product
-		err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Defect, &p.Type, &p.Waist, &p.Length, &p.Chest, &p.Owner,
-			&p.Status, &p.Price, &p.SalePrice, pq.Array(&p.Image), &p.Create_Date, &p.Update_Date, &p.Owner_Name)
-		if err != nil {
-			return nil, 0, err
+		var oc OrderChange
+		if err := rows.Scan(&oc.From, &oc.To, &oc.ChangedBy, &oc.Note, &oc.ChangedAt); err != nil {
+			return Order{}, err
 		}
-		products = append(products, p)
+		o.History = append(o.History, oc)
 	}
-
 	if err := rows.Err(); err != nil {
-		return nil, 0, err
+		return Order{}, err
 	}
 
-	return products, count, nil
+	var payment OrderPayment
+	err = q.QueryRow(
+		`SELECT id, order_id, amount, source, reference, COALESCE(confirmed_by, 0), note, created_at
+		FROM public.order_payment
+		WHERE order_id = $1`,
+		id,
+	).Scan(&payment.ID, &payment.OrderID, &payment.Amount, &payment.Source, &payment.Reference,
+		&payment.ConfirmedBy, &payment.Note, &payment.CreatedAt)
+	switch {
+	case err == nil:
+		o.Payment = &payment
+	case err != sql.ErrNoRows:
+		return Order{}, err
+	}
+
+	return o, nil
 }
 
-func getProducts(limit int, offset int) ([]Product, int, error) {
-	// Get total count
-	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM product").Scan(&count)
-	if err != nil {
-		return nil, 0, err
+// loadOrderItems fills in the items of every order with one query
+func loadOrderItems(q dbtx, orders []Order) error {
+	if len(orders) == 0 {
+		return nil
 	}
 
-	// Get paginated products
-	rows, err := db.Query(`
-		SELECT 
-			p.id, p.name, p.description, p.defect, p.type, p.waist, p.length, p.chest, p.owner,
-			p.status, p.price, p.saleprice, p.image, p.createdate, p.updatedate,
-			o.name as ownername
-		FROM 
-			product p
-		JOIN 
-			owner o ON p.owner = o.id
-		ORDER BY p.id
-		LIMIT $1 OFFSET $2;
-	`, limit, offset)
+	byID := make(map[int]*Order, len(orders))
+	ids := make([]int64, 0, len(orders))
+	for i := range orders {
+		orders[i].Items = []OrderItem{}
+		byID[orders[i].ID] = &orders[i]
+		ids = append(ids, int64(orders[i].ID))
+	}
 
+	rows, err := q.Query(
+		`SELECT i.id, i.order_id, i.product_id, p.name, i.price
+		FROM public.order_item i
+		JOIN public.product p ON p.id = i.product_id
+		WHERE i.order_id = ANY($1)
+		ORDER BY i.order_id, i.id`,
+		pq.Array(ids),
+	)
 	if err != nil {
-		return nil, 0, err
+		return err
 	}
 	defer rows.Close()
 
-	var products []Product
 	for rows.Next() {
-		var p Product
-		err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Defect, &p.Type, &p.Waist, &p.Length, &p.Chest, &p.Owner,
-			&p.Status, &p.Price, &p.SalePrice, pq.Array(&p.Image), &p.Create_Date, &p.Update_Date, &p.Owner_Name)
-		if err != nil {
-			return nil, 0, err
+		var (
+			item    OrderItem
+			orderID int
+		)
+		if err := rows.Scan(&item.ID, &orderID, &item.ProductID, &item.ProductName, &item.Price); err != nil {
+			return err
 		}
-		products = append(products, p)
-	}
-
-	if err = rows.Err(); err != nil {
-		return nil, 0, err
+		byID[orderID].Items = append(byID[orderID].Items, item)
 	}
 
-	return products, count, nil
+	return rows.Err()
 }
 
-func countProducts() (int, error) {
-	var count int
+func (r *pgCartRepo) Get(userID int) (Cart, error) {
+	return queryCart(r.db, userID)
+}
 
-	err := db.QueryRow("SELECT COUNT(*) FROM product;").Scan(&count)
+// Add locks the product like Checkout does, so a hold and a checkout of the
+// same product can't both go through. An expired hold nobody swept yet is
+// taken over.
+func (r *pgCartRepo) Add(userID, productID int, ttl time.Duration) (Cart, error) {
+	tx, err := r.db.Begin()
 	if err != nil {
-		return 0, err
+		return Cart{}, err
 	}
+	defer tx.Rollback()
 
-	return count, nil
-}
-
-func getOwners() ([]Owner, error) {
-	rows, err := db.Query("SELECT id, name FROM owner")
+	p, err := queryProductById(tx, productID, false, true)
+	if err != nil {
+		return Cart{}, err
+	}
 
+	holder, err := queryHolder(tx, productID)
 	if err != nil {
-		return nil, err
+		return Cart{}, err
+	}
+	if err := checkHoldable(p, holder, userID); err != nil {
+		return Cart{}, err
 	}
 
-	defer rows.Close()
+	var held int
+	err = tx.QueryRow(
+		`SELECT COUNT(*) FROM public.cart_hold WHERE user_id = $1 AND expires_at > now()`, userID,
+	).Scan(&held)
+	if err != nil {
+		return Cart{}, err
+	}
+	if err := checkCartSize(held); err != nil {
+		return Cart{}, err
+	}
 
-	var owners []Owner
+	_, err = tx.Exec(
+		`INSERT INTO public.cart_hold(product_id, user_id, created_at, expires_at)
+		VALUES ($1, $2, now(), now() + $3 * interval '1 millisecond')
+		ON CONFLICT (product_id) DO UPDATE
+		SET user_id = EXCLUDED.user_id, created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at`,
+		productID, userID, ttl.Milliseconds(),
+	)
+	if err != nil {
+		return Cart{}, err
+	}
 
-	for rows.Next() {
-		var o Owner
-		err := rows.Scan(&o.ID, &o.Name)
-		if err != nil {
-			return nil, err
-		}
-		owners = append(owners, o)
+	cart, err := queryCart(tx, userID)
+	if err != nil {
+		return Cart{}, err
 	}
 
-	// Check for errors from iterating over rows
-	if err = rows.Err(); err != nil {
-		return nil, err
+	if err := tx.Commit(); err != nil {
+		return Cart{}, err
 	}
 
-	return owners, nil
+	return cart, nil
 }
 
-func getTypes() ([]Type, error) {
-	rows, err := db.Query("SELECT id, name FROM type")
-
+func (r *pgCartRepo) Remove(userID, productID int) (Cart, error) {
+	result, err := r.db.Exec(
+		`DELETE FROM public.cart_hold WHERE product_id = $1 AND user_id = $2 AND expires_at > now()`,
+		productID, userID,
+	)
 	if err != nil {
-		return nil, err
+		return Cart{}, err
 	}
 
-	defer rows.Close()
-
-	var types []Type
-
-	for rows.Next() {
-		var t Type
-		err := rows.Scan(&t.ID, &t.Name)
-		if err != nil {
-			return nil, err
-		}
-		types = append(types, t)
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return Cart{}, err
+	}
+	if rowsAffected == 0 {
+		return Cart{}, notFoundf("product %d isn't in your cart", productID)
 	}
 
-	// Check for errors from iterating over rows
-	if err = rows.Err(); err != nil {
-		return nil, err
+	return queryCart(r.db, userID)
+}
+
+func (r *pgCartRepo) ReleaseExpired() (int, error) {
+	result, err := r.db.Exec(`DELETE FROM public.cart_hold WHERE expires_at <= now()`)
+	if err != nil {
+		return 0, err
 	}
 
-	return types, nil
+	released, err := result.RowsAffected()
+	return int(released), err
 }
 
-func getStatus() ([]Status, error) {
-	rows, err := db.Query("SELECT id, name FROM status")
+// queryHolder returns who holds a product now, 0 when nobody does
+func queryHolder(q dbtx, productID int) (int, error) {
+	var userID int
+	err := q.QueryRow(
+		`SELECT user_id FROM public.cart_hold WHERE product_id = $1 AND expires_at > now()`, productID,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return userID, err
+}
 
+// queryCart reads the live holds of a user, a product deleted while held
+// drops out of the cart
+func queryCart(q dbtx, userID int) (Cart, error) {
+	rows, err := q.Query(
+		`SELECT p.id, p.name, p.price, p.saleprice, h.expires_at
+		FROM public.cart_hold h
+		JOIN public.product p ON p.id = h.product_id
+		WHERE h.user_id = $1 AND h.expires_at > now() AND p.deleted_at IS NULL
+		ORDER BY h.created_at, p.id`,
+		userID,
+	)
 	if err != nil {
-		return nil, err
+		return Cart{}, err
 	}
-
 	defer rows.Close()
 
-	var allStatus []Status
-
+	var items []CartItem
 	for rows.Next() {
-		var s Status
-		err := rows.Scan(&s.ID, &s.Name)
-		if err != nil {
-			return nil, err
+		var (
+			item CartItem
+			p    Product
+		)
+		if err := rows.Scan(&item.ProductID, &item.ProductName, &p.Price, &p.SalePrice, &item.HeldUntil); err != nil {
+			return Cart{}, err
 		}
-		allStatus = append(allStatus, s)
+		item.Price = salePrice(p)
+		items = append(items, item)
 	}
 
-	// Check for errors from iterating over rows
-	if err = rows.Err(); err != nil {
-		return nil, err
+	if err := rows.Err(); err != nil {
+		return Cart{}, err
 	}
 
-	return allStatus, nil
+	return newCart(items), nil
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+// Sentinel errors the data layer wraps its errors in. Handlers just return
+// them and errorHandler picks the status code, callers test with errors.Is.
+var (
+	ErrNotFound             = errors.New("not found")
+	ErrConflict             = errors.New("conflict")
+	ErrValidation           = errors.New("validation failed")
+	ErrUnauthorized         = errors.New("unauthorized")
+	ErrForbidden            = errors.New("forbidden")
+	ErrPreconditionFailed   = errors.New("precondition failed")
+	ErrPreconditionRequired = errors.New("precondition required")
+)
+
+// DomainError carries a message meant for the client next to the sentinel
+// that classifies it.
+type DomainError struct {
+	Kind    error
+	Message string
+}
+
+func (e *DomainError) Error() string {
+	return e.Message
+}
+
+func (e *DomainError) Unwrap() error {
+	return e.Kind
+}
+
+func notFoundf(format string, args ...interface{}) error {
+	return &DomainError{Kind: ErrNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+func conflictf(format string, args ...interface{}) error {
+	return &DomainError{Kind: ErrConflict, Message: fmt.Sprintf(format, args...)}
+}
+
+func unauthorized(message string) error {
+	return &DomainError{Kind: ErrUnauthorized, Message: message}
+}
+
+func forbidden(message string) error {
+	return &DomainError{Kind: ErrForbidden, Message: message}
+}
+
+func badRequest(message string) error {
+	return fiber.NewError(fiber.StatusBadRequest, message)
+}
+
+type ErrorBody struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	RequestID string       `json:"requestid,omitempty"`
+	Details   []FieldError `json:"details,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+var errorKinds = []struct {
+	kind   error
+	status int
+	code   string
+}{
+	{ErrNotFound, fiber.StatusNotFound, "not_found"},
+	{ErrConflict, fiber.StatusConflict, "conflict"},
+	{ErrValidation, fiber.StatusUnprocessableEntity, "validation_error"},
+	{ErrUnauthorized, fiber.StatusUnauthorized, "unauthorized"},
+	{ErrForbidden, fiber.StatusForbidden, "forbidden"},
+	{ErrPreconditionFailed, fiber.StatusPreconditionFailed, "precondition_failed"},
+	{ErrPreconditionRequired, fiber.StatusPreconditionRequired, "precondition_required"},
+}
+
+// pqErrors are the driver errors a client can cause. The driver's own message
+// names tables and constraints, so clients get a fixed one and the driver's
+// is only logged.
+var pqErrors = map[string]struct {
+	status  int
+	code    string
+	message string
+}{
+	"unique_violation":            {fiber.StatusConflict, "conflict", "A record with the same value already exists"},
+	"foreign_key_violation":       {fiber.StatusConflict, "conflict", "The request refers to a record that doesn't exist or is still in use"},
+	"check_violation":             {fiber.StatusBadRequest, "bad_request", "A value is out of range"},
+	"not_null_violation":          {fiber.StatusBadRequest, "bad_request", "A required value is missing"},
+	"invalid_text_representation": {fiber.StatusBadRequest, "bad_request", "A value has the wrong format"},
+}
+
+// errorHandler is the Fiber ErrorHandler, every error a handler returns ends
+// up here and goes out in the same JSON envelope.
+func errorHandler(c *fiber.Ctx, err error) error {
+	status, body := errorResponse(err)
+	body.RequestID = requestID(c)
+
+	var pqErr *pq.Error
+	if status >= fiber.StatusInternalServerError || errors.As(err, &pqErr) {
+		log.Printf("request %s %s %s failed: %v", body.RequestID, c.Method(), c.Path(), err)
+	}
+
+	return c.Status(status).JSON(ErrorResponse{Error: body})
+}
+
+func errorResponse(err error) (int, ErrorBody) {
+	if verr, ok := asValidationError(err); ok {
+		return fiber.StatusUnprocessableEntity, ErrorBody{
+			Code:    "validation_error",
+			Message: "The request has invalid fields",
+			Details: verr.Errors,
+		}
+	}
+
+	for _, ek := range errorKinds {
+		if errors.Is(err, ek.kind) {
+			return ek.status, ErrorBody{Code: ek.code, Message: err.Error()}
+		}
+	}
+
+	var fe *fiber.Error
+	if errors.As(err, &fe) {
+		return fe.Code, ErrorBody{Code: statusCode(fe.Code), Message: fe.Message}
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		if pe, ok := pqErrors[pqErr.Code.Name()]; ok {
+			return pe.status, ErrorBody{Code: pe.code, Message: pe.message}
+		}
+	}
+
+	return fiber.StatusInternalServerError, ErrorBody{
+		Code:    "internal_error",
+		Message: "Something went wrong, please try again later",
+	}
+}
+
+// statusCode turns 404 into "not_found" for errors that only have a status
+func statusCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ReplaceAll(strings.ToLower(text), " ", "_")
+}
+
+func requestID(c *fiber.Ctx) string {
+	id, _ := c.Locals("requestid").(string)
+	return id
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// productETag is a strong ETag built from the product's version column,
+// which is bumped by every update.
+func productETag(p Product) string {
+	return fmt.Sprintf(`"%d"`, p.Version)
+}
+
+var errIfMatchFailed error = &DomainError{Kind: ErrPreconditionFailed, Message: "If-Match does not match the current product"}
+
+var errIfMatchRequired error = &DomainError{Kind: ErrPreconditionRequired, Message: `If-Match is required, send the product's ETag or "*" to overwrite any version`}
+
+// requireIfMatch is ifMatchVersion for the writes that replace what a client
+// read, PUT and PATCH, so one staff member can't silently overwrite another.
+// "*" still skips the check on purpose.
+func requireIfMatch(c *fiber.Ctx) (int, error) {
+	if strings.TrimSpace(c.Get(fiber.HeaderIfMatch)) == "" {
+		return 0, errIfMatchRequired
+	}
+	return ifMatchVersion(c)
+}
+
+// ifMatchVersion reads the If-Match header of a write. It returns 0 when the
+// client didn't ask for a check, and an error when the header can never match
+// (malformed or weak tags, which If-Match doesn't accept).
+func ifMatchVersion(c *fiber.Ctx) (int, error) {
+	header := strings.TrimSpace(c.Get(fiber.HeaderIfMatch))
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+
+	tag := strings.TrimSuffix(strings.TrimPrefix(header, `"`), `"`)
+	if len(tag)+2 != len(header) {
+		return 0, errIfMatchFailed
+	}
+
+	version, err := strconv.Atoi(tag)
+	if err != nil || version <= 0 {
+		return 0, errIfMatchFailed
+	}
+
+	return version, nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// dateLayout is how the date range parameters are written
+const dateLayout = "2006-01-02"
+
+// productSortColumns is every sort key clients may ask for and the column it
+// orders by. Only these column names ever reach the SQL, never the parameter.
+var productSortColumns = map[string]string{
+	"price":      "p.price",
+	"saleprice":  "p.saleprice",
+	"createdate": "p.createdate",
+	"name":       "lower(p.name)",
+}
+
+// defaultFitTolerance is how far off each measurement may be in fits-me mode
+// when the client doesn't pass a tolerance
+const defaultFitTolerance = 2
+
+// IntRange bounds a number from both sides, a nil end is open
+type IntRange struct {
+	Min *int
+	Max *int
+}
+
+func (r IntRange) contains(n int) bool {
+	return (r.Min == nil || n >= *r.Min) && (r.Max == nil || n <= *r.Max)
+}
+
+// DateRange holds inclusive YYYY-MM-DD dates, an empty end is open. The dates
+// compare as strings, like the date part of createdate and updatedate.
+type DateRange struct {
+	From string
+	To   string
+}
+
+func (r DateRange) contains(timestamp string) bool {
+	day := timestamp
+	if len(day) > len(dateLayout) {
+		day = day[:len(dateLayout)]
+	}
+	return (r.From == "" || day >= r.From) && (r.To == "" || day <= r.To)
+}
+
+// FitQuery holds the measurements of a customer, 0 leaves one out. Products
+// fit when every given measurement is within Tolerance of theirs.
+type FitQuery struct {
+	Waist     int
+	Length    int
+	Chest     int
+	Tolerance int
+}
+
+// ProductFilter is what GET /product/filter narrows the list down with. A
+// product matches a list when it has any of the values. Products are ordered
+// by Sort, one of productSortColumns, or else with Fit set by how close they
+// fit, best first, and by id last.
+type ProductFilter struct {
+	Status         []string
+	Type           []string
+	Owner          []int
+	Name           string
+	IncludeDeleted bool
+
+	// Held keeps only products someone holds in their cart, or with false
+	// only the ones nobody does
+	Held *bool
+
+	Created DateRange
+	Updated DateRange
+
+	Sort     string
+	SortDesc bool
+
+	Waist     IntRange
+	Length    IntRange
+	Chest     IntRange
+	Price     IntRange
+	SalePrice IntRange
+
+	Fit *FitQuery
+}
+
+// measurements pairs the fit query with the product measurements it is held
+// against, leaving out the ones the customer didn't give
+func (f FitQuery) measurements(p Product) [][2]int {
+	var pairs [][2]int
+	for _, m := range [][2]int{{f.Waist, p.Waist}, {f.Length, p.Length}, {f.Chest, p.Chest}} {
+		if m[0] != 0 {
+			pairs = append(pairs, m)
+		}
+	}
+	return pairs
+}
+
+// fits reports whether p is within the tolerance and how far off it is in
+// total, smaller is a better fit
+func (f FitQuery) fits(p Product) (bool, int) {
+	distance := 0
+	for _, m := range f.measurements(p) {
+		d := m[0] - m[1]
+		if d < 0 {
+			d = -d
+		}
+		if d > f.Tolerance {
+			return false, 0
+		}
+		distance += d
+	}
+	return true, distance
+}
+
+// matches reports whether p passes the filters, the fit is checked
+// separately since it also orders the results
+func (f ProductFilter) matches(p Product) bool {
+	return (len(f.Status) == 0 || slices.Contains(f.Status, p.Status)) &&
+		(len(f.Type) == 0 || slices.Contains(f.Type, p.Type)) &&
+		(len(f.Owner) == 0 || slices.Contains(f.Owner, p.Owner)) &&
+		(f.Name == "" || strings.Contains(strings.ToLower(p.Name), strings.ToLower(f.Name))) &&
+		(f.Held == nil || *f.Held == p.Held) &&
+		f.Created.contains(p.Create_Date) &&
+		f.Updated.contains(p.Update_Date) &&
+		f.Waist.contains(p.Waist) &&
+		f.Length.contains(p.Length) &&
+		f.Chest.contains(p.Chest) &&
+		f.Price.contains(p.Price) &&
+		f.SalePrice.contains(p.SalePrice)
+}
+
+// parseProductFilter reads the filters from the query string: status, type
+// and owner lists, held, the created/updated date ranges, minwaist/maxwaist
+// and the other ranges, the fits-me measurements waist, length, chest and
+// tolerance and the sort. Every bad parameter is reported at once.
+func parseProductFilter(c *fiber.Ctx) (ProductFilter, error) {
+	f := ProductFilter{
+		Status: queryList(c, "status"),
+		Type:   queryList(c, "type"),
+		Name:   c.Query("name"),
+	}
+	v := &ValidationError{}
+
+	for _, raw := range queryList(c, "owner") {
+		id, err := strconv.Atoi(raw)
+		if err != nil {
+			v.add("owner", "must be a list of owner ids")
+			break
+		}
+		f.Owner = append(f.Owner, id)
+	}
+
+	for _, r := range []struct {
+		name string
+		into *DateRange
+	}{
+		{"created", &f.Created},
+		{"updated", &f.Updated},
+	} {
+		r.into.From = queryDate(c, v, r.name+"from")
+		r.into.To = queryDate(c, v, r.name+"to")
+		if r.into.From != "" && r.into.To != "" && r.into.From > r.into.To {
+			v.add(r.name+"from", fmt.Sprintf("must not be after %sto", r.name))
+		}
+	}
+
+	if raw := c.Query("held"); raw != "" {
+		held, err := strconv.ParseBool(raw)
+		if err != nil {
+			v.add("held", "must be true or false")
+		} else {
+			f.Held = &held
+		}
+	}
+
+	if key := c.Query("sort"); key != "" {
+		f.Sort, f.SortDesc = strings.CutPrefix(key, "-")
+		if _, ok := productSortColumns[f.Sort]; !ok {
+			v.add("sort", "must be one of "+strings.Join(productSortKeys(), ", ")+", with a leading - for descending")
+		}
+	}
+
+	for _, r := range []struct {
+		name string
+		into *IntRange
+	}{
+		{"waist", &f.Waist},
+		{"length", &f.Length},
+		{"chest", &f.Chest},
+		{"price", &f.Price},
+		{"saleprice", &f.SalePrice},
+	} {
+		r.into.Min = queryInt(c, v, "min"+r.name)
+		r.into.Max = queryInt(c, v, "max"+r.name)
+		if r.into.Min != nil && r.into.Max != nil && *r.into.Min > *r.into.Max {
+			v.add("min"+r.name, fmt.Sprintf("must not be greater than max%s", r.name))
+		}
+	}
+
+	fit := FitQuery{Tolerance: defaultFitTolerance}
+	given := false
+	for _, m := range []struct {
+		name string
+		into *int
+	}{
+		{"waist", &fit.Waist},
+		{"length", &fit.Length},
+		{"chest", &fit.Chest},
+	} {
+		n := queryInt(c, v, m.name)
+		if n == nil {
+			continue
+		}
+		if *n <= 0 {
+			v.add(m.name, "must be greater than 0")
+			continue
+		}
+		*m.into = *n
+		given = true
+	}
+
+	if tolerance := queryInt(c, v, "tolerance"); tolerance != nil {
+		switch {
+		case *tolerance < 0:
+			v.add("tolerance", "must not be negative")
+		case !given && !v.has("waist") && !v.has("length") && !v.has("chest"):
+			v.add("tolerance", "needs at least one of waist, length or chest")
+		default:
+			fit.Tolerance = *tolerance
+		}
+	}
+
+	if given {
+		f.Fit = &fit
+	}
+
+	return f, v.err()
+}
+
+// queryInt reads an optional integer parameter, nil when it isn't there
+func queryInt(c *fiber.Ctx, v *ValidationError, name string) *int {
+	raw := c.Query(name)
+	if raw == "" {
+		return nil
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		v.add(name, "must be a whole number")
+		return nil
+	}
+	return &n
+}
+
+// queryList reads a parameter given more than once or as a comma separated
+// list, or both
+func queryList(c *fiber.Ctx, name string) []string {
+	var values []string
+	for _, raw := range c.Context().QueryArgs().PeekMulti(name) {
+		for _, value := range strings.Split(string(raw), ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+// queryDate reads an optional YYYY-MM-DD parameter
+func queryDate(c *fiber.Ctx, v *ValidationError, name string) string {
+	raw := c.Query(name)
+	if raw == "" {
+		return ""
+	}
+
+	if _, err := time.Parse(dateLayout, raw); err != nil {
+		v.add(name, "must be a date like 2024-05-31")
+		return ""
+	}
+	return raw
+}
+
+func productSortKeys() []string {
+	keys := make([]string, 0, len(productSortColumns))
+	for key := range productSortColumns {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// compare orders two products by the sort key like cmp.Compare, 0 when there
+// is no sort key or it doesn't tell them apart
+func (f ProductFilter) compare(a, b Product) int {
+	var cmp int
+	switch f.Sort {
+	case "price":
+		cmp = a.Price - b.Price
+	case "saleprice":
+		cmp = a.SalePrice - b.SalePrice
+	case "createdate":
+		cmp = strings.Compare(a.Create_Date, b.Create_Date)
+	case "name":
+		cmp = strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	}
+
+	if f.SortDesc {
+		return -cmp
+	}
+	return cmp
+}
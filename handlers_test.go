@@ -0,0 +1,1876 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+type testClient struct {
+	t     *testing.T
+	app   *fiber.App
+	token string
+}
+
+func (tc *testClient) do(method, path string, body interface{}, headers map[string]string) (*http.Response, []byte) {
+	tc.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			tc.t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if tc.token != "" {
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := tc.app.Test(req, -1)
+	if err != nil {
+		tc.t.Fatalf("%s %s: %v", method, path, err)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+
+	return resp, data
+}
+
+func (tc *testClient) expect(method, path string, body interface{}, want int) []byte {
+	tc.t.Helper()
+	return tc.expectWith(method, path, body, nil, want)
+}
+
+// anyVersion is the If-Match of a product write that doesn't care what it overwrites
+var anyVersion = map[string]string{fiber.HeaderIfMatch: "*"}
+
+func (tc *testClient) expectWith(method, path string, body interface{}, headers map[string]string, want int) []byte {
+	tc.t.Helper()
+
+	resp, data := tc.do(method, path, body, headers)
+	if resp.StatusCode != want {
+		tc.t.Fatalf("%s %s: got %d, want %d: %s", method, path, resp.StatusCode, want, data)
+	}
+
+	return data
+}
+
+// upload posts files as multipart/form-data in the image field
+func (tc *testClient) upload(path string, files [][]byte, want int) []byte {
+	tc.t.Helper()
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for i, data := range files {
+		part, err := w.CreateFormFile("image", "upload"+strconv.Itoa(i))
+		if err != nil {
+			tc.t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	w.Close()
+
+	req := httptest.NewRequest(fiber.MethodPost, path, &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if tc.token != "" {
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+	}
+
+	resp, err := tc.app.Test(req, -1)
+	if err != nil {
+		tc.t.Fatalf("POST %s: %v", path, err)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	if resp.StatusCode != want {
+		tc.t.Fatalf("POST %s: got %d, want %d: %s", path, resp.StatusCode, want, data)
+	}
+
+	return data
+}
+
+// seedStore returns a store with one type and owner, the lifecycle statuses
+// and an account for every role, all with the password "password123".
+func seedStore(t *testing.T) (*memoryStore, Owner) {
+	t.Helper()
+
+	m := newMemoryStore()
+	m.addType("shirt")
+
+	store := m.Store()
+	if err := store.Owners.Create(&Owner{Name: "Somchai"}); err != nil {
+		t.Fatal(err)
+	}
+	owners, _ := store.Owners.List()
+
+	for _, role := range []string{roleAdmin, roleStaff, roleCustomer} {
+		u := &User{Email: role + "@example.com", Password: "password123", Firstname: role, Lastname: "test", Role: role}
+		if _, err := createUser(store.Users, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return m, owners[0]
+}
+
+func loginAs(t *testing.T, app *fiber.App, role string) *testClient {
+	t.Helper()
+
+	tc := &testClient{t: t, app: app}
+	data := tc.expect(fiber.MethodPost, "/api/v1/login", Login{Email: role + "@example.com", Password: "password123"}, http.StatusOK)
+
+	var token Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		t.Fatal(err)
+	}
+	tc.token = token.Token
+
+	return tc
+}
+
+func testProduct(owner Owner) Product {
+	return Product{
+		Name: "Denim jacket", Type: "shirt", Status: "available", Owner: owner.ID,
+		Waist: 30, Length: 60, Chest: 40, Price: 500, SalePrice: 400,
+		Image: []string{"a.jpg"},
+	}
+}
+
+func createTestProduct(t *testing.T, staff *testClient, owner Owner) Product {
+	t.Helper()
+
+	staff.expect(fiber.MethodPost, "/api/v1/product", testProduct(owner), http.StatusOK)
+
+	var list ProductListResponse
+	data := staff.expect(fiber.MethodGet, "/api/v1/product?limit=100", nil, http.StatusOK)
+	if err := json.Unmarshal(data, &list); err != nil {
+		t.Fatal(err)
+	}
+
+	return list.Products[len(list.Products)-1]
+}
+
+func TestProductLifecycle(t *testing.T) {
+	m, owner := seedStore(t)
+	app := newTestAppWithStore(t, m)
+	staff := loginAs(t, app, roleStaff)
+
+	p := createTestProduct(t, staff, owner)
+	if p.Owner_Name != owner.Name || p.Version != 1 {
+		t.Fatalf("created product: got owner %q version %d", p.Owner_Name, p.Version)
+	}
+
+	path := "/api/v1/product/" + strconv.Itoa(p.ID)
+
+	resp, _ := staff.do(fiber.MethodGet, path, nil, nil)
+	if etag := resp.Header.Get(fiber.HeaderETag); etag != `"1"` {
+		t.Fatalf("ETag: got %q, want %q", etag, `"1"`)
+	}
+
+	// Every write needs If-Match, and only a successful one moves the version
+	update := p
+	update.Price = 600
+	rename := map[string]interface{}{"name": "Blue denim jacket"}
+	draft := StatusTransition{Status: statusDraft}
+	cases := []struct {
+		name    string
+		method  string
+		path    string
+		body    interface{}
+		ifMatch string
+		status  int
+	}{
+		{"PUT current", fiber.MethodPut, path, update, `"1"`, http.StatusOK},
+		{"PUT stale", fiber.MethodPut, path, update, `"1"`, http.StatusPreconditionFailed},
+		{"PUT weak", fiber.MethodPut, path, update, `W/"2"`, http.StatusPreconditionFailed},
+		{"PUT malformed", fiber.MethodPut, path, update, `"two"`, http.StatusPreconditionFailed},
+		{"PUT without", fiber.MethodPut, path, update, "", http.StatusPreconditionRequired},
+		{"PATCH without", fiber.MethodPatch, path, rename, "", http.StatusPreconditionRequired},
+		{"PATCH current", fiber.MethodPatch, path, rename, `"2"`, http.StatusOK},
+		{"PATCH stale", fiber.MethodPatch, path, map[string]interface{}{"price": 700}, `"2"`, http.StatusPreconditionFailed},
+		{"PUT any", fiber.MethodPut, path, update, "*", http.StatusOK},
+		{"transition without", fiber.MethodPost, path + "/transition", draft, "", http.StatusPreconditionRequired},
+		{"transition stale", fiber.MethodPost, path + "/transition", draft, `"3"`, http.StatusPreconditionFailed},
+		{"transition current", fiber.MethodPost, path + "/transition", draft, `"4"`, http.StatusOK},
+	}
+
+	version := p.Version
+	for _, tc := range cases {
+		headers := map[string]string{}
+		if tc.ifMatch != "" {
+			headers[fiber.HeaderIfMatch] = tc.ifMatch
+		}
+		resp, data := staff.do(tc.method, tc.path, tc.body, headers)
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: got %d, want %d: %s", tc.name, resp.StatusCode, tc.status, data)
+		}
+		if tc.status == http.StatusOK {
+			version++
+			if etag := resp.Header.Get(fiber.HeaderETag); etag != `"`+strconv.Itoa(version)+`"` {
+				t.Fatalf("%s: ETag %q, want version %d", tc.name, etag, version)
+			}
+		}
+
+		stored, err := m.Store().Products.Get(p.ID, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Version != version {
+			t.Fatalf("%s: stored version %d, want %d", tc.name, stored.Version, version)
+		}
+	}
+
+	stored, _ := m.Store().Products.Get(p.ID, false)
+	if stored.Name != p.Name || stored.Price != 600 || stored.Status != statusDraft {
+		t.Fatalf("after the writes: got %+v", stored)
+	}
+
+}
+
+func TestDeletedProductsAreHidden(t *testing.T) {
+	m, owner := seedStore(t)
+	app := newTestAppWithStore(t, m)
+	anon := &testClient{t: t, app: app}
+	staff := loginAs(t, app, roleStaff)
+	admin := loginAs(t, app, roleAdmin)
+
+	kept := createTestProduct(t, staff, owner)
+	gone := testProduct(owner)
+	gone.Name = "Silk dress"
+	staff.expect(fiber.MethodPost, "/api/v1/product", gone, http.StatusOK)
+
+	var created ProductListResponse
+	if err := json.Unmarshal(staff.expect(fiber.MethodGet, "/api/v1/product", nil, http.StatusOK), &created); err != nil {
+		t.Fatal(err)
+	}
+	gone = created.Products[len(created.Products)-1]
+	path := "/api/v1/product/" + strconv.Itoa(gone.ID)
+
+	// listed reports whether a list or search response has gone in it
+	listed := func(data []byte) bool {
+		t.Helper()
+		var got struct {
+			Products []Product             `json:"products"`
+			Results  []ProductSearchResult `json:"results"`
+		}
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range got.Products {
+			if p.ID == gone.ID {
+				return true
+			}
+		}
+		for _, r := range got.Results {
+			if r.ID == gone.ID {
+				return true
+			}
+		}
+		return false
+	}
+
+	// visible checks every read for every client, and that only admins can
+	// ask for deleted products
+	visible := func(want bool) {
+		t.Helper()
+		get := http.StatusNotFound
+		if want {
+			get = http.StatusOK
+		}
+		for _, client := range []*testClient{anon, staff, admin} {
+			client.expect(fiber.MethodGet, path, nil, get)
+			for _, list := range []string{"/api/v1/product", "/api/v1/product/filter?name=silk", "/api/v1/product/search?q=silk"} {
+				if got := listed(client.expect(fiber.MethodGet, list, nil, http.StatusOK)); got != want {
+					t.Errorf("%s: listed %v, want %v", list, got, want)
+				}
+			}
+		}
+
+		anon.expect(fiber.MethodGet, path+"?includeDeleted=true", nil, http.StatusForbidden)
+		staff.expect(fiber.MethodGet, path+"?includeDeleted=true", nil, http.StatusForbidden)
+		staff.expect(fiber.MethodGet, "/api/v1/product?includeDeleted=true", nil, http.StatusForbidden)
+		admin.expect(fiber.MethodGet, path+"?includeDeleted=true", nil, http.StatusOK)
+		if !listed(admin.expect(fiber.MethodGet, "/api/v1/product?includeDeleted=true", nil, http.StatusOK)) {
+			t.Error("admin with includeDeleted doesn't list the product")
+		}
+	}
+
+	visible(true)
+
+	cases := []struct {
+		name    string
+		client  *testClient
+		method  string
+		path    string
+		status  int
+		deleted bool
+	}{
+		{"staff can't delete", staff, fiber.MethodDelete, path, http.StatusForbidden, false},
+		{"admin deletes", admin, fiber.MethodDelete, path, http.StatusOK, true},
+		{"deleting twice", admin, fiber.MethodDelete, path, http.StatusNotFound, true},
+		{"anonymous can't restore", anon, fiber.MethodPost, path + "/restore", http.StatusUnauthorized, true},
+		{"staff can't restore", staff, fiber.MethodPost, path + "/restore", http.StatusForbidden, true},
+		{"restoring a live product", admin, fiber.MethodPost, "/api/v1/product/" + strconv.Itoa(kept.ID) + "/restore", http.StatusNotFound, true},
+		{"admin restores", admin, fiber.MethodPost, path + "/restore", http.StatusOK, false},
+		{"restoring twice", admin, fiber.MethodPost, path + "/restore", http.StatusNotFound, false},
+	}
+
+	version := gone.Version
+	for _, tc := range cases {
+		tc.client.expect(tc.method, tc.path, nil, tc.status)
+		if tc.status == http.StatusOK {
+			version++
+		}
+
+		stored, err := m.Store().Products.Get(gone.ID, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (stored.Delete_Date != nil) != tc.deleted || stored.Version != version {
+			t.Fatalf("%s: stored deletedate %v version %d, want deleted %v version %d", tc.name, stored.Delete_Date, stored.Version, tc.deleted, version)
+		}
+
+		if tc.name == "admin deletes" {
+			visible(false)
+		}
+	}
+
+	// Restoring brings the product back as it was
+	stored, _ := m.Store().Products.Get(gone.ID, false)
+	if stored.Name != gone.Name || stored.Price != gone.Price || stored.Owner != gone.Owner || stored.Status != gone.Status {
+		t.Fatalf("restored: got %+v, want %+v", stored, gone)
+	}
+	if keptStored, _ := m.Store().Products.Get(kept.ID, false); keptStored.Version != kept.Version {
+		t.Fatalf("restoring a live product changed it: %+v", keptStored)
+	}
+	visible(true)
+}
+
+// TestProductMergePatch applies its cases in order to one product, each
+// starting from what the previous one left
+func TestProductMergePatch(t *testing.T) {
+	m, owner := seedStore(t)
+	app := newTestAppWithStore(t, m)
+	staff := loginAs(t, app, roleStaff)
+
+	p := createTestProduct(t, staff, owner)
+	path := "/api/v1/product/" + strconv.Itoa(p.ID)
+
+	cases := []struct {
+		name    string
+		body    map[string]interface{}
+		change  func(p *Product)
+		details map[string]string
+	}{
+		{"set", map[string]interface{}{"description": "Faded", "defect": "Small tear"},
+			func(p *Product) { p.Description, p.Defect = "Faded", "Small tear" }, nil},
+		{"missing fields keep their value", map[string]interface{}{"name": "Faded jacket"},
+			func(p *Product) { p.Name = "Faded jacket" }, nil},
+		{"null removes optional fields", map[string]interface{}{"description": nil, "image": nil},
+			func(p *Product) { p.Description, p.Image = "", nil }, nil},
+		{"null on required fields", map[string]interface{}{"name": nil, "price": nil, "id": 5}, nil,
+			map[string]string{"name": "can't be removed", "price": "can't be removed", "id": "unknown or read-only field"}},
+		{"saleprice over price", map[string]interface{}{"saleprice": 1000}, nil,
+			map[string]string{"saleprice": "can't be greater than price"}},
+	}
+
+	want := p
+	for _, tc := range cases {
+		status := http.StatusOK
+		if tc.details != nil {
+			status = http.StatusUnprocessableEntity
+		}
+		data := staff.expectWith(fiber.MethodPatch, path, tc.body, anyVersion, status)
+
+		if tc.details != nil {
+			var body ErrorResponse
+			if err := json.Unmarshal(data, &body); err != nil {
+				t.Fatal(err)
+			}
+			details := map[string]string{}
+			for _, fe := range body.Error.Details {
+				details[fe.Field] = fe.Message
+			}
+			if !reflect.DeepEqual(details, tc.details) {
+				t.Errorf("%s: details got %v, want %v", tc.name, details, tc.details)
+			}
+		} else {
+			tc.change(&want)
+			want.Version++
+		}
+
+		// A rejected patch leaves the product as it was
+		stored, err := m.Store().Products.Get(p.ID, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Name != want.Name || stored.Description != want.Description || stored.Defect != want.Defect ||
+			len(stored.Image) != len(want.Image) || stored.Price != want.Price || stored.SalePrice != want.SalePrice ||
+			stored.Version != want.Version {
+			t.Fatalf("%s: stored %+v, want %+v", tc.name, stored, want)
+		}
+	}
+}
+
+func TestValidationDetails(t *testing.T) {
+	m, owner := seedStore(t)
+	app := newTestAppWithStore(t, m)
+	admin := loginAs(t, app, roleAdmin)
+
+	product := func(change func(p *Product)) Product {
+		p := testProduct(owner)
+		change(&p)
+		return p
+	}
+	negativeUser := User{Email: "valid@example.com", Password: "password123", Firstname: "A", Lastname: "B", Role: roleStaff, Phone: -1, Zipcode: -1}
+
+	cases := []struct {
+		name string
+		path string
+		body interface{}
+		want map[string]string
+	}{
+		{"product required", "/api/v1/product", Product{}, map[string]string{
+			"name": "is required", "waist": "must be greater than 0", "length": "must be greater than 0",
+			"chest": "must be greater than 0", "type": "is required", "status": "is required", "owner": "is required",
+		}},
+		{"product negative measurements", "/api/v1/product", product(func(p *Product) { p.Waist, p.Length, p.Chest = -1, -2, -3 }), map[string]string{
+			"waist": "must be greater than 0", "length": "must be greater than 0", "chest": "must be greater than 0",
+		}},
+		{"product negative prices", "/api/v1/product", product(func(p *Product) { p.Price, p.SalePrice = -1, -1 }), map[string]string{
+			"price": "can't be negative", "saleprice": "can't be negative",
+		}},
+		{"product saleprice over price", "/api/v1/product", product(func(p *Product) { p.SalePrice = p.Price + 1 }), map[string]string{
+			"saleprice": "can't be greater than price",
+		}},
+		{"product unknown references", "/api/v1/product", product(func(p *Product) { p.Type, p.Owner = "hat", 999 }), map[string]string{
+			"type": `unknown type "hat"`, "owner": "no owner with id 999",
+		}},
+		{"product unknown status id", "/api/v1/product", product(func(p *Product) { p.Status, p.StatusID = "", 999 }), map[string]string{
+			"status": "no status with id 999",
+		}},
+		{"owner required", "/api/v1/owner", Owner{}, map[string]string{
+			"name": "is required",
+		}},
+		{"owner commission", "/api/v1/owner", Owner{Name: "Somsri", Commission: 101}, map[string]string{
+			"commission": "must be between 0 and 100",
+		}},
+		{"user required", "/api/v1/users", User{}, map[string]string{
+			"email": "must be a valid email address", "password": "must be at least 8 characters",
+			"firstname": "is required", "lastname": "is required",
+			"role": "must be one of admin, staff, consignor or customer",
+		}},
+		{"user negative numbers", "/api/v1/users", negativeUser, map[string]string{
+			"phone": "can't be negative", "zipcode": "can't be negative",
+		}},
+		{"registration", "/api/v1/register", User{Email: "not an email", Password: "short"}, map[string]string{
+			"email": "must be a valid email address", "password": "must be at least 8 characters",
+			"firstname": "is required", "lastname": "is required",
+		}},
+	}
+
+	// stored counts the products, owners and users, none of the cases may add one
+	stored := func() [3]int {
+		store := m.Store()
+		_, products, err := store.Products.List(maxPageLimit, 0, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		owners, err := store.Owners.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		users, err := store.Users.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return [3]int{products, len(owners), len(users)}
+	}
+	before := stored()
+
+	for _, tc := range cases {
+		var body ErrorResponse
+		data := admin.expect(fiber.MethodPost, tc.path, tc.body, http.StatusUnprocessableEntity)
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error.Code != "validation_error" {
+			t.Errorf("%s: code %q", tc.name, body.Error.Code)
+		}
+
+		got := map[string]string{}
+		for _, fe := range body.Error.Details {
+			got[fe.Field] = fe.Message
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: details\ngot  %v\nwant %v", tc.name, got, tc.want)
+		}
+		if after := stored(); after != before {
+			t.Errorf("%s: stored products, owners, users went from %v to %v", tc.name, before, after)
+		}
+	}
+}
+
+// TestBulkUpdate sends the same mixed batch in every mode: two good items, a
+// missing product, an invalid one, a repeated id and a stale version
+func TestBulkUpdate(t *testing.T) {
+	cases := []struct {
+		name      string
+		query     string
+		mode      string
+		status    int
+		committed bool
+		updated   string
+	}{
+		{"default", "", bulkModeAtomic, http.StatusUnprocessableEntity, false, bulkStatusRolledBack},
+		{"atomic", "?mode=" + bulkModeAtomic, bulkModeAtomic, http.StatusUnprocessableEntity, false, bulkStatusRolledBack},
+		{"best-effort", "?mode=" + bulkModeBestEffort, bulkModeBestEffort, http.StatusOK, true, bulkStatusUpdated},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, owner := seedStore(t)
+			app := newTestAppWithStore(t, m)
+			staff := loginAs(t, app, roleStaff)
+
+			a := createTestProduct(t, staff, owner)
+			b := createTestProduct(t, staff, owner)
+			invalid := createTestProduct(t, staff, owner)
+			stale := createTestProduct(t, staff, owner)
+			before := []Product{a, b, invalid, stale}
+
+			a.Name, b.Name = "Renamed A", "Renamed B"
+			missing := testProduct(owner)
+			missing.ID = 999
+			invalid.Name = "Renamed invalid"
+			invalid.Waist = -1
+			stale.Name = "Renamed stale"
+			stale.Version += 5
+
+			var res BulkUpdateResponse
+			data := staff.expect(fiber.MethodPut, "/api/v1/product"+tc.query, []Product{a, missing, invalid, b, a, stale}, tc.status)
+			if err := json.Unmarshal(data, &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Mode != tc.mode || res.Committed != tc.committed || len(res.Results) != 6 {
+				t.Fatalf("got %+v", res)
+			}
+
+			want := []string{tc.updated, bulkStatusNotFound, bulkStatusInvalid, tc.updated, bulkStatusInvalid, bulkStatusConflict}
+			for i, r := range res.Results {
+				if r.Status != want[i] {
+					t.Errorf("result %d is %s, want %s", i, r.Status, want[i])
+				}
+				if (r.Product != nil) != (r.Status == bulkStatusUpdated) {
+					t.Errorf("result %d has product %v", i, r.Product)
+				}
+			}
+			if len(res.Results[2].Errors) == 0 || res.Results[2].Errors[0].Field != "waist" {
+				t.Errorf("invalid item errors: got %+v", res.Results[2].Errors)
+			}
+
+			// Only a committed batch changes the good items, and then only once
+			for i, p := range before {
+				stored, err := m.Store().Products.Get(p.ID, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				good := i < 2 && tc.committed
+				if renamed := stored.Name != p.Name; renamed != good {
+					t.Errorf("product %d is named %q after the batch", p.ID, stored.Name)
+				}
+				wantVersion := p.Version
+				if good {
+					wantVersion++
+				}
+				if stored.Version != wantVersion {
+					t.Errorf("product %d: version %d, want %d", p.ID, stored.Version, wantVersion)
+				}
+			}
+			if _, err := m.Store().Products.Get(missing.ID, true); !errors.Is(err, ErrNotFound) {
+				t.Errorf("missing product: got %v", err)
+			}
+		})
+	}
+
+	m, owner := seedStore(t)
+	staff := loginAs(t, newTestAppWithStore(t, m), roleStaff)
+	p := createTestProduct(t, staff, owner)
+	staff.expect(fiber.MethodPut, "/api/v1/product?mode=sometimes", []Product{p}, http.StatusBadRequest)
+	staff.expect(fiber.MethodPut, "/api/v1/product", []Product{}, http.StatusBadRequest)
+}
+
+func TestBulkErrorStatus(t *testing.T) {
+	cases := []struct {
+		err     error
+		status  string
+		message string
+	}{
+		{notFoundf("no product found with id 7"), bulkStatusNotFound, "product not found"},
+		{errVersionMismatch, bulkStatusConflict, "product was modified since it was read"},
+		{conflictf("product 7 is sold"), bulkStatusConflict, "product 7 is sold"},
+		{forbidden("not yours"), bulkStatusForbidden, "not yours"},
+		{checkStatusKept(&Product{ID: 7, StatusID: 1}, &Product{StatusID: 2}), bulkStatusInvalid, "status: can only be changed"},
+		{&pq.Error{Code: "23503", Message: `insert violates foreign key constraint "product_owner_fkey"`}, bulkStatusInvalid, "references a missing type, status or owner"},
+		{&pq.Error{Code: "23505", Message: `duplicate key value violates unique constraint "product_pkey"`}, bulkStatusConflict, "conflicts with another product"},
+		{&pq.Error{Code: "23514", Message: `new row violates check constraint "product_price_check"`}, bulkStatusInvalid, "invalid value"},
+		{&pq.Error{Code: "22P02", Message: `invalid input syntax for type integer: "x"`}, bulkStatusInvalid, "invalid value"},
+		{errors.New("connection reset"), bulkStatusError, "failed to update product"},
+	}
+
+	for _, tc := range cases {
+		status, message := bulkErrorStatus(tc.err)
+		if status != tc.status || !strings.HasPrefix(message, tc.message) {
+			t.Errorf("%v: got %s %q, want %s %q", tc.err, status, message, tc.status, tc.message)
+		}
+	}
+}
+
+func TestAuthFlow(t *testing.T) {
+	m, _ := seedStore(t)
+	app := newTestAppWithStore(t, m)
+	anon := &testClient{t: t, app: app}
+
+	anon.expect(fiber.MethodPost, "/api/v1/login", Login{Email: "admin@example.com", Password: "wrong"}, http.StatusUnauthorized)
+	anon.expect(fiber.MethodPost, "/api/v1/register", User{Email: "admin@example.com", Password: "password123", Firstname: "A", Lastname: "B"}, http.StatusConflict)
+
+	var registered User
+	data := anon.expect(fiber.MethodPost, "/api/v1/register", User{Email: "new@example.com", Password: "password123", Firstname: "A", Lastname: "B", Role: roleAdmin}, http.StatusCreated)
+	if err := json.Unmarshal(data, &registered); err != nil {
+		t.Fatal(err)
+	}
+	if registered.Role != roleCustomer || registered.Password != "" {
+		t.Fatalf("registered user: got %+v", registered)
+	}
+
+	var first Token
+	data = anon.expect(fiber.MethodPost, "/api/v1/login", Login{Email: "new@example.com", Password: "password123"}, http.StatusOK)
+	if err := json.Unmarshal(data, &first); err != nil {
+		t.Fatal(err)
+	}
+
+	var second Token
+	data = anon.expect(fiber.MethodPost, "/api/v1/refresh", RefreshRequest{RefreshToken: first.RefreshToken}, http.StatusOK)
+	if err := json.Unmarshal(data, &second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying a rotated refresh token revokes the whole session
+	anon.expect(fiber.MethodPost, "/api/v1/refresh", RefreshRequest{RefreshToken: first.RefreshToken}, http.StatusUnauthorized)
+	anon.expect(fiber.MethodPost, "/api/v1/refresh", RefreshRequest{RefreshToken: second.RefreshToken}, http.StatusUnauthorized)
+
+	admin := loginAs(t, app, roleAdmin)
+	admin.expect(fiber.MethodGet, "/api/v1/users", nil, http.StatusOK)
+	admin.expect(fiber.MethodPost, "/api/v1/logout", nil, http.StatusNoContent)
+	admin.expect(fiber.MethodGet, "/api/v1/users", nil, http.StatusUnauthorized)
+}
+
+func TestOwnerHandlers(t *testing.T) {
+	m, owner := seedStore(t)
+	app := newTestAppWithStore(t, m)
+	admin := loginAs(t, app, roleAdmin)
+
+	admin.expect(fiber.MethodPost, "/api/v1/owner", Owner{Name: ""}, http.StatusUnprocessableEntity)
+	admin.expect(fiber.MethodPost, "/api/v1/owner", Owner{Name: "Malee"}, http.StatusOK)
+	admin.expect(fiber.MethodPut, "/api/v1/owner/"+strconv.Itoa(owner.ID), Owner{Name: "Somsri"}, http.StatusOK)
+	admin.expect(fiber.MethodPut, "/api/v1/owner/999", Owner{Name: "Nobody"}, http.StatusNotFound)
+
+	var owners []Owner
+	data := admin.expect(fiber.MethodGet, "/api/v1/owner", nil, http.StatusOK)
+	if err := json.Unmarshal(data, &owners); err != nil {
+		t.Fatal(err)
+	}
+	if len(owners) != 2 || owners[0].Name != "Somsri" {
+		t.Fatalf("owners: got %+v", owners)
+	}
+
+	// The list has every owner's user and commission, so it's staff only
+	loginAs(t, app, roleStaff).expect(fiber.MethodGet, "/api/v1/owner", nil, http.StatusOK)
+	loginAs(t, app, roleCustomer).expect(fiber.MethodGet, "/api/v1/owner", nil, http.StatusForbidden)
+}
+
+func TestUserHandlers(t *testing.T) {
+	m, _ := seedStore(t)
+	app := newTestAppWithStore(t, m)
+	admin := loginAs(t, app, roleAdmin)
+
+	full := User{
+		Email: "full@example.com", Password: "password123", Firstname: "Nok", Lastname: "Suk",
+		Phone: 812345678, Address: "1 Sukhumvit", Role: roleConsignor, Country: "TH", Zipcode: 10110,
+	}
+
+	var created User
+	data := admin.expect(fiber.MethodPost, "/api/v1/users", full, http.StatusCreated)
+	if err := json.Unmarshal(data, &created); err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/api/v1/users/" + strconv.Itoa(created.ID)
+
+	var got User
+	data = admin.expect(fiber.MethodGet, path, nil, http.StatusOK)
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := full
+	want.ID = created.ID
+	want.Password = ""
+	if got != want {
+		t.Fatalf("round trip: got %+v, want %+v", got, want)
+	}
+
+	admin.expect(fiber.MethodPost, "/api/v1/users", full, http.StatusConflict)
+
+	consignor := loginAs(t, app, "full")
+	consignor.expect(fiber.MethodGet, path, nil, http.StatusForbidden)
+
+	update := full
+	update.Password = ""
+	update.Address = "2 Silom"
+	update.Role = roleAdmin
+	data = consignor.expect(fiber.MethodPut, "/api/v1/me", update, http.StatusOK)
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Address != "2 Silom" || got.Role != roleConsignor {
+		t.Fatalf("PUT /me: got %+v", got)
+	}
+
+	// The password was left out of the update and still works
+	loginAs(t, app, "full")
+
+	admin.expect(fiber.MethodPut, path, update, http.StatusOK)
+	data = consignor.expect(fiber.MethodGet, "/api/v1/me", nil, http.StatusOK)
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Role != roleAdmin {
+		t.Fatalf("GET /me after admin update: got role %q", got.Role)
+	}
+
+	admin.expect(fiber.MethodDelete, path, nil, http.StatusNoContent)
+	admin.expect(fiber.MethodGet, path, nil, http.StatusNotFound)
+	consignor.expect(fiber.MethodGet, "/api/v1/me", nil, http.StatusUnauthorized)
+}
+
+func TestLookupHandlers(t *testing.T) {
+	m, owner := seedStore(t)
+	app := newTestAppWithStore(t, m)
+	admin := loginAs(t, app, roleAdmin)
+
+	var pants Type
+	data := admin.expect(fiber.MethodPost, "/api/v1/type", Type{Name: "pants"}, http.StatusCreated)
+	if err := json.Unmarshal(data, &pants); err != nil {
+		t.Fatal(err)
+	}
+	admin.expect(fiber.MethodPost, "/api/v1/type", Type{Name: "pants"}, http.StatusConflict)
+	admin.expect(fiber.MethodPost, "/api/v1/type", Type{Name: " "}, http.StatusUnprocessableEntity)
+
+	typePath := "/api/v1/type/" + strconv.Itoa(pants.ID)
+
+	// Referenced by id only, the response carries the name as well
+	p := testProduct(owner)
+	p.Type, p.TypeID = "", pants.ID
+	admin.expect(fiber.MethodPost, "/api/v1/product", p, http.StatusOK)
+
+	p.Type = "shirt"
+	admin.expect(fiber.MethodPost, "/api/v1/product", p, http.StatusUnprocessableEntity)
+	p.Type, p.TypeID = "", 999
+	admin.expect(fiber.MethodPost, "/api/v1/product", p, http.StatusUnprocessableEntity)
+
+	admin.expect(fiber.MethodPut, typePath, Type{Name: "trousers"}, http.StatusOK)
+
+	var list ProductListResponse
+	data = admin.expect(fiber.MethodGet, "/api/v1/product", nil, http.StatusOK)
+	if err := json.Unmarshal(data, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Products) != 1 || list.Products[0].TypeID != pants.ID || list.Products[0].Type != "trousers" {
+		t.Fatalf("product after type rename: got %+v", list.Products)
+	}
+
+	admin.expect(fiber.MethodDelete, typePath, nil, http.StatusConflict)
+
+	var unused Status
+	data = admin.expect(fiber.MethodPost, "/api/v1/status", Status{Name: "archived"}, http.StatusCreated)
+	if err := json.Unmarshal(data, &unused); err != nil {
+		t.Fatal(err)
+	}
+	statusPath := "/api/v1/status/" + strconv.Itoa(unused.ID)
+	admin.expect(fiber.MethodPut, statusPath, Status{Name: "available"}, http.StatusConflict)
+	admin.expect(fiber.MethodDelete, statusPath, nil, http.StatusNoContent)
+	admin.expect(fiber.MethodGet, statusPath, nil, http.StatusNotFound)
+}
+
+func TestStatusLifecycle(t *testing.T) {
+	m, owner := seedStore(t)
+	app := newTestAppWithStore(t, m)
+	staff := loginAs(t, app, roleStaff)
+	admin := loginAs(t, app, roleAdmin)
+	customer := loginAs(t, app, roleCustomer)
+
+	sold := testProduct(owner)
+	sold.Status = statusSold
+	staff.expect(fiber.MethodPost, "/api/v1/product", sold, http.StatusUnprocessableEntity)
+
+	p := createTestProduct(t, staff, owner)
+	path := "/api/v1/product/" + strconv.Itoa(p.ID)
+
+	transition := func(tc *testClient, status string, want int) Product {
+		t.Helper()
+
+		var got Product
+		data := tc.expectWith(fiber.MethodPost, path+"/transition", StatusTransition{Status: status, Note: "to " + status}, anyVersion, want)
+		if want == http.StatusOK {
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return got
+	}
+
+	transition(customer, statusReserved, http.StatusForbidden)
+	transition(staff, "lost", http.StatusUnprocessableEntity)
+	transition(staff, statusAvailable, http.StatusConflict)
+	transition(staff, statusPaidOut, http.StatusConflict)
+	transition(staff, statusReserved, http.StatusOK)
+	got := transition(staff, statusSold, http.StatusOK)
+	if got.Status != statusSold || got.Version != p.Version+2 {
+		t.Fatalf("after two transitions: got status %q version %d", got.Status, got.Version)
+	}
+
+	// Every other write keeps the status as it is
+	update := got
+	update.Status, update.StatusID = statusAvailable, 0
+	staff.expectWith(fiber.MethodPut, path, update, anyVersion, http.StatusUnprocessableEntity)
+	staff.expectWith(fiber.MethodPatch, path, map[string]string{"status": statusAvailable}, anyVersion, http.StatusUnprocessableEntity)
+	update.Status, update.StatusID = statusSold, 0
+	update.Name = "Sold jacket"
+	staff.expectWith(fiber.MethodPut, path, update, anyVersion, http.StatusOK)
+
+	transition(staff, statusPaidOut, http.StatusOK)
+	transition(staff, statusAvailable, http.StatusConflict)
+
+	var me User
+	data := staff.expect(fiber.MethodGet, "/api/v1/me", nil, http.StatusOK)
+	if err := json.Unmarshal(data, &me); err != nil {
+		t.Fatal(err)
+	}
+
+	var history []StatusChange
+	data = staff.expect(fiber.MethodGet, path+"/history", nil, http.StatusOK)
+	if err := json.Unmarshal(data, &history); err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{{statusAvailable, statusReserved}, {statusReserved, statusSold}, {statusSold, statusPaidOut}}
+	if len(history) != len(want) {
+		t.Fatalf("history: got %+v", history)
+	}
+	for i, sc := range history {
+		if sc.From != want[i][0] || sc.To != want[i][1] || sc.ChangedBy != me.ID || sc.Note != "to "+sc.To {
+			t.Fatalf("history[%d]: got %+v, want %s -> %s by %d", i, sc, want[i][0], want[i][1], me.ID)
+		}
+	}
+
+	staff.expect(fiber.MethodGet, "/api/v1/product/999/history", nil, http.StatusNotFound)
+
+	paidOut := findMemLookup(m.statuses, 0, statusPaidOut)
+	statusPath := "/api/v1/status/" + strconv.Itoa(paidOut.ID)
+	admin.expect(fiber.MethodPut, statusPath, Status{Name: "paid"}, http.StatusConflict)
+	admin.expect(fiber.MethodDelete, statusPath, nil, http.StatusConflict)
+}
+
+func testImage(t *testing.T, w, h int, format string) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		img.Set(x, x*h/w, color.RGBA{R: 200, A: 255})
+	}
+
+	var buf bytes.Buffer
+	var err error
+	if format == "png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestProductImages(t *testing.T) {
+	m, owner := seedStore(t)
+	dir := t.TempDir()
+	app := newTestAppWithFiles(t, m, newLocalStorage(dir, localStoragePath))
+	staff := loginAs(t, app, roleStaff)
+	customer := loginAs(t, app, roleCustomer)
+
+	p := createTestProduct(t, staff, owner)
+	path := "/api/v1/product/" + strconv.Itoa(p.ID) + "/images"
+
+	photo := testImage(t, 2000, 1000, "jpeg")
+	icon := testImage(t, 100, 150, "png")
+
+	customer.upload(path, [][]byte{photo}, http.StatusForbidden)
+	staff.upload("/api/v1/product/999/images", [][]byte{photo}, http.StatusNotFound)
+	staff.upload(path, nil, http.StatusUnprocessableEntity)
+
+	data := staff.upload(path, [][]byte{photo, []byte("not an image")}, http.StatusUnprocessableEntity)
+	var rejected ErrorResponse
+	if err := json.Unmarshal(data, &rejected); err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected.Error.Details) != 1 || rejected.Error.Details[0].Field != "image[1]" {
+		t.Fatalf("mixed upload: got %+v", rejected.Error.Details)
+	}
+
+	var images []ProductImage
+	data = staff.upload(path, [][]byte{photo, icon}, http.StatusCreated)
+	if err := json.Unmarshal(data, &images); err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[0].Position != 1 || images[1].Position != 2 ||
+		images[0].Width != 2000 || images[1].ContentType != "image/png" {
+		t.Fatalf("uploaded images: got %+v", images)
+	}
+
+	// The variants are served from the local storage
+	variants := map[string]int{images[0].URL: 2000, images[0].WebURL: webImageSize, images[0].ThumbURL: thumbImageSize}
+	for url, width := range variants {
+		resp, body := staff.do(fiber.MethodGet, url, nil, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: got %d", url, resp.StatusCode)
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(body))
+		if err != nil || config.Width != width {
+			t.Fatalf("GET %s: got width %d (%v), want %d", url, config.Width, err, width)
+		}
+	}
+
+	first, second := images[0].ID, images[1].ID
+	staff.expect(fiber.MethodPut, path, ImageOrder{Order: []int{second}}, http.StatusUnprocessableEntity)
+	staff.expect(fiber.MethodPut, path, ImageOrder{Order: []int{second, second}}, http.StatusUnprocessableEntity)
+	staff.expect(fiber.MethodPut, path, ImageOrder{Order: []int{second, first}}, http.StatusOK)
+
+	data = customer.expect(fiber.MethodGet, path, nil, http.StatusOK)
+	if err := json.Unmarshal(data, &images); err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[0].ID != second || images[1].ID != first {
+		t.Fatalf("after reorder: got %+v", images)
+	}
+
+	deleted := images[1]
+	staff.expect(fiber.MethodDelete, path+"/"+strconv.Itoa(first), nil, http.StatusNoContent)
+	staff.expect(fiber.MethodDelete, path+"/"+strconv.Itoa(first), nil, http.StatusNotFound)
+	for _, url := range []string{deleted.URL, deleted.WebURL, deleted.ThumbURL} {
+		file := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(url, localStoragePath+"/")))
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Fatalf("%s of a deleted image is still stored: %v", url, err)
+		}
+	}
+}
+
+func TestProductSearch(t *testing.T) {
+	m, owner := seedStore(t)
+	app := newTestAppWithStore(t, m)
+	staff := loginAs(t, app, roleStaff)
+	admin := loginAs(t, app, roleAdmin)
+
+	jacket := createTestProduct(t, staff, owner)
+	staff.expectWith(fiber.MethodPatch, "/api/v1/product/"+strconv.Itoa(jacket.ID),
+		map[string]string{"description": "Blue denim <b>barely</b> worn"}, anyVersion, http.StatusOK)
+
+	dress := testProduct(owner)
+	dress.Name, dress.Description = "Silk dress", "ชุดผ้าไหม สีแดง"
+	staff.expect(fiber.MethodPost, "/api/v1/product", dress, http.StatusOK)
+
+	gone := testProduct(owner)
+	gone.Name = "Denim skirt"
+	staff.expect(fiber.MethodPost, "/api/v1/product", gone, http.StatusOK)
+	var list ProductListResponse
+	if err := json.Unmarshal(staff.expect(fiber.MethodGet, "/api/v1/product?limit=100", nil, http.StatusOK), &list); err != nil {
+		t.Fatal(err)
+	}
+	admin.expect(fiber.MethodDelete, "/api/v1/product/"+strconv.Itoa(list.Products[2].ID), nil, http.StatusOK)
+
+	search := func(q string) ProductSearchResponse {
+		t.Helper()
+
+		var resp ProductSearchResponse
+		data := staff.expect(fiber.MethodGet, "/api/v1/product/search?q="+url.QueryEscape(q), nil, http.StatusOK)
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	got := search("denim")
+	if got.Mode != searchModeFullText || got.Total != 1 || got.Results[0].ID != jacket.ID {
+		t.Fatalf("denim: got %+v", got)
+	}
+	if want := "<mark>Denim</mark> jacket Blue <mark>denim</mark> &lt;b&gt;barely&lt;/b&gt; worn"; got.Results[0].Snippet != want {
+		t.Fatalf("denim snippet: got %q, want %q", got.Results[0].Snippet, want)
+	}
+
+	// The owner name is searched too, the name outranks the owner
+	got = search("somchai jacket")
+	if got.Total != 1 || got.Results[0].ID != jacket.ID {
+		t.Fatalf("somchai jacket: got %+v", got)
+	}
+	if got = search("somchai"); got.Total != 2 {
+		t.Fatalf("somchai: got %d results", got.Total)
+	}
+
+	got = search("jackit")
+	if got.Mode != searchModeFuzzy || got.Total != 1 || got.Results[0].ID != jacket.ID {
+		t.Fatalf("typo: got %+v", got)
+	}
+
+	// Thai has no spaces between words, a part of one only matches fuzzily
+	got = search("ผ้าไหม")
+	if got.Mode != searchModeFuzzy || got.Total != 1 || got.Results[0].Name != "Silk dress" {
+		t.Fatalf("thai: got %+v", got)
+	}
+	if !strings.Contains(got.Results[0].Snippet, "<mark>ผ้าไหม</mark>") {
+		t.Fatalf("thai snippet: got %q", got.Results[0].Snippet)
+	}
+
+	if got = search("sweater"); got.Total != 0 || len(got.Results) != 0 {
+		t.Fatalf("sweater: got %+v", got)
+	}
+
+	staff.expect(fiber.MethodGet, "/api/v1/product/search?q=+", nil, http.StatusUnprocessableEntity)
+}
+
+func TestPageParams(t *testing.T) {
+	m, owner := seedStore(t)
+	for i := 0; i <= maxPageLimit; i++ {
+		p := testProduct(owner)
+		if err := validateProduct(m.Store().Lookups, &p); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Store().Products.Create(&p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := newTestAppWithStore(t, m)
+	anon := &testClient{t: t, app: app}
+
+	cases := []struct {
+		query  string
+		status int
+		field  string
+		count  int
+	}{
+		{"", http.StatusOK, "", 15},
+		{"limit=1&offset=100", http.StatusOK, "", 1},
+		{"limit=1000", http.StatusOK, "", maxPageLimit},
+		{"limit=0", http.StatusUnprocessableEntity, "limit", 0},
+		{"limit=-1", http.StatusUnprocessableEntity, "limit", 0},
+		{"offset=-1", http.StatusUnprocessableEntity, "offset", 0},
+		{"limit=ten", http.StatusBadRequest, "", 0},
+	}
+
+	for _, list := range []string{"/api/v1/product?", "/api/v1/product/filter?", "/api/v1/product/search?q=denim&"} {
+		for _, tc := range cases {
+			data := anon.expect(fiber.MethodGet, list+tc.query, nil, tc.status)
+
+			if tc.field != "" {
+				var body ErrorResponse
+				json.Unmarshal(data, &body)
+				if len(body.Error.Details) != 1 || body.Error.Details[0].Field != tc.field {
+					t.Errorf("%s%s: details %+v", list, tc.query, body.Error.Details)
+				}
+			}
+			if tc.status != http.StatusOK {
+				continue
+			}
+
+			var page struct {
+				Products []Product             `json:"products"`
+				Results  []ProductSearchResult `json:"results"`
+			}
+			json.Unmarshal(data, &page)
+			if got := len(page.Products) + len(page.Results); got != tc.count {
+				t.Errorf("%s%s: got %d items, want %d", list, tc.query, got, tc.count)
+			}
+		}
+	}
+}
+
+func TestProductFilterMeasurements(t *testing.T) {
+	m, owner := seedStore(t)
+	app := newTestAppWithStore(t, m)
+	staff := loginAs(t, app, roleStaff)
+
+	for _, size := range []struct {
+		name                 string
+		waist, length, chest int
+		price                int
+	}{
+		{"small", 28, 58, 36, 300},
+		{"medium", 31, 61, 40, 500},
+		{"large", 34, 64, 44, 800},
+		{"exact", 30, 60, 40, 450},
+	} {
+		p := testProduct(owner)
+		p.Name, p.Waist, p.Length, p.Chest, p.Price, p.SalePrice = size.name, size.waist, size.length, size.chest, size.price, size.price
+		staff.expect(fiber.MethodPost, "/api/v1/product", p, http.StatusOK)
+	}
+
+	filter := func(query string) []string {
+		t.Helper()
+
+		var list ProductListResponse
+		if err := json.Unmarshal(staff.expect(fiber.MethodGet, "/api/v1/product/filter?"+query, nil, http.StatusOK), &list); err != nil {
+			t.Fatal(err)
+		}
+		if list.Total != len(list.Products) {
+			t.Fatalf("%s: total %d but %d products", query, list.Total, len(list.Products))
+		}
+
+		got := []string{}
+		for _, p := range list.Products {
+			got = append(got, p.Name)
+		}
+		return got
+	}
+
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		{"minwaist=30&maxwaist=31", []string{"medium", "exact"}},
+		{"minchest=40", []string{"medium", "large", "exact"}},
+		{"maxprice=450&minsaleprice=400", []string{"exact"}},
+		{"minlength=70", []string{}},
+		// Fits-me orders by the total difference, best first
+		{"waist=30&chest=40", []string{"exact", "medium"}},
+		{"waist=30&length=60&chest=40&tolerance=4", []string{"exact", "medium", "small", "large"}},
+		{"waist=30&tolerance=0", []string{"exact"}},
+		{"chest=40&tolerance=4&maxprice=600", []string{"medium", "exact", "small"}},
+	}
+	for _, tc := range cases {
+		if got := filter(tc.query); strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s: got %v, want %v", tc.query, got, tc.want)
+		}
+	}
+
+	for _, query := range []string{"minwaist=abc", "minprice=500&maxprice=100", "chest=-1", "waist=30&tolerance=-1", "tolerance=2"} {
+		staff.expect(fiber.MethodGet, "/api/v1/product/filter?"+query, nil, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestProductFilterListsAndSort(t *testing.T) {
+	m, owner := seedStore(t)
+	if err := m.Store().Owners.Create(&Owner{Name: "Malee"}); err != nil {
+		t.Fatal(err)
+	}
+	owners, _ := m.Store().Owners.List()
+	other := owners[1]
+	app := newTestAppWithStore(t, m)
+	staff := loginAs(t, app, roleStaff)
+
+	for _, item := range []struct {
+		name   string
+		owner  int
+		price  int
+		status string
+	}{
+		{"coat", owner.ID, 900, statusAvailable},
+		{"Apron", other.ID, 200, statusAvailable},
+		{"belt", owner.ID, 150, statusDraft},
+	} {
+		p := testProduct(owner)
+		p.Name, p.Owner, p.Price, p.SalePrice, p.Status = item.name, item.owner, item.price, item.price, item.status
+		staff.expect(fiber.MethodPost, "/api/v1/product", p, http.StatusOK)
+	}
+	var coats ProductListResponse
+	if err := json.Unmarshal(staff.expect(fiber.MethodGet, "/api/v1/product/filter?name=coat", nil, http.StatusOK), &coats); err != nil {
+		t.Fatal(err)
+	}
+	staff.expectWith(fiber.MethodPost, "/api/v1/product/"+strconv.Itoa(coats.Products[0].ID)+"/transition",
+		StatusTransition{Status: statusReserved}, anyVersion, http.StatusOK)
+
+	today := time.Now().Format(dateLayout)
+	yesterday := time.Now().AddDate(0, 0, -1).Format(dateLayout)
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"status=reserved,draft", "coat,belt"},
+		{"status=reserved&status=available", "coat,Apron"},
+		{"owner=" + strconv.Itoa(other.ID), "Apron"},
+		{"owner=" + strconv.Itoa(owner.ID) + "," + strconv.Itoa(other.ID) + "&type=shirt,dress", "coat,Apron,belt"},
+		{"sort=price", "belt,Apron,coat"},
+		{"sort=-price", "coat,Apron,belt"},
+		{"sort=name", "Apron,belt,coat"},
+		{"sort=-name&status=available,draft", "belt,Apron"},
+		{"createdfrom=" + today + "&createdto=" + today + "&sort=saleprice", "belt,Apron,coat"},
+		{"createdto=" + yesterday, ""},
+		{"updatedfrom=" + today + "&maxprice=500", "Apron,belt"},
+	}
+	for _, tc := range cases {
+		var list ProductListResponse
+		data := staff.expect(fiber.MethodGet, "/api/v1/product/filter?"+tc.query, nil, http.StatusOK)
+		if err := json.Unmarshal(data, &list); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, p := range list.Products {
+			got = append(got, p.Name)
+		}
+		if strings.Join(got, ",") != tc.want || list.Total != len(got) {
+			t.Errorf("%s: got %v (total %d), want %s", tc.query, got, list.Total, tc.want)
+		}
+	}
+
+	for _, query := range []string{
+		"sort=id", "sort=price%3Bdrop%20table%20product", "sort=--price", "owner=abc",
+		"createdfrom=31-05-2024", "createdfrom=" + today + "&createdto=" + yesterday,
+	} {
+		staff.expect(fiber.MethodGet, "/api/v1/product/filter?"+query, nil, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestConsignorLedger(t *testing.T) {
+	m, _ := seedStore(t)
+	app := newTestAppWithStore(t, m)
+	admin := loginAs(t, app, roleAdmin)
+	staff := loginAs(t, app, roleStaff)
+	customer := loginAs(t, app, roleCustomer)
+
+	admin.expect(fiber.MethodPost, "/api/v1/owner", Owner{Name: "Malee", Commission: 150}, http.StatusUnprocessableEntity)
+	admin.expect(fiber.MethodPost, "/api/v1/owner", map[string]interface{}{"name": "Malee", "commission": 25}, http.StatusOK)
+	owners, _ := m.Store().Owners.List()
+	owner := owners[len(owners)-1]
+	if owner.Commission != 25 {
+		t.Fatalf("commission: got %+v", owner)
+	}
+	ownerPath := "/api/v1/owner/" + strconv.Itoa(owner.ID)
+
+	// Leaving commission out of an update keeps it
+	admin.expect(fiber.MethodPut, ownerPath, map[string]string{"name": "Malee S."}, http.StatusOK)
+	if o, _ := m.Store().Owners.Get(owner.ID); o.Commission != 25 {
+		t.Fatalf("commission after rename: got %d", o.Commission)
+	}
+
+	sell := func(price, salePrice int) int {
+		t.Helper()
+
+		p := testProduct(owner)
+		p.Price, p.SalePrice = price, salePrice
+		staff.expect(fiber.MethodPost, "/api/v1/product", p, http.StatusOK)
+		var list ProductListResponse
+		json.Unmarshal(staff.expect(fiber.MethodGet, "/api/v1/product?limit=100", nil, http.StatusOK), &list)
+		id := list.Products[len(list.Products)-1].ID
+
+		staff.expectWith(fiber.MethodPost, "/api/v1/product/"+strconv.Itoa(id)+"/transition",
+			StatusTransition{Status: statusSold, Note: "cash"}, anyVersion, http.StatusOK)
+		return id
+	}
+	balance := func() OwnerBalance {
+		t.Helper()
+
+		var b OwnerBalance
+		json.Unmarshal(staff.expect(fiber.MethodGet, ownerPath+"/balance", nil, http.StatusOK), &b)
+		return b
+	}
+
+	kept := sell(500, 400)
+	returned := sell(1000, 0)
+	if b := balance(); b.Earned != 300+750 || b.Balance != 1050 || b.Commission != 25 {
+		t.Fatalf("after sales: got %+v", b)
+	}
+
+	staff.expectWith(fiber.MethodPost, "/api/v1/product/"+strconv.Itoa(returned)+"/transition",
+		StatusTransition{Status: statusReturned}, anyVersion, http.StatusOK)
+	if b := balance(); b.Earned != 300 || b.Balance != 300 {
+		t.Fatalf("after return: got %+v", b)
+	}
+
+	staff.expect(fiber.MethodPost, "/api/v1/payout", PayoutRequest{}, http.StatusForbidden)
+	admin.expect(fiber.MethodPost, "/api/v1/payout", PayoutRequest{Owners: []int{999}}, http.StatusNotFound)
+
+	var batch PayoutBatch
+	data := admin.expect(fiber.MethodPost, "/api/v1/payout", PayoutRequest{Note: "October"}, http.StatusCreated)
+	if err := json.Unmarshal(data, &batch); err != nil {
+		t.Fatal(err)
+	}
+	if batch.Total != 300 || len(batch.Payouts) != 1 || batch.Payouts[0].OwnerID != owner.ID || batch.Payouts[0].OwnerName != "Malee S." {
+		t.Fatalf("batch: got %+v", batch)
+	}
+	admin.expect(fiber.MethodGet, "/api/v1/payout/"+strconv.Itoa(batch.ID), nil, http.StatusOK)
+	admin.expect(fiber.MethodPost, "/api/v1/payout", PayoutRequest{}, http.StatusConflict)
+
+	if b := balance(); b.Earned != 300 || b.PaidOut != 300 || b.Balance != 0 {
+		t.Fatalf("after payout: got %+v", b)
+	}
+
+	// The payout settles the sale and moves the product along
+	var p Product
+	json.Unmarshal(staff.expect(fiber.MethodGet, "/api/v1/product/"+strconv.Itoa(kept), nil, http.StatusOK), &p)
+	if p.Status != statusPaidOut {
+		t.Fatalf("paid product: got status %s", p.Status)
+	}
+	var history []StatusChange
+	json.Unmarshal(staff.expect(fiber.MethodGet, "/api/v1/product/"+strconv.Itoa(kept)+"/history", nil, http.StatusOK), &history)
+	if last := history[len(history)-1]; last.To != statusPaidOut || last.Note != payoutNote(batch.ID) {
+		t.Fatalf("paid product history: got %+v", last)
+	}
+
+	var statements []OwnerStatement
+	json.Unmarshal(staff.expect(fiber.MethodGet, ownerPath+"/statements", nil, http.StatusOK), &statements)
+	if len(statements) != 2 || statements[0].PayoutID != 0 || len(statements[0].Entries) != 0 {
+		t.Fatalf("statements: got %+v", statements)
+	}
+	var kinds []string
+	for _, e := range statements[1].Entries {
+		kinds = append(kinds, e.Kind)
+	}
+	if statements[1].Amount != 300 || strings.Join(kinds, ",") != "sale,sale,return,payout" {
+		t.Fatalf("payout statement: got %+v", statements[1])
+	}
+
+	customer.expect(fiber.MethodGet, ownerPath+"/balance", nil, http.StatusForbidden)
+	staff.expect(fiber.MethodGet, "/api/v1/owner/999/statements", nil, http.StatusNotFound)
+}
+
+func TestConsignorPortal(t *testing.T) {
+	m, owner := seedStore(t)
+	store := m.Store()
+	if err := store.Owners.Create(&Owner{Name: "Malee"}); err != nil {
+		t.Fatal(err)
+	}
+	owners, _ := store.Owners.List()
+	other := owners[1]
+
+	consignorUser := &User{Email: "consignor@example.com", Password: "password123", Firstname: "Som", Lastname: "Chai", Role: roleConsignor}
+	u, err := createUser(store.Users, consignorUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	customer, _ := store.Users.FindByEmail("customer@example.com")
+
+	app := newTestAppWithStore(t, m)
+	admin := loginAs(t, app, roleAdmin)
+	staff := loginAs(t, app, roleStaff)
+	consignor := loginAs(t, app, roleConsignor)
+
+	// Not linked yet
+	consignor.expect(fiber.MethodGet, "/api/v1/me/owner", nil, http.StatusForbidden)
+
+	ownerPath := "/api/v1/owner/" + strconv.Itoa(owner.ID)
+	admin.expect(fiber.MethodPut, ownerPath, map[string]int{"userid": customer.ID}, http.StatusUnprocessableEntity)
+	admin.expect(fiber.MethodPut, ownerPath, map[string]int{"userid": 999}, http.StatusUnprocessableEntity)
+	admin.expect(fiber.MethodPut, ownerPath, map[string]int{"userid": u.ID}, http.StatusOK)
+	admin.expect(fiber.MethodPut, "/api/v1/owner/"+strconv.Itoa(other.ID), map[string]int{"userid": u.ID}, http.StatusConflict)
+
+	var me Owner
+	json.Unmarshal(consignor.expect(fiber.MethodGet, "/api/v1/me/owner", nil, http.StatusOK), &me)
+	if me.ID != owner.ID || me.UserID != u.ID {
+		t.Fatalf("me/owner: got %+v", me)
+	}
+
+	mine := createTestProduct(t, staff, owner)
+	sold := createTestProduct(t, staff, owner)
+	staff.expectWith(fiber.MethodPost, "/api/v1/product/"+strconv.Itoa(sold.ID)+"/transition", StatusTransition{Status: statusSold}, anyVersion, http.StatusOK)
+	theirs := createTestProduct(t, staff, other)
+
+	// Asking for another owner's products still only lists their own
+	var list ProductListResponse
+	data := consignor.expect(fiber.MethodGet, "/api/v1/me/owner/products?owner="+strconv.Itoa(other.ID)+"&sort=-price", nil, http.StatusOK)
+	if err := json.Unmarshal(data, &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 2 {
+		t.Fatalf("own products: got %+v", list)
+	}
+	for _, p := range list.Products {
+		if p.Owner != owner.ID {
+			t.Fatalf("own products: got product %d of owner %d", p.ID, p.Owner)
+		}
+	}
+	consignor.expect(fiber.MethodGet, "/api/v1/me/owner/products?status=sold", nil, http.StatusOK)
+
+	var balance OwnerBalance
+	json.Unmarshal(consignor.expect(fiber.MethodGet, "/api/v1/me/owner/balance", nil, http.StatusOK), &balance)
+	if balance.OwnerID != owner.ID || balance.Balance != ownerShare(salePrice(sold), 0) {
+		t.Fatalf("balance: got %+v", balance)
+	}
+	consignor.expect(fiber.MethodGet, "/api/v1/me/owner/statements", nil, http.StatusOK)
+
+	// The staff routes stay closed to consignors
+	consignor.expect(fiber.MethodGet, "/api/v1/owner/"+strconv.Itoa(other.ID)+"/balance", nil, http.StatusForbidden)
+	consignor.expect(fiber.MethodGet, "/api/v1/withdrawal", nil, http.StatusForbidden)
+	staff.expect(fiber.MethodGet, "/api/v1/me/owner", nil, http.StatusForbidden)
+
+	withdraw := func(id, want int) WithdrawalRequest {
+		t.Helper()
+
+		var w WithdrawalRequest
+		data := consignor.expect(fiber.MethodPost, "/api/v1/me/owner/withdrawals", NewWithdrawal{ProductID: id, Note: "moving away"}, want)
+		json.Unmarshal(data, &w)
+		return w
+	}
+	withdraw(theirs.ID, http.StatusNotFound)
+	withdraw(sold.ID, http.StatusConflict)
+	request := withdraw(mine.ID, http.StatusCreated)
+	if request.Status != withdrawalPending || request.ProductName != mine.Name || request.RequestedBy != u.ID {
+		t.Fatalf("request: got %+v", request)
+	}
+	withdraw(mine.ID, http.StatusConflict)
+
+	var pending []WithdrawalRequest
+	json.Unmarshal(staff.expect(fiber.MethodGet, "/api/v1/withdrawal?status=pending", nil, http.StatusOK), &pending)
+	if len(pending) != 1 || pending[0].ID != request.ID {
+		t.Fatalf("pending: got %+v", pending)
+	}
+	staff.expect(fiber.MethodGet, "/api/v1/withdrawal?status=maybe", nil, http.StatusUnprocessableEntity)
+
+	requestPath := "/api/v1/withdrawal/" + strconv.Itoa(request.ID)
+	var decided WithdrawalRequest
+	json.Unmarshal(staff.expect(fiber.MethodPost, requestPath+"/approve", nil, http.StatusOK), &decided)
+	if decided.Status != withdrawalApproved || decided.DecidedAt == "" {
+		t.Fatalf("approved: got %+v", decided)
+	}
+	staff.expect(fiber.MethodPost, requestPath+"/reject", WithdrawalDecision{Note: "too late"}, http.StatusConflict)
+
+	var p Product
+	json.Unmarshal(staff.expect(fiber.MethodGet, "/api/v1/product/"+strconv.Itoa(mine.ID), nil, http.StatusOK), &p)
+	if p.Status != statusWithdrawn {
+		t.Fatalf("withdrawn product: got status %s", p.Status)
+	}
+
+	var history []WithdrawalRequest
+	json.Unmarshal(consignor.expect(fiber.MethodGet, "/api/v1/me/owner/withdrawals", nil, http.StatusOK), &history)
+	if len(history) != 1 || history[0].Status != withdrawalApproved {
+		t.Fatalf("own withdrawals: got %+v", history)
+	}
+
+	// A product a customer ordered stays with the order, whether the request
+	// came before the checkout or after it
+	asked := createTestProduct(t, staff, owner)
+	late := createTestProduct(t, staff, owner)
+	request = withdraw(asked.ID, http.StatusCreated)
+
+	buyer := loginAs(t, app, roleCustomer)
+	var order Order
+	json.Unmarshal(buyer.expect(fiber.MethodPost, "/api/v1/checkout", Checkout{ProductIDs: []int{asked.ID, late.ID}}, http.StatusCreated), &order)
+
+	withdraw(late.ID, http.StatusConflict)
+	requestPath = "/api/v1/withdrawal/" + strconv.Itoa(request.ID)
+	staff.expect(fiber.MethodPost, requestPath+"/approve", nil, http.StatusConflict)
+
+	if got, _ := store.Products.Get(asked.ID, false); got.Status != statusReserved {
+		t.Fatalf("refused approval moved the product to %s", got.Status)
+	}
+	json.Unmarshal(staff.expect(fiber.MethodGet, "/api/v1/withdrawal?status=pending", nil, http.StatusOK), &pending)
+	if len(pending) != 1 || pending[0].ID != request.ID {
+		t.Fatalf("refused approval decided the request: %+v", pending)
+	}
+
+	// Once the order lets go of it the request can go through
+	buyer.expect(fiber.MethodPost, "/api/v1/me/orders/"+strconv.Itoa(order.ID)+"/cancel", nil, http.StatusOK)
+	staff.expect(fiber.MethodPost, requestPath+"/approve", nil, http.StatusOK)
+	if got, _ := store.Products.Get(asked.ID, false); got.Status != statusWithdrawn {
+		t.Fatalf("approved after cancelling: got status %s", got.Status)
+	}
+	if got, _ := store.Products.Get(late.ID, false); got.Status != statusAvailable {
+		t.Fatalf("cancelled order left its product %s", got.Status)
+	}
+}
+
+func TestOrders(t *testing.T) {
+	m, owner := seedStore(t)
+	app := newTestAppWithStore(t, m)
+	staff := loginAs(t, app, roleStaff)
+	admin := loginAs(t, app, roleAdmin)
+	customer := loginAs(t, app, roleCustomer)
+
+	a := createTestProduct(t, staff, owner)
+	b := createTestProduct(t, staff, owner)
+	c := createTestProduct(t, staff, owner)
+
+	status := func(id int) string {
+		t.Helper()
+
+		var p Product
+		json.Unmarshal(staff.expect(fiber.MethodGet, "/api/v1/product/"+strconv.Itoa(id), nil, http.StatusOK), &p)
+		return p.Status
+	}
+
+	customer.expect(fiber.MethodPost, "/api/v1/checkout", Checkout{}, http.StatusUnprocessableEntity)
+	customer.expect(fiber.MethodPost, "/api/v1/checkout", Checkout{ProductIDs: []int{a.ID, a.ID}}, http.StatusUnprocessableEntity)
+	customer.expect(fiber.MethodPost, "/api/v1/checkout", Checkout{ProductIDs: []int{999}}, http.StatusNotFound)
+
+	var order Order
+	data := customer.expect(fiber.MethodPost, "/api/v1/checkout", Checkout{ProductIDs: []int{b.ID, a.ID}, Note: "gift wrap"}, http.StatusCreated)
+	if err := json.Unmarshal(data, &order); err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != orderPending || len(order.Items) != 2 || order.Total != salePrice(a)+salePrice(b) || order.Items[0].ProductName != a.Name {
+		t.Fatalf("checkout: got %+v", order)
+	}
+	if status(a.ID) != statusReserved || status(b.ID) != statusReserved {
+		t.Fatal("checkout didn't reserve the products")
+	}
+
+	// A product of an open order can't be deleted, the order couldn't move it
+	admin.expect(fiber.MethodDelete, "/api/v1/product/"+strconv.Itoa(a.ID), nil, http.StatusConflict)
+
+	// nor moved by hand, only the order moves it
+	reserved, _ := m.Store().Products.Get(a.ID, false)
+	for _, to := range []string{statusAvailable, statusSold, statusWithdrawn} {
+		staff.expectWith(fiber.MethodPost, "/api/v1/product/"+strconv.Itoa(a.ID)+"/transition", StatusTransition{Status: to}, anyVersion, http.StatusConflict)
+	}
+	if got, _ := m.Store().Products.Get(a.ID, false); got.Status != statusReserved || got.Version != reserved.Version {
+		t.Fatalf("refused transitions changed the product: %+v", got)
+	}
+
+	// One product that can't be ordered fails the whole checkout
+	admin.expect(fiber.MethodPost, "/api/v1/checkout", Checkout{ProductIDs: []int{c.ID, b.ID}}, http.StatusConflict)
+	if status(c.ID) != statusAvailable {
+		t.Fatal("failed checkout reserved a product")
+	}
+
+	var mine struct {
+		Orders []Order `json:"orders"`
+		Total  int     `json:"total"`
+	}
+	json.Unmarshal(customer.expect(fiber.MethodGet, "/api/v1/me/orders", nil, http.StatusOK), &mine)
+	if mine.Total != 1 || mine.Orders[0].ID != order.ID {
+		t.Fatalf("my orders: got %+v", mine)
+	}
+	orderPath := strconv.Itoa(order.ID)
+	customer.expect(fiber.MethodGet, "/api/v1/me/orders/"+orderPath, nil, http.StatusOK)
+	admin.expect(fiber.MethodGet, "/api/v1/me/orders/"+orderPath, nil, http.StatusNotFound)
+	customer.expect(fiber.MethodGet, "/api/v1/order/"+orderPath, nil, http.StatusForbidden)
+	customer.expect(fiber.MethodGet, "/api/v1/me/orders?status=lost", nil, http.StatusUnprocessableEntity)
+
+	move := func(to string, want int) Order {
+		t.Helper()
+
+		var o Order
+		data := staff.expect(fiber.MethodPost, "/api/v1/order/"+orderPath+"/status", OrderTransition{Status: to}, want)
+		json.Unmarshal(data, &o)
+		return o
+	}
+	move("lost", http.StatusUnprocessableEntity)
+	move(orderShipped, http.StatusConflict)
+	staff.expect(fiber.MethodPost, "/api/v1/order/"+orderPath+"/payment",
+		PaymentConfirmation{Amount: order.Total, Reference: "SLIP-1"}, http.StatusOK)
+	if status(a.ID) != statusSold || status(b.ID) != statusSold {
+		t.Fatal("payment didn't sell the products")
+	}
+	if balance, _ := m.Store().Ledger.Balance(owner.ID); balance.Earned != salePrice(a)+salePrice(b) {
+		t.Fatalf("payment didn't reach the ledger: got %+v", balance)
+	}
+
+	customer.expect(fiber.MethodPost, "/api/v1/me/orders/"+orderPath+"/cancel", nil, http.StatusConflict)
+	move(orderShipped, http.StatusOK)
+	done := move(orderCompleted, http.StatusOK)
+	if len(done.History) != 4 || done.History[1].To != orderPaid || done.History[3].From != orderShipped {
+		t.Fatalf("history: got %+v", done.History)
+	}
+	move(orderCancelled, http.StatusConflict)
+
+	// A customer can cancel before paying, the product goes back on sale
+	data = customer.expect(fiber.MethodPost, "/api/v1/checkout", Checkout{ProductIDs: []int{c.ID}}, http.StatusCreated)
+	json.Unmarshal(data, &order)
+	customer.expect(fiber.MethodPost, "/api/v1/me/orders/"+strconv.Itoa(order.ID)+"/cancel", nil, http.StatusOK)
+	if status(c.ID) != statusAvailable {
+		t.Fatal("cancel didn't release the product")
+	}
+	admin.expect(fiber.MethodDelete, "/api/v1/product/"+strconv.Itoa(a.ID), nil, http.StatusConflict)
+	admin.expect(fiber.MethodDelete, "/api/v1/product/"+strconv.Itoa(c.ID), nil, http.StatusOK)
+
+	var all struct {
+		Orders []Order `json:"orders"`
+		Total  int     `json:"total"`
+	}
+	json.Unmarshal(staff.expect(fiber.MethodGet, "/api/v1/order?status=cancelled", nil, http.StatusOK), &all)
+	if all.Total != 1 || all.Orders[0].ID != order.ID {
+		t.Fatalf("cancelled orders: got %+v", all)
+	}
+}
+
+func TestCartHolds(t *testing.T) {
+	m, owner := seedStore(t)
+	app := newTestAppWithStore(t, m)
+	staff := loginAs(t, app, roleStaff)
+	admin := loginAs(t, app, roleAdmin)
+	customer := loginAs(t, app, roleCustomer)
+
+	a := createTestProduct(t, staff, owner)
+	b := createTestProduct(t, staff, owner)
+	c := createTestProduct(t, staff, owner)
+
+	product := func(id int) Product {
+		t.Helper()
+
+		var p Product
+		json.Unmarshal(staff.expect(fiber.MethodGet, "/api/v1/product/"+strconv.Itoa(id), nil, http.StatusOK), &p)
+		return p
+	}
+	filtered := func(query string) []int {
+		t.Helper()
+
+		var list ProductListResponse
+		json.Unmarshal(staff.expect(fiber.MethodGet, "/api/v1/product/filter?"+query, nil, http.StatusOK), &list)
+		ids := []int{}
+		for _, p := range list.Products {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+
+	var cart Cart
+	data := customer.expect(fiber.MethodPost, "/api/v1/me/cart", AddToCart{ProductID: a.ID}, http.StatusCreated)
+	if err := json.Unmarshal(data, &cart); err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.Items) != 1 || cart.Items[0].ProductID != a.ID || cart.Total != salePrice(a) || cart.Items[0].HeldUntil == "" {
+		t.Fatalf("add: got %+v", cart)
+	}
+
+	customer.expect(fiber.MethodPost, "/api/v1/me/cart", AddToCart{ProductID: a.ID}, http.StatusConflict)
+	admin.expect(fiber.MethodPost, "/api/v1/me/cart", AddToCart{ProductID: a.ID}, http.StatusConflict)
+	admin.expect(fiber.MethodPost, "/api/v1/me/cart", AddToCart{ProductID: 999}, http.StatusNotFound)
+	admin.expect(fiber.MethodPost, "/api/v1/checkout", Checkout{ProductIDs: []int{a.ID}}, http.StatusConflict)
+
+	// The product stays available in the lifecycle but shows as held
+	if p := product(a.ID); !p.Held || p.Status != statusAvailable {
+		t.Fatalf("held product: got %+v", p)
+	}
+	if got := filtered("held=true"); !slices.Equal(got, []int{a.ID}) {
+		t.Fatalf("held=true: got %v", got)
+	}
+	if got := filtered("held=false"); !slices.Equal(got, []int{b.ID, c.ID}) {
+		t.Fatalf("held=false: got %v", got)
+	}
+	staff.expect(fiber.MethodGet, "/api/v1/product/filter?held=maybe", nil, http.StatusUnprocessableEntity)
+
+	json.Unmarshal(customer.expect(fiber.MethodDelete, "/api/v1/me/cart/"+strconv.Itoa(a.ID), nil, http.StatusOK), &cart)
+	if len(cart.Items) != 0 || product(a.ID).Held {
+		t.Fatalf("remove: got %+v", cart)
+	}
+	customer.expect(fiber.MethodDelete, "/api/v1/me/cart/"+strconv.Itoa(a.ID), nil, http.StatusNotFound)
+	customer.expect(fiber.MethodPost, "/api/v1/me/cart/checkout", nil, http.StatusConflict)
+
+	// Checking the cart out orders it and ends the holds
+	customer.expect(fiber.MethodPost, "/api/v1/me/cart", AddToCart{ProductID: b.ID}, http.StatusCreated)
+	customer.expect(fiber.MethodPost, "/api/v1/me/cart", AddToCart{ProductID: a.ID}, http.StatusCreated)
+
+	var order Order
+	data = customer.expect(fiber.MethodPost, "/api/v1/me/cart/checkout", CartCheckout{Note: "gift wrap"}, http.StatusCreated)
+	if err := json.Unmarshal(data, &order); err != nil {
+		t.Fatal(err)
+	}
+	if len(order.Items) != 2 || order.Note != "gift wrap" || order.Total != salePrice(a)+salePrice(b) {
+		t.Fatalf("cart checkout: got %+v", order)
+	}
+	if p := product(a.ID); p.Held || p.Status != statusReserved {
+		t.Fatalf("ordered product: got %+v", p)
+	}
+	json.Unmarshal(customer.expect(fiber.MethodGet, "/api/v1/me/cart", nil, http.StatusOK), &cart)
+	if len(cart.Items) != 0 {
+		t.Fatalf("cart after checkout: got %+v", cart)
+	}
+
+	// Moving a held product out of available ends the hold
+	customer.expect(fiber.MethodPost, "/api/v1/me/cart", AddToCart{ProductID: c.ID}, http.StatusCreated)
+	staff.expectWith(fiber.MethodPost, "/api/v1/product/"+strconv.Itoa(c.ID)+"/transition", StatusTransition{Status: statusDraft}, anyVersion, http.StatusOK)
+	if product(c.ID).Held {
+		t.Fatal("transition kept the hold")
+	}
+	staff.expectWith(fiber.MethodPost, "/api/v1/product/"+strconv.Itoa(c.ID)+"/transition", StatusTransition{Status: statusAvailable}, anyVersion, http.StatusOK)
+
+	// An expired hold stops counting before the sweeper gets to it
+	cfg.CartHoldTTL = 200 * time.Millisecond
+	customer.expect(fiber.MethodPost, "/api/v1/me/cart", AddToCart{ProductID: c.ID}, http.StatusCreated)
+	if !product(c.ID).Held {
+		t.Fatal("product isn't held")
+	}
+	time.Sleep(250 * time.Millisecond)
+	if product(c.ID).Held {
+		t.Fatal("expired hold still counts")
+	}
+	if released, err := m.Store().Carts.ReleaseExpired(); err != nil || released != 1 {
+		t.Fatalf("release expired: got %d, %v", released, err)
+	}
+	admin.expect(fiber.MethodPost, "/api/v1/me/cart", AddToCart{ProductID: c.ID}, http.StatusCreated)
+}
+
+func TestPromptPayPayload(t *testing.T) {
+	if got := crc16CCITT([]byte("123456789")); got != 0x29B1 {
+		t.Fatalf("crc16CCITT check value: got %04X, want 29B1", got)
+	}
+
+	payload, err := promptPayPayload("081-234-5678", 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "000201" + "010212" +
+		"2937" + "0016A000000677010111" + "01130066812345678" +
+		"5303764" + "5406400.00" + "5802TH" + "6304"
+	if !strings.HasPrefix(payload, want) || len(payload) != len(want)+4 {
+		t.Fatalf("payload: got %s", payload)
+	}
+	if crc := fmt.Sprintf("%04X", crc16CCITT([]byte(want))); !strings.HasSuffix(payload, crc) {
+		t.Fatalf("payload %s doesn't end with its CRC %s", payload, crc)
+	}
+
+	for target, account := range map[string]string{
+		"1234567890123":   "02131234567890123",
+		"123456789012345": "0315123456789012345",
+	} {
+		if got, err := promptPayAccount(target); err != nil || got != account {
+			t.Errorf("promptPayAccount(%s): got %s, %v, want %s", target, got, err, account)
+		}
+	}
+	for _, target := range []string{"", "812345678", "1234567890", "08123456ab"} {
+		if _, err := promptPayAccount(target); err == nil {
+			t.Errorf("promptPayAccount(%q) should fail", target)
+		}
+	}
+}
+
+func TestPromptPayPayments(t *testing.T) {
+	m, owner := seedStore(t)
+	newTestAppWithStore(t, m)
+	cfg.PromptPay = PromptPayConfig{ID: "0812345678", WebhookDriver: webhookDriverHMAC, WebhookSecret: "webhook_secret"}
+	app := newApp(m.Store(), newLocalStorage(t.TempDir(), localStoragePath))
+
+	staff := loginAs(t, app, roleStaff)
+	admin := loginAs(t, app, roleAdmin)
+	customer := loginAs(t, app, roleCustomer)
+	provider := &testClient{t: t, app: app}
+
+	a := createTestProduct(t, staff, owner)
+	b := createTestProduct(t, staff, owner)
+
+	var order Order
+	json.Unmarshal(customer.expect(fiber.MethodPost, "/api/v1/checkout", Checkout{ProductIDs: []int{a.ID}}, http.StatusCreated), &order)
+	orderPath := "/api/v1/me/orders/" + strconv.Itoa(order.ID)
+
+	var qr PromptPayQR
+	json.Unmarshal(customer.expect(fiber.MethodGet, orderPath+"/promptpay", nil, http.StatusOK), &qr)
+	if qr.Amount != salePrice(a) || !strings.Contains(qr.Payload, "5406400.00") {
+		t.Fatalf("qr: got %+v", qr)
+	}
+	admin.expect(fiber.MethodGet, orderPath+"/promptpay", nil, http.StatusNotFound)
+
+	resp, data := customer.do(fiber.MethodGet, orderPath+"/promptpay.png", nil, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(fiber.HeaderContentType) != "image/png" {
+		t.Fatalf("qr png: got %d %s", resp.StatusCode, resp.Header.Get(fiber.HeaderContentType))
+	}
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatalf("qr png: %v", err)
+	}
+
+	webhook := func(payment PaymentConfirmation, secret string, want int) Order {
+		t.Helper()
+
+		body, _ := json.Marshal(payment)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		headers := map[string]string{webhookSignatureHeader: "sha256=" + hex.EncodeToString(mac.Sum(nil))}
+
+		resp, data := provider.do(fiber.MethodPost, "/api/v1/payment/promptpay/webhook", payment, headers)
+		if resp.StatusCode != want {
+			t.Fatalf("webhook: got %d, want %d: %s", resp.StatusCode, want, data)
+		}
+		var o Order
+		json.Unmarshal(data, &o)
+		return o
+	}
+
+	paid := PaymentConfirmation{OrderID: order.ID, Amount: qr.Amount, Reference: "BANK-0001"}
+	webhook(paid, "not_the_secret", http.StatusUnauthorized)
+	webhook(PaymentConfirmation{OrderID: order.ID, Amount: qr.Amount + 1, Reference: "BANK-0001"}, "webhook_secret", http.StatusConflict)
+	webhook(PaymentConfirmation{OrderID: order.ID, Amount: qr.Amount}, "webhook_secret", http.StatusUnprocessableEntity)
+
+	order = webhook(paid, "webhook_secret", http.StatusOK)
+	if order.Status != orderPaid || order.Payment == nil || order.Payment.Source != paymentSourceWebhook || order.Payment.Reference != "BANK-0001" {
+		t.Fatalf("webhook payment: got %+v", order)
+	}
+	var p Product
+	json.Unmarshal(staff.expect(fiber.MethodGet, "/api/v1/product/"+strconv.Itoa(a.ID), nil, http.StatusOK), &p)
+	if p.Status != statusSold {
+		t.Fatalf("paid product: got %s", p.Status)
+	}
+
+	// A retried webhook gets the order back, a second payment doesn't go through
+	if again := webhook(paid, "webhook_secret", http.StatusOK); again.Status != orderPaid || len(again.History) != len(order.History) {
+		t.Fatalf("webhook retry: got %+v", again)
+	}
+	webhook(PaymentConfirmation{OrderID: order.ID, Amount: qr.Amount, Reference: "BANK-0002"}, "webhook_secret", http.StatusConflict)
+	customer.expect(fiber.MethodGet, orderPath+"/promptpay", nil, http.StatusConflict)
+
+	// Staff confirm a slip by hand, a bank reference only pays one order
+	json.Unmarshal(customer.expect(fiber.MethodPost, "/api/v1/checkout", Checkout{ProductIDs: []int{b.ID}}, http.StatusCreated), &order)
+	paymentPath := "/api/v1/order/" + strconv.Itoa(order.ID) + "/payment"
+	customer.expect(fiber.MethodPost, paymentPath, PaymentConfirmation{Amount: order.Total, Reference: "SLIP-1"}, http.StatusForbidden)
+	// Marking it paid without a payment is refused
+	staff.expect(fiber.MethodPost, "/api/v1/order/"+strconv.Itoa(order.ID)+"/status", OrderTransition{Status: orderPaid}, http.StatusConflict)
+	staff.expect(fiber.MethodPost, paymentPath, PaymentConfirmation{Amount: order.Total}, http.StatusUnprocessableEntity)
+	staff.expect(fiber.MethodPost, paymentPath, PaymentConfirmation{Amount: order.Total, Reference: "BANK-0001"}, http.StatusConflict)
+
+	json.Unmarshal(staff.expect(fiber.MethodPost, paymentPath, PaymentConfirmation{Amount: order.Total, Reference: "SLIP-1", Note: "matched by hand"}, http.StatusOK), &order)
+	if order.Status != orderPaid || order.Payment.Source != paymentSourceStaff || order.Payment.ConfirmedBy == 0 {
+		t.Fatalf("staff payment: got %+v", order)
+	}
+	if last := order.History[len(order.History)-1]; last.To != orderPaid || last.Note != "PromptPay SLIP-1: matched by hand" {
+		t.Fatalf("payment history: got %+v", last)
+	}
+
+	// Without a PromptPay id there is nothing to scan
+	json.Unmarshal(customer.expect(fiber.MethodPost, "/api/v1/checkout", Checkout{ProductIDs: []int{createTestProduct(t, staff, owner).ID}}, http.StatusCreated), &order)
+	cfg.PromptPay.ID = ""
+	customer.expect(fiber.MethodGet, "/api/v1/me/orders/"+strconv.Itoa(order.ID)+"/promptpay", nil, http.StatusConflict)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"github.com/google/uuid"
+	"golang.org/x/image/draw"
+)
+
+const (
+	maxImageBytes       = 8 << 20
+	maxImagesPerUpload  = 5
+	maxImagesPerProduct = 20
+	// maxImagePixels stops a small file from decoding into gigabytes
+	maxImagePixels = 40_000_000
+
+	webImageSize   = 1600
+	thumbImageSize = 320
+)
+
+// imageExtensions lists the accepted upload types, sniffed from the content
+// and not taken from the file name or the client's Content-Type.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+// ProductImage is an uploaded image with its web sized and thumbnail
+// variants. The storage keys stay on the server, clients get the URLs.
+type ProductImage struct {
+	ID          int    `json:"id"`
+	ProductID   int    `json:"productid"`
+	Position    int    `json:"position"`
+	ContentType string `json:"contenttype"`
+	Size        int64  `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	URL         string `json:"url"`
+	WebURL      string `json:"weburl"`
+	ThumbURL    string `json:"thumburl"`
+	Create_Date string `json:"createdate"`
+
+	Key      string `json:"-"`
+	WebKey   string `json:"-"`
+	ThumbKey string `json:"-"`
+}
+
+// ImageOrder is the body of PUT /product/:id/images
+type ImageOrder struct {
+	Order []int `json:"order"`
+}
+
+// imageUpload is one accepted upload with its variants, ready to be stored
+type imageUpload struct {
+	image ProductImage
+	files map[string][]byte
+}
+
+// decodeImage checks an upload and decodes it, problem is a message for the
+// client when the upload isn't acceptable.
+func decodeImage(data []byte) (img image.Image, contentType string, problem string) {
+	if len(data) > maxImageBytes {
+		return nil, "", fmt.Sprintf("must be at most %d MB", maxImageBytes>>20)
+	}
+
+	contentType = http.DetectContentType(data)
+	if _, ok := imageExtensions[contentType]; !ok {
+		return nil, "", "must be a JPEG or PNG image"
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", "can't be read as an image"
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, "", fmt.Sprintf("must be at most %d megapixels", maxImagePixels/1_000_000)
+	}
+
+	img, _, err = image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", "can't be read as an image"
+	}
+
+	return img, contentType, ""
+}
+
+// prepareImageUpload makes the variants of a decoded image and picks the
+// storage keys, the original is stored as uploaded.
+func prepareImageUpload(productID int, data []byte, img image.Image, contentType string) (imageUpload, error) {
+	web, err := encodeImage(resizeToFit(img, webImageSize), contentType)
+	if err != nil {
+		return imageUpload{}, err
+	}
+	thumb, err := encodeImage(resizeToFit(img, thumbImageSize), contentType)
+	if err != nil {
+		return imageUpload{}, err
+	}
+
+	base := fmt.Sprintf("products/%d/%s", productID, uuid.NewString())
+	ext := imageExtensions[contentType]
+	bounds := img.Bounds()
+
+	pi := ProductImage{
+		ProductID:   productID,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Width:       bounds.Dx(),
+		Height:      bounds.Dy(),
+		Key:         base + ext,
+		WebKey:      base + "_web" + ext,
+		ThumbKey:    base + "_thumb" + ext,
+	}
+
+	return imageUpload{
+		image: pi,
+		files: map[string][]byte{pi.Key: data, pi.WebKey: web, pi.ThumbKey: thumb},
+	}, nil
+}
+
+// resizeToFit scales img down so neither side is longer than size, smaller
+// images keep their size. Either way the result is a fresh image, so the
+// variants never carry the original's metadata.
+func resizeToFit(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/bounds.Dx())
+		} else {
+			w, h = max(1, w*size/bounds.Dy()), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+func encodeImage(img image.Image, contentType string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	var err error
+	if contentType == "image/png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	}
+
+	return buf.Bytes(), err
+}
+
+// withImageURLs fills in the URLs clients load the files from
+func withImageURLs(files Storage, images []ProductImage) []ProductImage {
+	for i := range images {
+		images[i].URL = files.URL(images[i].Key)
+		images[i].WebURL = files.URL(images[i].WebKey)
+		images[i].ThumbURL = files.URL(images[i].ThumbKey)
+	}
+	return images
+}
+
+// checkImageOrder makes sure order lists every one of ids exactly once
+func checkImageOrder(ids []int, order []int) error {
+	want := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+
+	ok := len(order) == len(ids)
+	for _, id := range order {
+		if !want[id] {
+			ok = false
+			break
+		}
+		delete(want, id)
+	}
+
+	if ok {
+		return nil
+	}
+
+	v := &ValidationError{}
+	v.add("order", "must list every image of the product exactly once")
+	return v
+}
@@ -0,0 +1,148 @@
+package main
+
+import "fmt"
+
+// defaultCommission is the percentage of a sale the shop keeps when an owner
+// is created without one, migration 0010 gives existing owners the same.
+const defaultCommission = 30
+
+// The kinds of owner ledger entries. A sale adds the owner's share, a return
+// takes it back and a payout settles everything still open.
+const (
+	ledgerSale   = "sale"
+	ledgerReturn = "return"
+	ledgerPayout = "payout"
+)
+
+// LedgerEntry is one line of what the shop owes an owner. Amount is positive
+// when it adds to what the owner is owed. SalePrice and Commission are kept as
+// they were at the sale, later changes to the product or owner don't touch it.
+type LedgerEntry struct {
+	ID          int    `json:"id"`
+	OwnerID     int    `json:"ownerid"`
+	Kind        string `json:"kind"`
+	ProductID   int    `json:"productid,omitempty"`
+	ProductName string `json:"productname,omitempty"`
+	PayoutID    int    `json:"payoutid,omitempty"`
+	SalePrice   int    `json:"saleprice"`
+	Commission  int    `json:"commission"`
+	Amount      int    `json:"amount"`
+	Note        string `json:"note"`
+	CreatedAt   string `json:"createdat"`
+}
+
+// OwnerBalance is the body of GET /owner/:id/balance. Earned is the owner's
+// share of every sale less returns, Balance what hasn't been paid out yet.
+type OwnerBalance struct {
+	OwnerID    int `json:"ownerid"`
+	Commission int `json:"commission"`
+	Earned     int `json:"earned"`
+	PaidOut    int `json:"paidout"`
+	Balance    int `json:"balance"`
+}
+
+// OwnerStatement lists the entries one payout settled, or with PayoutID 0
+// the entries still open and what they add up to.
+type OwnerStatement struct {
+	PayoutID int           `json:"payoutid"`
+	PaidAt   string        `json:"paidat,omitempty"`
+	Amount   int           `json:"amount"`
+	Entries  []LedgerEntry `json:"entries"`
+}
+
+// Payout is what one owner was paid in a batch
+type Payout struct {
+	ID        int    `json:"id"`
+	BatchID   int    `json:"batchid"`
+	OwnerID   int    `json:"ownerid"`
+	OwnerName string `json:"ownername"`
+	Amount    int    `json:"amount"`
+	CreatedAt string `json:"createdat"`
+}
+
+// PayoutBatch settles the open balances of several owners at once
+type PayoutBatch struct {
+	ID        int      `json:"id"`
+	Note      string   `json:"note"`
+	CreatedBy int      `json:"createdby"`
+	CreatedAt string   `json:"createdat"`
+	Total     int      `json:"total"`
+	Payouts   []Payout `json:"payouts"`
+}
+
+// PayoutRequest is the body of POST /payout, no owners means every owner
+// with a balance
+type PayoutRequest struct {
+	Owners []int  `json:"owners"`
+	Note   string `json:"note"`
+}
+
+// salePrice is what the customer paid, the sale price when there is one
+func salePrice(p Product) int {
+	if p.SalePrice > 0 {
+		return p.SalePrice
+	}
+	return p.Price
+}
+
+// ownerShare is what the owner gets of a sale, rounded down to whole units so
+// the shop never pays out more than it took
+func ownerShare(price, commission int) int {
+	return price * (100 - commission) / 100
+}
+
+func checkCommission(v *ValidationError, commission int) {
+	if commission < 0 || commission > 100 {
+		v.add("commission", "must be between 0 and 100")
+	}
+}
+
+// payoutNote is the history note of products a payout moves to paid-out
+func payoutNote(batchID int) string {
+	return fmt.Sprintf("payout batch %d", batchID)
+}
+
+// buildStatements groups the ledger entries of an owner by the payout that
+// settled them, the open statement first and then the payouts newest first.
+// Both are expected in the order they happened.
+func buildStatements(payouts []Payout, entries []LedgerEntry) []OwnerStatement {
+	open := OwnerStatement{Entries: []LedgerEntry{}}
+	settled := map[int][]LedgerEntry{}
+
+	for _, e := range entries {
+		if e.PayoutID == 0 {
+			open.Entries = append(open.Entries, e)
+			open.Amount += e.Amount
+			continue
+		}
+		settled[e.PayoutID] = append(settled[e.PayoutID], e)
+	}
+
+	statements := []OwnerStatement{open}
+	for i := len(payouts) - 1; i >= 0; i-- {
+		p := payouts[i]
+		statements = append(statements, OwnerStatement{
+			PayoutID: p.ID,
+			PaidAt:   p.CreatedAt,
+			Amount:   p.Amount,
+			Entries:  settled[p.ID],
+		})
+	}
+
+	return statements
+}
+
+// checkPayoutOwners makes sure every owner a payout asked for exists
+func checkPayoutOwners(requested, found []int) error {
+	exists := make(map[int]bool, len(found))
+	for _, id := range found {
+		exists[id] = true
+	}
+
+	for _, id := range requested {
+		if !exists[id] {
+			return notFoundf("no owner found with id %d", id)
+		}
+	}
+	return nil
+}
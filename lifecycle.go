@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The statuses of the product lifecycle, migration 0006 creates their rows.
+// Admins may add other statuses, but products can only move between these.
+const (
+	statusDraft     = "draft"
+	statusAvailable = "available"
+	statusReserved  = "reserved"
+	statusSold      = "sold"
+	statusPaidOut   = "paid-out"
+	statusWithdrawn = "withdrawn"
+	statusReturned  = "returned"
+)
+
+var lifecycleStatuses = []string{
+	statusDraft, statusAvailable, statusReserved, statusSold, statusPaidOut, statusWithdrawn, statusReturned,
+}
+
+// statusTransitions lists where a product may move from each status. Paid
+// out is final, the owner has been paid for the sale.
+var statusTransitions = map[string][]string{
+	statusDraft:     {statusAvailable, statusWithdrawn},
+	statusAvailable: {statusDraft, statusReserved, statusSold, statusWithdrawn},
+	statusReserved:  {statusAvailable, statusSold, statusWithdrawn},
+	statusSold:      {statusPaidOut, statusReturned},
+	statusReturned:  {statusAvailable, statusWithdrawn},
+	statusWithdrawn: {statusDraft, statusAvailable},
+	statusPaidOut:   {},
+}
+
+// StatusTransition is the body of POST /product/:id/transition
+type StatusTransition struct {
+	Status string `json:"status"`
+	Note   string `json:"note"`
+}
+
+// StatusChange is one row of a product's status history. From is empty when
+// the old status has since been deleted, ChangedBy is 0 when the user was.
+type StatusChange struct {
+	ID        int    `json:"id"`
+	ProductID int    `json:"productid"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	ChangedBy int    `json:"changedby"`
+	Note      string `json:"note"`
+	ChangedAt string `json:"changedat"`
+}
+
+// deletableStatuses are the statuses no order or sale needs a product in.
+// Deleting a reserved or sold product would strand its order, which can only
+// move its products while they aren't deleted.
+var deletableStatuses = []string{statusDraft, statusAvailable, statusWithdrawn}
+
+func checkDeletable(p Product) error {
+	for _, s := range deletableStatuses {
+		if p.Status == s {
+			return nil
+		}
+	}
+	return conflictf("product %d is %s and can't be deleted, only %s products can",
+		p.ID, p.Status, strings.Join(deletableStatuses, ", "))
+}
+
+func isLifecycleStatus(name string) bool {
+	_, ok := statusTransitions[name]
+	return ok
+}
+
+// checkTransition tells whether product id may move from one status to
+// another. Products still in a status from before the lifecycle existed may
+// move to any lifecycle status, that is how they join it.
+func checkTransition(id int, from, to string) error {
+	if !isLifecycleStatus(to) {
+		v := &ValidationError{}
+		v.add("status", "must be one of "+strings.Join(lifecycleStatuses, ", "))
+		return v
+	}
+	if from == to {
+		return conflictf("product %d is already %s", id, to)
+	}
+
+	next, ok := statusTransitions[from]
+	if !ok {
+		return nil
+	}
+	for _, s := range next {
+		if s == to {
+			return nil
+		}
+	}
+
+	return conflictf("product %d can't move from %s to %s", id, from, to)
+}
+
+// checkStatusKept rejects a write that changes the status of a stored
+// product. Only Transition changes it, so every change ends up in the history.
+func checkStatusKept(current, p *Product) error {
+	if p.StatusID == current.StatusID {
+		return nil
+	}
+
+	v := &ValidationError{}
+	v.add("status", fmt.Sprintf("can only be changed through POST /api/v1/product/%d/transition", current.ID))
+	return v
+}
+
+// checkNewProductStatus makes new products enter the lifecycle at the start
+func checkNewProductStatus(p *Product) error {
+	if p.Status == statusDraft || p.Status == statusAvailable {
+		return nil
+	}
+
+	v := &ValidationError{}
+	v.add("status", fmt.Sprintf("new products must be %s or %s", statusDraft, statusAvailable))
+	return v
+}
+
+// checkStatusEditable keeps the lifecycle statuses from being renamed or
+// deleted, the transitions refer to them by name.
+func checkStatusEditable(s Status) error {
+	if isLifecycleStatus(s.Name) {
+		return conflictf("status %q is part of the product lifecycle", s.Name)
+	}
+	return nil
+}
@@ -1,26 +1,24 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
+	"os"
 	"strconv"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	jwtware "github.com/gofiber/jwt/v3"
 	_ "github.com/lib/pq"
+	"github.com/skip2/go-qrcode"
 )
 
-var jwtSecret = []byte("your_secret_key")
-
-const (
-	host     = "localhost"          // or the Docker service name if running in another container
-	port     = 5432                 // default PostgreSQL port
-	user     = "wearlab"            // as defined in docker-compose.yml
-	password = "wearlabbro30102001" // as defined in docker-compose.yml
-	dbname   = "wearlabdatabase"    // as defined in docker-compose.yml
-)
+var jwtSecret []byte
 
 type Login struct {
 	Email    string `json:"email"`
@@ -33,17 +31,22 @@ type Product struct {
 	Description string   `json:"description"`
 	Defect      string   `json:"defect"`
 	Type        string   `json:"type"`
+	TypeID      int      `json:"typeid"`
 	Waist       int      `json:"waist"`
 	Length      int      `json:"length"`
 	Chest       int      `json:"chest"`
 	Owner       int      `json:"owner"`
 	Status      string   `json:"status"`
+	StatusID    int      `json:"statusid"`
+	Held        bool     `json:"held"`
 	Price       int      `json:"price"`
 	SalePrice   int      `json:"saleprice"`
 	Image       []string `json:"image"`
 	Create_Date string   `json:"createdate"`
 	Update_Date string   `json:"updatedate"`
 	Owner_Name  string   `json:"ownername"`
+	Version     int      `json:"version"`
+	Delete_Date *string  `json:"deletedate,omitempty"`
 }
 
 type ProductListResponse struct {
@@ -51,9 +54,28 @@ type ProductListResponse struct {
 	Products []Product `json:"products"`
 }
 
+type BulkUpdateResult struct {
+	ID      int          `json:"id"`
+	Status  string       `json:"status"`
+	Error   string       `json:"error,omitempty"`
+	Errors  []FieldError `json:"errors,omitempty"`
+	Product *Product     `json:"product,omitempty"`
+}
+
+type BulkUpdateResponse struct {
+	Mode      string             `json:"mode"`
+	Committed bool               `json:"committed"`
+	Results   []BulkUpdateResult `json:"results"`
+}
+
+// Owner is the consignor who brought products in. Commission is the
+// percentage of a sale the shop keeps, see ledger.go. UserID is the account
+// the consignor signs in with, 0 when they have none.
 type Owner struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Commission int    `json:"commission"`
+	UserID     int    `json:"userid"`
 }
 
 type Type struct {
@@ -80,7 +102,7 @@ type DayOff struct {
 type User struct {
 	ID        int    `json:"id"`
 	Email     string `json:"email"`
-	Password  string `json:"password"`
+	Password  string `json:"password,omitempty"`
 	Firstname string `json:"firstname"`
 	Lastname  string `json:"lastname"`
 	Phone     int    `json:"phone"`
@@ -96,26 +118,39 @@ type Item struct {
 }
 
 type Token struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshtoken"`
+	ExpiresIn    int64  `json:"expiresin"`
 }
 
-var db *sql.DB
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshtoken"`
+}
 
 func main() {
-	// Connection string
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
-		"password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to an optional YAML config file")
+	flag.Parse()
+
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg = c
+	jwtSecret = []byte(cfg.JWTSecret)
 
 	// Open a connection
-	sdb, err := sql.Open("postgres", psqlInfo)
+	db, err := sql.Open("postgres", cfg.DB.dsn())
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	defer db.Close()
-	db = sdb
+
+	db.SetMaxOpenConns(cfg.DB.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.DB.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.DB.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.DB.ConnMaxIdleTime)
 
 	// Check the connection to make sure
 	err = db.Ping()
@@ -123,356 +158,1510 @@ func main() {
 		log.Fatal(err)
 	}
 
-	app := fiber.New()
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrateCommand(db, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if cfg.AutoMigrate {
+		if err := runMigrateCommand(db, []string{"up"}, log.Writer()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	files, err := newStorage(context.Background(), cfg.Storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store := newPostgresStore(db)
+	go runHoldSweeper(context.Background(), store.Carts, cfg.CartSweepInterval)
 
-	app.Use(cors.New())
+	app := newApp(store, files)
 
-	app.Post("/login", loginHandler)
+	log.Fatal(app.Listen(cfg.ListenAddr))
+}
 
-	app.Get("/product/filter", getProductWithFilterHandler)
-	app.Get("/product/:id", getProductByIdHandle)
-	app.Get("/product", getProductsHandler)
-	app.Get("/owner", getOwnersHandler)
-	app.Put("/owner/:id", updateOwnerHandler)
-	app.Post("/owner", createOwnerHandler)
-	app.Get("/type", getTypesHandler)
-	app.Get("/status", getStatusHandler)
-	app.Post("/user", createUserHandler)
-	app.Get("/users", getUsersHandler)
+// Handlers get their storage injected, so tests can run them against the
+// in-memory store instead of Postgres.
+type authHandler struct {
+	users UserRepository
+}
 
-	// Protected routes for /product only
-	productGroup := app.Group("/product", jwtware.New(jwtware.Config{
-		SigningKey: jwtSecret,
-	}))
+type productHandler struct {
+	products ProductRepository
+	lookups  LookupRepository
+}
 
-	productGroup.Post("/", createProductHandler)
-	productGroup.Put("/:id", updateProductHandle)
-	productGroup.Delete("/:id", deleteProductHandler)
+type ownerHandler struct {
+	owners OwnerRepository
+	users  UserRepository
+	ledger LedgerRepository
+}
 
-	// If you also want to protect these, move them to another group:
-	ownerGroup := app.Group("/owner", jwtware.New(jwtware.Config{
-		SigningKey: jwtSecret,
-	}))
+// consignorHandler serves /me/owner, always for the owner requireOwnerAccount found
+type consignorHandler struct {
+	products    ProductRepository
+	ledger      LedgerRepository
+	withdrawals WithdrawalRepository
+}
 
-	ownerGroup.Put("/:id", updateOwnerHandler)
-	ownerGroup.Post("/", createOwnerHandler)
+type withdrawalHandler struct {
+	withdrawals WithdrawalRepository
+}
 
-	// Start Fiber and Socket.IO
-	app.Listen(":8080")
+type orderHandler struct {
+	orders  OrderRepository
+	webhook PaymentWebhook
+}
 
-	// app.Listen(":8080")
+// cartHandler serves /me/cart, checking the cart out goes through orders
+type cartHandler struct {
+	carts  CartRepository
+	orders OrderRepository
+}
 
-	// fmt.Println("Successfully connected!")
+type payoutHandler struct {
+	ledger LedgerRepository
+}
 
-	// err = createProduct(&Product{Name: "Go product", Price: 220})
+type lookupHandler struct {
+	lookups LookupRepository
+}
 
-	// product, err := getProductById(2)
+type imageHandler struct {
+	images ImageRepository
+	files  Storage
+}
 
-	// for choice 1
-	// err = updateProduct(1, &Product{Name: "New name", Price: 310})
+func (h *authHandler) loginHandler(c *fiber.Ctx) error {
+	req := new(Login)
 
-	//for choice 2
-	// product, err := updateProduct(5, &Product{Name: "New name id 3", Price: 320})
+	if err := c.BodyParser(req); err != nil {
+		return badRequest("Cannot parse JSON")
+	}
 
-	// err = deleteProduct(1)
+	token, err := login(h.users, req)
+	if err != nil {
+		return err
+	}
 
-	// product, err := getProducts()
+	return c.JSON(token)
+}
 
-	// err = addProductAndSupplier("CPF", "Potato Chips", 25)
+func (h *authHandler) refreshHandler(c *fiber.Ctx) error {
+	req := new(RefreshRequest)
 
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
+	if err := c.BodyParser(req); err != nil || req.RefreshToken == "" {
+		return badRequest("Refresh token is required")
+	}
 
-	// fmt.Println("Create Successful !")
+	token, err := refreshTokens(h.users, req.RefreshToken)
+	if err != nil {
+		return err
+	}
 
-	// fmt.Println("Create Successful !", product)
+	return c.JSON(token)
 }
 
-func loginHandler(c *fiber.Ctx) error {
-	req := new(Login)
+func (h *authHandler) logoutHandler(c *fiber.Ctx) error {
+	claims := tokenClaims(c)
+	jti, _ := claims["jti"].(string)
+	family, _ := claims["fam"].(string)
+	exp, _ := claims["exp"].(float64)
 
-	if err := c.BodyParser(req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Cannot parse JSON",
-		})
+	if err := h.users.RevokeSession(family, jti, time.Unix(int64(exp), 0)); err != nil {
+		return err
 	}
 
-	token, err := login(req)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (h *authHandler) revokeUserSessionsHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Invalid email or password",
-		})
+		return badRequest("Invalid user ID")
 	}
 
-	return c.JSON(fiber.Map{
-		"token": token,
-	})
+	if err := h.users.RevokeUserSessions(id); err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (h *authHandler) registerHandler(c *fiber.Ctx) error {
+	user := new(User)
+
+	if err := c.BodyParser(user); err != nil {
+		return badRequest("Cannot parse JSON")
+	}
+
+	if err := validateRegistration(user); err != nil {
+		return err
+	}
+
+	// Self registration always creates a customer, other roles are granted by an admin
+	user.Role = roleCustomer
+
+	u, err := createUser(h.users, user)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(u)
 }
 
-func getUsersHandler(c *fiber.Ctx) error {
-	users, err := getUsers()
+func (h *authHandler) getUsersHandler(c *fiber.Ctx) error {
+	users, err := h.users.List()
 
 	if err != nil {
-		return c.SendStatus(fiber.StatusBadRequest)
+		return err
 	}
 
 	return c.JSON(users)
 }
 
-func getProductByIdHandle(c *fiber.Ctx) error {
+func (h *productHandler) getProductByIdHandle(c *fiber.Ctx) error {
 	// Convert the "id" parameter from the request to an integer
 	id, err := strconv.Atoi(c.Params("id"))
 
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid product ID")
+		return badRequest("Invalid product ID")
+	}
+
+	includeDeleted, err := includeDeletedParam(c)
+	if err != nil {
+		return err
 	}
 
-	// Call the getProductById function to retrieve the product
-	product, err := getProductById(id)
+	product, err := h.products.Get(id, includeDeleted)
 
 	if err != nil {
-		// Check if the error is due to no rows being found
-		if err.Error() == fmt.Sprintf("no product found with id %d", id) {
-			return c.Status(fiber.StatusNotFound).SendString(err.Error())
-		}
-		// Handle other possible errors
-		return c.Status(fiber.StatusInternalServerError).SendString("An error occurred while retrieving the product")
+		return err
 	}
 
 	// If the product is found, return it as a JSON response
+	c.Set(fiber.HeaderETag, productETag(product))
 	return c.JSON(product)
 }
 
-func createProductHandler(c *fiber.Ctx) error {
+func (h *productHandler) createProductHandler(c *fiber.Ctx) error {
 	product := new(Product)
 
 	if err := c.BodyParser(product); err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		return badRequest(err.Error())
+	}
+
+	if err := validateProduct(h.lookups, product); err != nil {
+		return err
 	}
 
-	err := createProduct(product)
+	err := h.products.Create(product)
 
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		return err
 	}
 
 	return c.SendString("Create Product Successfully.")
 }
 
-func createOwnerHandler(c *fiber.Ctx) error {
-	owner := new(Owner)
+func (h *ownerHandler) createOwnerHandler(c *fiber.Ctx) error {
+	owner := &Owner{Commission: defaultCommission}
 
 	if err := c.BodyParser(owner); err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		return badRequest(err.Error())
 	}
 
-	err := createOwner(owner)
+	if err := validateOwner(owner); err != nil {
+		return err
+	}
+	if err := validateOwnerUser(h.users, owner); err != nil {
+		return err
+	}
+
+	err := h.owners.Create(owner)
 
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		return err
 	}
 
 	return c.SendString("Create New Owner Successfully.")
 }
 
-func createUserHandler(c *fiber.Ctx) error {
+func (h *authHandler) createUserHandler(c *fiber.Ctx) error {
+	user := new(User)
+
+	if err := c.BodyParser(user); err != nil {
+		return badRequest(err.Error())
+	}
+
+	if err := validateUser(user, true); err != nil {
+		return err
+	}
+
+	u, err := createUser(h.users, user)
+
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(u)
+}
+
+func (h *authHandler) getUserHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid user ID")
+	}
+
+	u, err := h.users.Get(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(u)
+}
+
+// updateUserHandler replaces every field of a user, leaving out the password
+// keeps the current one.
+func (h *authHandler) updateUserHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid user ID")
+	}
+
+	user := new(User)
+
+	if err := c.BodyParser(user); err != nil {
+		return badRequest(err.Error())
+	}
+
+	if err := validateUser(user, false); err != nil {
+		return err
+	}
+
+	u, err := updateUser(h.users, id, user)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(u)
+}
+
+func (h *authHandler) deleteUserHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid user ID")
+	}
+
+	if err := h.users.Delete(id); err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (h *authHandler) getMeHandler(c *fiber.Ctx) error {
+	id, ok := tokenUserID(c)
+	if !ok {
+		return unauthorized("missing or invalid token")
+	}
+
+	u, err := h.users.Get(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(u)
+}
+
+// updateMeHandler lets a user edit their own profile, the role stays whatever
+// an admin set it to.
+func (h *authHandler) updateMeHandler(c *fiber.Ctx) error {
+	id, ok := tokenUserID(c)
+	if !ok {
+		return unauthorized("missing or invalid token")
+	}
+
+	current, err := h.users.Get(id)
+	if err != nil {
+		return err
+	}
+
 	user := new(User)
 
 	if err := c.BodyParser(user); err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		return badRequest(err.Error())
 	}
 
-	err := createUser(user)
+	user.Role = current.Role
+
+	if err := validateUser(user, false); err != nil {
+		return err
+	}
 
+	u, err := updateUser(h.users, id, user)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		return err
 	}
 
-	return c.SendString("Create User Successfully.")
+	return c.JSON(u)
 }
 
-func deleteProductHandler(c *fiber.Ctx) error {
+func (h *productHandler) deleteProductHandler(c *fiber.Ctx) error {
 	// Parse the uid parameter
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid Product ID")
+		return badRequest("Invalid Product ID")
 	}
 
-	// Attempt to delete the day off
-	err = deleteProduct(id)
+	err = h.products.Delete(id)
 	if err != nil {
-		if err.Error() == "no record found to delete" {
-			return c.Status(fiber.StatusNotFound).SendString("No matching record found")
-		}
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to delete product")
+		return err
 	}
 
 	return c.SendString("Product deleted successfully.")
 }
 
-func updateProductHandle(c *fiber.Ctx) error {
+// includeDeletedParam reads ?includeDeleted=true, which only admins may use
+func includeDeletedParam(c *fiber.Ctx) (bool, error) {
+	if !c.QueryBool("includeDeleted") {
+		return false, nil
+	}
+
+	if !hasRole(c, roleAdmin) {
+		return false, forbidden("only admins can list deleted products")
+	}
+
+	return true, nil
+}
+
+func (h *productHandler) restoreProductHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid Product ID")
+	}
+
+	product, err := h.products.Restore(id)
+	if err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderETag, productETag(product))
+	return c.JSON(product)
+}
+
+func (h *productHandler) updateProductHandle(c *fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.SendStatus(fiber.StatusBadRequest)
+		return badRequest("Invalid product ID")
+	}
+
+	expectedVersion, err := requireIfMatch(c)
+	if err != nil {
+		return err
 	}
 
 	product := new(Product)
 
 	if err := c.BodyParser(product); err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		return badRequest(err.Error())
+	}
+
+	if err := validateProduct(h.lookups, product); err != nil {
+		return err
 	}
 
-	updateProduct, err := updateProduct(id, product)
+	updateProduct, err := h.products.Update(id, product, expectedVersion)
 
 	if err != nil {
-		return c.SendStatus(fiber.StatusBadRequest)
+		return err
 	}
 
+	c.Set(fiber.HeaderETag, productETag(updateProduct))
 	return c.JSON(updateProduct)
 }
 
-func updateOwnerHandler(c *fiber.Ctx) error {
+// transitionProductHandler moves a product to another lifecycle status, the
+// body is {"status": "sold", "note": "..."}.
+func (h *productHandler) transitionProductHandler(c *fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid ID")
+		return badRequest("Invalid product ID")
 	}
 
-	var owner Owner
-	if err := c.BodyParser(&owner); err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+	expectedVersion, err := requireIfMatch(c)
+	if err != nil {
+		return err
+	}
+
+	var change StatusTransition
+	if err := c.BodyParser(&change); err != nil {
+		return badRequest("Invalid request body")
 	}
 
-	o, err := updateOwner(id, &owner)
+	userID, _ := tokenUserID(c)
+
+	product, err := h.products.Transition(id, change, userID, expectedVersion)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		return err
 	}
 
-	return c.JSON(o)
+	c.Set(fiber.HeaderETag, productETag(product))
+	return c.JSON(product)
 }
 
-func updateMultipleProductsHandle(c *fiber.Ctx) error {
-	var products []Product
-
-	if err := c.BodyParser(&products); err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+func (h *productHandler) getProductHistoryHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid product ID")
 	}
 
-	var updatedProducts []Product
+	history, err := h.products.History(id)
+	if err != nil {
+		return err
+	}
 
-	for _, product := range products {
-		if product.ID == 0 {
-			return c.Status(fiber.StatusBadRequest).SendString("Product ID is required for update")
-		}
+	return c.JSON(history)
+}
 
-		updated, err := updateProduct(product.ID, &product)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Failed to update product ID %d: %v", product.ID, err))
-		}
+func (h *imageHandler) getImagesHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid product ID")
+	}
 
-		updatedProducts = append(updatedProducts, updated)
+	images, err := h.images.List(id)
+	if err != nil {
+		return err
 	}
 
-	return c.JSON(updatedProducts)
+	return c.JSON(withImageURLs(h.files, images))
 }
 
-func getProductWithFilterHandler(c *fiber.Ctx) error {
-	// Get string filters directly (no need to convert)
-	status := c.Query("status")
-	prodType := c.Query("type")
-	name := c.Query("name")
+// uploadImagesHandler takes multipart/form-data with the files in the "image"
+// field. Every file is checked before anything is stored, so one bad file
+// rejects the whole upload.
+func (h *imageHandler) uploadImagesHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid product ID")
+	}
 
-	// Fetch "limit" and "offset" from query parameters
-	limit, err := strconv.Atoi(c.Query("limit", "15")) // Default to 15 if not provided
+	form, err := c.MultipartForm()
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid Limit")
+		return badRequest("Body must be multipart/form-data with the files in the image field")
+	}
+	files := form.File["image"]
+
+	v := &ValidationError{}
+	switch {
+	case len(files) == 0:
+		v.add("image", "is required")
+	case len(files) > maxImagesPerUpload:
+		v.add("image", fmt.Sprintf("at most %d files per upload", maxImagesPerUpload))
+	}
+	if err := v.err(); err != nil {
+		return err
 	}
 
-	offset, err := strconv.Atoi(c.Query("offset", "0")) // Default to 0 if not provided
+	existing, err := h.images.List(id)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid Offset")
+		return err
+	}
+	if len(existing)+len(files) > maxImagesPerProduct {
+		v.add("image", fmt.Sprintf("a product can have at most %d images", maxImagesPerProduct))
+		return v
 	}
 
-	// Fetch products with the parsed limit and offset
-	products, total, err := getProductWithFilter(limit, offset, status, prodType, name)
+	uploads := make([]imageUpload, 0, len(files))
+	for i, fh := range files {
+		data, err := readFormFile(fh)
+		if err != nil {
+			return err
+		}
+
+		img, contentType, problem := decodeImage(data)
+		if problem != "" {
+			v.add(fmt.Sprintf("image[%d]", i), problem)
+			continue
+		}
+
+		upload, err := prepareImageUpload(id, data, img, contentType)
+		if err != nil {
+			return err
+		}
+		uploads = append(uploads, upload)
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	ctx := c.UserContext()
+	records := make([]ProductImage, 0, len(uploads))
+	var stored []string
+
+	for _, upload := range uploads {
+		for key, data := range upload.files {
+			if err := h.files.Put(ctx, key, data, upload.image.ContentType); err != nil {
+				h.deleteFiles(ctx, stored...)
+				return err
+			}
+			stored = append(stored, key)
+		}
+		records = append(records, upload.image)
+	}
+
+	added, err := h.images.Add(id, records)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get products")
+		h.deleteFiles(ctx, stored...)
+		return err
 	}
 
-	// Return paginated response with total count
-	return c.JSON(fiber.Map{
-		"products": products,
-		"total":    total,
-	})
+	return c.Status(fiber.StatusCreated).JSON(withImageURLs(h.files, added))
 }
 
-func getProductsHandler(c *fiber.Ctx) error {
-	// Fetch "limit" and "offset" from query parameters
-	limit, err := strconv.Atoi(c.Query("limit", "15")) // Default to 15 if not provided
+// readFormFile reads at most one byte more than an image may have, enough
+// for decodeImage to reject it
+func readFormFile(fh *multipart.FileHeader) ([]byte, error) {
+	f, err := fh.Open()
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid Limit")
+		return nil, err
 	}
+	defer f.Close()
 
-	offset, err := strconv.Atoi(c.Query("offset", "0")) // Default to 0 if not provided
+	return io.ReadAll(io.LimitReader(f, maxImageBytes+1))
+}
+
+// deleteFiles is best effort, a file left behind only costs storage
+func (h *imageHandler) deleteFiles(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		if err := h.files.Delete(ctx, key); err != nil {
+			log.Printf("delete file %s: %v", key, err)
+		}
+	}
+}
+
+// reorderImagesHandler takes {"order": [ids...]} listing every image of the
+// product in the new order
+func (h *imageHandler) reorderImagesHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid Offset")
+		return badRequest("Invalid product ID")
 	}
 
-	// Fetch products with the parsed limit and offset
-	products, total, err := getProducts(limit, offset)
+	var body ImageOrder
+	if err := c.BodyParser(&body); err != nil {
+		return badRequest("Invalid request body")
+	}
+
+	images, err := h.images.Reorder(id, body.Order)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get products")
+		return err
 	}
 
-	// Return paginated response with total count
-	return c.JSON(fiber.Map{
-		"products": products,
-		"total":    total,
-	})
+	return c.JSON(withImageURLs(h.files, images))
 }
 
-func getOwnersHandler(c *fiber.Ctx) error {
-	owners, err := getOwners()
+func (h *imageHandler) deleteImageHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid product ID")
+	}
 
+	imageID, err := strconv.Atoi(c.Params("imageid"))
 	if err != nil {
-		return c.SendStatus(fiber.StatusBadRequest)
+		return badRequest("Invalid image ID")
 	}
 
-	return c.JSON(owners)
-}
+	image, err := h.images.Delete(id, imageID)
+	if err != nil {
+		return err
+	}
+
+	h.deleteFiles(c.UserContext(), image.Key, image.WebKey, image.ThumbKey)
 
-func getTypesHandler(c *fiber.Ctx) error {
-	types, err := getTypes()
+	return c.SendStatus(fiber.StatusNoContent)
+}
 
+// patchProductHandler applies a JSON merge patch (RFC 7386), only the fields
+// present in the body are changed.
+func (h *productHandler) patchProductHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		return c.SendStatus(fiber.StatusBadRequest)
+		return badRequest("Invalid product ID")
 	}
 
-	return c.JSON(types)
-}
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(c.Body(), &patch); err != nil || patch == nil {
+		return badRequest("Body must be a JSON object")
+	}
 
-func getStatusHandler(c *fiber.Ctx) error {
-	types, err := getStatus()
+	expectedVersion, err := requireIfMatch(c)
+	if err != nil {
+		return err
+	}
 
+	values, err := decodeProductPatch(patch)
 	if err != nil {
-		return c.SendStatus(fiber.StatusBadRequest)
+		return err
 	}
 
-	return c.JSON(types)
+	product, err := h.products.Patch(id, values, expectedVersion)
+	if err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderETag, productETag(product))
+	return c.JSON(product)
 }
 
-// func getDayOffsHandler(c *fiber.Ctx) error {
-// 	uid, err := strconv.Atoi(c.Params("uid"))
+func (h *ownerHandler) updateOwnerHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid ID")
+	}
 
-// 	if err != nil {
-// 		return c.SendStatus(fiber.StatusBadRequest)
-// 	}
+	// Fields left out of the body keep their current value
+	owner, err := h.owners.Get(id)
+	if err != nil {
+		return err
+	}
+	if err := c.BodyParser(&owner); err != nil {
+		return badRequest("Invalid request body")
+	}
 
-// 	dayOffs, err := getDayOffs(uid)
+	if err := validateOwner(&owner); err != nil {
+		return err
+	}
+	if err := validateOwnerUser(h.users, &owner); err != nil {
+		return err
+	}
 
-// 	if err != nil {
-// 		return c.SendStatus(fiber.StatusBadRequest)
-// 	}
+	o, err := h.owners.Update(id, &owner)
+	if err != nil {
+		return err
+	}
 
-// 	return c.JSON(dayOffs)
-// }
+	return c.JSON(o)
+}
+
+// updateMultipleProductsHandle updates a batch of products in one transaction.
+// ?mode=atomic (default) commits only when every item succeeds,
+// ?mode=best-effort commits whatever succeeded. Both report the result per item.
+func (h *productHandler) updateMultipleProductsHandle(c *fiber.Ctx) error {
+	var products []Product
+
+	if err := c.BodyParser(&products); err != nil {
+		return badRequest(err.Error())
+	}
+
+	mode := c.Query("mode", bulkModeAtomic)
+	if mode != bulkModeAtomic && mode != bulkModeBestEffort {
+		return badRequest("Invalid mode, use atomic or best-effort")
+	}
+
+	if len(products) == 0 {
+		return badRequest("No products to update")
+	}
+
+	results, committed, err := h.products.UpdateMany(products, mode)
+	if err != nil {
+		return err
+	}
+
+	status := fiber.StatusOK
+	if !committed {
+		status = fiber.StatusUnprocessableEntity
+	}
+
+	return c.Status(status).JSON(BulkUpdateResponse{
+		Mode:      mode,
+		Committed: committed,
+		Results:   results,
+	})
+}
+
+// maxPageLimit caps how many rows one page returns, a larger limit gets this
+const maxPageLimit = 100
+
+// pageParams reads "limit" and "offset" from the query string
+func pageParams(c *fiber.Ctx) (int, int, error) {
+	limit, err := strconv.Atoi(c.Query("limit", "15")) // Default to 15 if not provided
+	if err != nil {
+		return 0, 0, badRequest("Invalid Limit")
+	}
+
+	offset, err := strconv.Atoi(c.Query("offset", "0")) // Default to 0 if not provided
+	if err != nil {
+		return 0, 0, badRequest("Invalid Offset")
+	}
+
+	v := &ValidationError{}
+	if limit < 1 {
+		v.add("limit", "must be at least 1")
+	}
+	if offset < 0 {
+		v.add("offset", "can't be negative")
+	}
+	if err := v.err(); err != nil {
+		return 0, 0, err
+	}
+
+	return min(limit, maxPageLimit), offset, nil
+}
+
+func (h *productHandler) getProductWithFilterHandler(c *fiber.Ctx) error {
+	filter, err := parseProductFilter(c)
+	if err != nil {
+		return err
+	}
+
+	filter.IncludeDeleted, err = includeDeletedParam(c)
+	if err != nil {
+		return err
+	}
+
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		return err
+	}
+
+	// Fetch products with the parsed limit and offset
+	products, total, err := h.products.ListFiltered(filter, limit, offset)
+	if err != nil {
+		return err
+	}
+
+	// Return paginated response with total count
+	return c.JSON(fiber.Map{
+		"products": products,
+		"total":    total,
+	})
+}
+
+// searchProductsHandler searches name, description, defect, type and owner
+// name, e.g. /product/search?q=denim+jacket&limit=20
+func (h *productHandler) searchProductsHandler(c *fiber.Ctx) error {
+	query := c.Query("q")
+	if err := validateSearchQuery(query); err != nil {
+		return err
+	}
+
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		return err
+	}
+
+	results, total, mode, err := h.products.Search(query, limit, offset)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(ProductSearchResponse{Total: total, Mode: mode, Results: results})
+}
+
+func (h *productHandler) getProductsHandler(c *fiber.Ctx) error {
+	includeDeleted, err := includeDeletedParam(c)
+	if err != nil {
+		return err
+	}
+
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		return err
+	}
+
+	// Fetch products with the parsed limit and offset
+	products, total, err := h.products.List(limit, offset, includeDeleted)
+	if err != nil {
+		return err
+	}
+
+	// Return paginated response with total count
+	return c.JSON(fiber.Map{
+		"products": products,
+		"total":    total,
+	})
+}
+
+func (h *ownerHandler) getOwnersHandler(c *fiber.Ctx) error {
+	owners, err := h.owners.List()
+
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(owners)
+}
+
+func (h *ownerHandler) getOwnerBalanceHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid owner ID")
+	}
+
+	balance, err := h.ledger.Balance(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(balance)
+}
+
+func (h *ownerHandler) getOwnerStatementsHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid owner ID")
+	}
+
+	statements, err := h.ledger.Statements(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(statements)
+}
+
+func (h *payoutHandler) createPayoutBatchHandler(c *fiber.Ctx) error {
+	var req PayoutRequest
+	if err := c.BodyParser(&req); err != nil {
+		return badRequest("Invalid request body")
+	}
+
+	userID, _ := tokenUserID(c)
+
+	batch, err := h.ledger.CreatePayoutBatch(req, userID)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(batch)
+}
+
+func (h *payoutHandler) getPayoutBatchHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid payout batch ID")
+	}
+
+	batch, err := h.ledger.GetPayoutBatch(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(batch)
+}
+
+func (h *consignorHandler) getMyOwnerHandler(c *fiber.Ctx) error {
+	return c.JSON(accountOwner(c))
+}
+
+// getMyProductsHandler takes the filters of GET /product/filter, but always
+// only the consignor's own products that aren't deleted
+func (h *consignorHandler) getMyProductsHandler(c *fiber.Ctx) error {
+	filter, err := parseProductFilter(c)
+	if err != nil {
+		return err
+	}
+	filter.Owner = []int{accountOwner(c).ID}
+	filter.IncludeDeleted = false
+
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		return err
+	}
+
+	products, total, err := h.products.ListFiltered(filter, limit, offset)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"products": products,
+		"total":    total,
+	})
+}
+
+func (h *consignorHandler) getMyBalanceHandler(c *fiber.Ctx) error {
+	balance, err := h.ledger.Balance(accountOwner(c).ID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(balance)
+}
+
+func (h *consignorHandler) getMyStatementsHandler(c *fiber.Ctx) error {
+	statements, err := h.ledger.Statements(accountOwner(c).ID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(statements)
+}
+
+func (h *consignorHandler) getMyWithdrawalsHandler(c *fiber.Ctx) error {
+	requests, err := h.withdrawals.List(accountOwner(c).ID, "")
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(requests)
+}
+
+func (h *consignorHandler) createWithdrawalHandler(c *fiber.Ctx) error {
+	var req NewWithdrawal
+	if err := c.BodyParser(&req); err != nil {
+		return badRequest("Invalid request body")
+	}
+
+	userID, _ := tokenUserID(c)
+
+	w, err := h.withdrawals.Create(accountOwner(c).ID, req, userID)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(w)
+}
+
+func (h *withdrawalHandler) getWithdrawalsHandler(c *fiber.Ctx) error {
+	status := c.Query("status")
+
+	v := &ValidationError{}
+	checkWithdrawalStatus(v, status)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	requests, err := h.withdrawals.List(0, status)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(requests)
+}
+
+func (h *withdrawalHandler) approveWithdrawalHandler(c *fiber.Ctx) error {
+	return h.decide(c, true)
+}
+
+func (h *withdrawalHandler) rejectWithdrawalHandler(c *fiber.Ctx) error {
+	return h.decide(c, false)
+}
+
+func (h *withdrawalHandler) decide(c *fiber.Ctx, approve bool) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid withdrawal request ID")
+	}
+
+	var decision WithdrawalDecision
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&decision); err != nil {
+			return badRequest("Invalid request body")
+		}
+	}
+
+	userID, _ := tokenUserID(c)
+
+	w, err := h.withdrawals.Decide(id, approve, decision, userID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(w)
+}
+
+func (h *orderHandler) checkoutHandler(c *fiber.Ctx) error {
+	var checkout Checkout
+	if err := c.BodyParser(&checkout); err != nil {
+		return badRequest("Invalid request body")
+	}
+
+	if err := validateCheckout(&checkout); err != nil {
+		return err
+	}
+
+	userID, _ := tokenUserID(c)
+
+	order, err := h.orders.Checkout(userID, checkout)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(order)
+}
+
+// orderFilterParams reads the status filter every order list takes
+func orderFilterParams(c *fiber.Ctx) (OrderFilter, error) {
+	filter := OrderFilter{Status: c.Query("status")}
+
+	v := &ValidationError{}
+	checkOrderStatus(v, filter.Status)
+
+	return filter, v.err()
+}
+
+func (h *orderHandler) listOrders(c *fiber.Ctx, filter OrderFilter) error {
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		return err
+	}
+
+	orders, total, err := h.orders.List(filter, limit, offset)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"orders": orders,
+		"total":  total,
+	})
+}
+
+func (h *orderHandler) getMyOrdersHandler(c *fiber.Ctx) error {
+	filter, err := orderFilterParams(c)
+	if err != nil {
+		return err
+	}
+
+	filter.UserID, _ = tokenUserID(c)
+	return h.listOrders(c, filter)
+}
+
+// myOrder returns the order in the path when it belongs to the signed in
+// user. Other users' orders are reported missing, not forbidden, so their ids
+// can't be probed.
+func (h *orderHandler) myOrder(c *fiber.Ctx) (Order, error) {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return Order{}, badRequest("Invalid order ID")
+	}
+
+	order, err := h.orders.Get(id)
+	if err != nil {
+		return Order{}, err
+	}
+
+	userID, ok := tokenUserID(c)
+	if !ok || order.UserID != userID {
+		return Order{}, notFoundf("no order found with id %d", id)
+	}
+
+	return order, nil
+}
+
+func (h *orderHandler) getMyOrderHandler(c *fiber.Ctx) error {
+	order, err := h.myOrder(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(order)
+}
+
+// cancelMyOrderHandler lets customers cancel an order until it is paid,
+// after that only staff can
+func (h *orderHandler) cancelMyOrderHandler(c *fiber.Ctx) error {
+	order, err := h.myOrder(c)
+	if err != nil {
+		return err
+	}
+	if order.Status != orderPending {
+		return conflictf("order %d is %s, ask the shop to cancel it", order.ID, order.Status)
+	}
+
+	userID, _ := tokenUserID(c)
+
+	cancelled, err := h.orders.Transition(order.ID, OrderTransition{Status: orderCancelled, Note: "cancelled by the customer"}, userID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(cancelled)
+}
+
+// promptPayQR is what the customer scans to pay order o
+func (h *orderHandler) promptPayQR(o Order) (PromptPayQR, error) {
+	if cfg.PromptPay.ID == "" {
+		return PromptPayQR{}, errPromptPayOff
+	}
+	if o.Status != orderPending {
+		return PromptPayQR{}, conflictf("order %d is %s, there is nothing to pay", o.ID, o.Status)
+	}
+
+	payload, err := promptPayPayload(cfg.PromptPay.ID, o.Total)
+	if err != nil {
+		return PromptPayQR{}, err
+	}
+
+	return PromptPayQR{OrderID: o.ID, Amount: o.Total, Payload: payload}, nil
+}
+
+func (h *orderHandler) getMyPromptPayHandler(c *fiber.Ctx) error {
+	order, err := h.myOrder(c)
+	if err != nil {
+		return err
+	}
+
+	qr, err := h.promptPayQR(order)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(qr)
+}
+
+func (h *orderHandler) getMyPromptPayPNGHandler(c *fiber.Ctx) error {
+	order, err := h.myOrder(c)
+	if err != nil {
+		return err
+	}
+
+	qr, err := h.promptPayQR(order)
+	if err != nil {
+		return err
+	}
+
+	png, err := qrcode.Encode(qr.Payload, qrcode.Medium, 512)
+	if err != nil {
+		return err
+	}
+
+	c.Type("png")
+	return c.Send(png)
+}
+
+// confirmPaymentHandler is for staff matching a transfer slip to an order
+func (h *orderHandler) confirmPaymentHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid order ID")
+	}
+
+	var payment PaymentConfirmation
+	if err := c.BodyParser(&payment); err != nil {
+		return badRequest("Invalid request body")
+	}
+	payment.OrderID = id
+	payment.Source = paymentSourceStaff
+
+	if err := validatePaymentConfirmation(&payment); err != nil {
+		return err
+	}
+
+	userID, _ := tokenUserID(c)
+
+	order, err := h.orders.ConfirmPayment(id, payment, userID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(order)
+}
+
+// promptPayWebhookHandler is called by the payment provider, the body is
+// only trusted once the webhook has verified it
+func (h *orderHandler) promptPayWebhookHandler(c *fiber.Ctx) error {
+	payment, err := h.webhook.Verify(c.Get(webhookSignatureHeader), c.Body())
+	if err != nil {
+		return err
+	}
+
+	if err := validatePaymentConfirmation(&payment); err != nil {
+		return err
+	}
+
+	order, err := h.orders.ConfirmPayment(payment.OrderID, payment, 0)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(order)
+}
+
+func (h *orderHandler) getOrdersHandler(c *fiber.Ctx) error {
+	filter, err := orderFilterParams(c)
+	if err != nil {
+		return err
+	}
+
+	if raw := c.Query("userid"); raw != "" {
+		filter.UserID, err = strconv.Atoi(raw)
+		if err != nil {
+			return badRequest("Invalid user ID")
+		}
+	}
+
+	return h.listOrders(c, filter)
+}
+
+func (h *orderHandler) getOrderHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid order ID")
+	}
+
+	order, err := h.orders.Get(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(order)
+}
+
+func (h *orderHandler) transitionOrderHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid order ID")
+	}
+
+	var change OrderTransition
+	if err := c.BodyParser(&change); err != nil {
+		return badRequest("Invalid request body")
+	}
+
+	userID, _ := tokenUserID(c)
+
+	order, err := h.orders.Transition(id, change, userID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(order)
+}
+
+func (h *cartHandler) getMyCartHandler(c *fiber.Ctx) error {
+	userID, _ := tokenUserID(c)
+
+	cart, err := h.carts.Get(userID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(cart)
+}
+
+// addToCartHandler holds the product for cfg.CartHoldTTL
+func (h *cartHandler) addToCartHandler(c *fiber.Ctx) error {
+	var req AddToCart
+	if err := c.BodyParser(&req); err != nil {
+		return badRequest("Invalid request body")
+	}
+
+	userID, _ := tokenUserID(c)
+
+	cart, err := h.carts.Add(userID, req.ProductID, cfg.CartHoldTTL)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(cart)
+}
+
+func (h *cartHandler) removeFromCartHandler(c *fiber.Ctx) error {
+	productID, err := strconv.Atoi(c.Params("productid"))
+	if err != nil {
+		return badRequest("Invalid product ID")
+	}
+
+	userID, _ := tokenUserID(c)
+
+	cart, err := h.carts.Remove(userID, productID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(cart)
+}
+
+// checkoutCartHandler orders everything in the cart. Checkout ends the holds
+// as it reserves the products.
+func (h *cartHandler) checkoutCartHandler(c *fiber.Ctx) error {
+	var req CartCheckout
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return badRequest("Invalid request body")
+		}
+	}
+
+	userID, _ := tokenUserID(c)
+
+	cart, err := h.carts.Get(userID)
+	if err != nil {
+		return err
+	}
+	if len(cart.Items) == 0 {
+		return conflictf("your cart is empty")
+	}
+
+	order, err := h.orders.Checkout(userID, Checkout{ProductIDs: cartProductIDs(cart), Note: req.Note})
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(order)
+}
+
+func (h *lookupHandler) getTypesHandler(c *fiber.Ctx) error {
+	types, err := h.lookups.ListTypes()
+
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(types)
+}
+
+func (h *lookupHandler) getTypeHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid type ID")
+	}
+
+	t, err := h.lookups.GetType(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(t)
+}
+
+func (h *lookupHandler) createTypeHandler(c *fiber.Ctx) error {
+	var body Type
+	if err := c.BodyParser(&body); err != nil {
+		return badRequest("Invalid request body")
+	}
+
+	if err := validateLookupName(body.Name); err != nil {
+		return err
+	}
+
+	t, err := h.lookups.CreateType(body.Name)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(t)
+}
+
+func (h *lookupHandler) updateTypeHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid type ID")
+	}
+
+	var body Type
+	if err := c.BodyParser(&body); err != nil {
+		return badRequest("Invalid request body")
+	}
+
+	if err := validateLookupName(body.Name); err != nil {
+		return err
+	}
+
+	t, err := h.lookups.UpdateType(id, body.Name)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(t)
+}
+
+// deleteTypeHandler answers 409 while products still use the type
+func (h *lookupHandler) deleteTypeHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid type ID")
+	}
+
+	if err := h.lookups.DeleteType(id); err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (h *lookupHandler) getStatusHandler(c *fiber.Ctx) error {
+	types, err := h.lookups.ListStatuses()
+
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(types)
+}
+
+func (h *lookupHandler) getStatusByIdHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid status ID")
+	}
+
+	s, err := h.lookups.GetStatus(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(s)
+}
+
+func (h *lookupHandler) createStatusHandler(c *fiber.Ctx) error {
+	var body Status
+	if err := c.BodyParser(&body); err != nil {
+		return badRequest("Invalid request body")
+	}
+
+	if err := validateLookupName(body.Name); err != nil {
+		return err
+	}
+
+	s, err := h.lookups.CreateStatus(body.Name)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(s)
+}
+
+func (h *lookupHandler) updateStatusHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid status ID")
+	}
+
+	var body Status
+	if err := c.BodyParser(&body); err != nil {
+		return badRequest("Invalid request body")
+	}
+
+	if err := validateLookupName(body.Name); err != nil {
+		return err
+	}
+
+	s, err := h.lookups.UpdateStatus(id, body.Name)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(s)
+}
+
+// deleteStatusHandler answers 409 while products still use the status
+func (h *lookupHandler) deleteStatusHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return badRequest("Invalid status ID")
+	}
+
+	if err := h.lookups.DeleteStatus(id); err != nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,1744 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps everything in maps behind one mutex. It mirrors the
+// Postgres repositories closely enough to run the handlers in tests without a
+// database, it is not meant for serving.
+type memoryStore struct {
+	mu sync.Mutex
+
+	products map[int]Product
+	owners   map[int]Owner
+	types    []Type
+	statuses []Status
+	history  []StatusChange
+	images   map[int]ProductImage
+	ledger   []LedgerEntry
+	payouts  []Payout
+	batches  []PayoutBatch
+
+	withdrawals []WithdrawalRequest
+	orders      map[int]Order
+	payments    []OrderPayment
+	holds       map[int]memHold
+
+	// users keeps the password hash, it is stripped on the way out
+	users         map[int]User
+	refreshTokens []memRefreshToken
+	revoked       map[string]time.Time
+
+	nextID int
+}
+
+// memHold is a cart hold keyed by its product, like the cart_hold table
+type memHold struct {
+	UserID    int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (h memHold) active() bool {
+	return time.Now().Before(h.ExpiresAt)
+}
+
+type memRefreshToken struct {
+	RefreshToken
+	used    bool
+	revoked bool
+}
+
+type memProductRepo struct{ m *memoryStore }
+type memOwnerRepo struct{ m *memoryStore }
+type memUserRepo struct{ m *memoryStore }
+type memLookupRepo struct{ m *memoryStore }
+type memImageRepo struct{ m *memoryStore }
+type memLedgerRepo struct{ m *memoryStore }
+type memWithdrawalRepo struct{ m *memoryStore }
+type memOrderRepo struct{ m *memoryStore }
+type memCartRepo struct{ m *memoryStore }
+
+// memRefs checks product references while the caller already holds the lock
+type memRefs struct{ m *memoryStore }
+
+// newMemoryStore starts with the lifecycle statuses, like a migrated database
+func newMemoryStore() *memoryStore {
+	m := &memoryStore{
+		products: map[int]Product{},
+		owners:   map[int]Owner{},
+		users:    map[int]User{},
+		revoked:  map[string]time.Time{},
+		images:   map[int]ProductImage{},
+		orders:   map[int]Order{},
+		holds:    map[int]memHold{},
+	}
+	for _, name := range lifecycleStatuses {
+		m.statuses = append(m.statuses, Status{ID: m.id(), Name: name})
+	}
+	return m
+}
+
+func (m *memoryStore) Store() Store {
+	return Store{
+		Products:    &memProductRepo{m},
+		Owners:      &memOwnerRepo{m},
+		Users:       &memUserRepo{m},
+		Lookups:     &memLookupRepo{m},
+		Images:      &memImageRepo{m},
+		Ledger:      &memLedgerRepo{m},
+		Withdrawals: &memWithdrawalRepo{m},
+		Orders:      &memOrderRepo{m},
+		Carts:       &memCartRepo{m},
+	}
+}
+
+// id hands out ids from one sequence for every table, so a test can't pass by
+// mixing up an owner id with a product id
+func (m *memoryStore) id() int {
+	m.nextID++
+	return m.nextID
+}
+
+func (m *memoryStore) addType(name string) Type {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := Type{ID: m.id(), Name: name}
+	m.types = append(m.types, t)
+	return t
+}
+
+func memNow() string {
+	return time.Now().Format(time.RFC3339)
+}
+
+// withOwner fills in the joined owner, type and status names like the SQL
+// queries do
+func (m *memoryStore) withOwner(p Product) Product {
+	p.Owner_Name = m.owners[p.Owner].Name
+	p.Type = findMemLookup(m.types, p.TypeID, "").Name
+	p.Status = findMemLookup(m.statuses, p.StatusID, "").Name
+	p.Image = append([]string(nil), p.Image...)
+	p.Held = m.holder(p.ID) != 0
+	return p
+}
+
+// holder returns who holds a product now, 0 when nobody does
+func (m *memoryStore) holder(productID int) int {
+	if h, ok := m.holds[productID]; ok && h.active() {
+		return h.UserID
+	}
+	return 0
+}
+
+func (m *memoryStore) product(id int, includeDeleted bool) (Product, error) {
+	p, ok := m.products[id]
+	if !ok || (p.Delete_Date != nil && !includeDeleted) {
+		return Product{}, notFoundf("no product found with id %d", id)
+	}
+	return m.withOwner(p), nil
+}
+
+func (m *memoryStore) update(id int, product *Product, expectedVersion int) (Product, error) {
+	current, err := m.product(id, false)
+	if err != nil {
+		return Product{}, err
+	}
+	if expectedVersion != 0 && current.Version != expectedVersion {
+		return Product{}, errVersionMismatch
+	}
+	if err := checkStatusKept(&current, product); err != nil {
+		return Product{}, err
+	}
+
+	p := *product
+	p.ID = id
+	p.Image = append([]string(nil), product.Image...)
+	p.Create_Date = current.Create_Date
+	p.Update_Date = memNow()
+	p.Version = current.Version + 1
+	p.Delete_Date = nil
+	m.products[id] = p
+
+	return m.withOwner(p), nil
+}
+
+func (r *memProductRepo) List(limit, offset int, includeDeleted bool) ([]Product, int, error) {
+	return r.ListFiltered(ProductFilter{IncludeDeleted: includeDeleted}, limit, offset)
+}
+
+func (r *memProductRepo) ListFiltered(filter ProductFilter, limit, offset int) ([]Product, int, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	var matched []Product
+	distances := map[int]int{}
+	for _, stored := range r.m.products {
+		p := r.m.withOwner(stored)
+
+		if p.Delete_Date != nil && !filter.IncludeDeleted || !filter.matches(p) {
+			continue
+		}
+
+		if filter.Fit != nil {
+			ok, distance := filter.Fit.fits(p)
+			if !ok {
+				continue
+			}
+			distances[p.ID] = distance
+		}
+		matched = append(matched, p)
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		if cmp := filter.compare(matched[i], matched[j]); cmp != 0 {
+			return cmp < 0
+		}
+		di, dj := distances[matched[i].ID], distances[matched[j].ID]
+		if di != dj {
+			return di < dj
+		}
+		return matched[i].ID < matched[j].ID
+	})
+
+	return memPage(matched, limit, offset), len(matched), nil
+}
+
+// memPage cuts one page out of items like LIMIT and OFFSET, a negative limit
+// means no limit
+func memPage[T any](items []T, limit, offset int) []T {
+	total := len(items)
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit >= 0 && offset+limit < end {
+		end = offset + limit
+	}
+
+	return items[offset:end]
+}
+
+// Search imitates the Postgres search closely enough for the handlers. A full
+// text match needs every term to be a word of the product, ranked by the
+// weight of the fields it is in. Otherwise products that contain the query or
+// have a word close to every term match fuzzily.
+func (r *memProductRepo) Search(query string, limit, offset int) ([]ProductSearchResult, int, string, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	terms := searchTerms(query)
+	var fullText, fuzzy []ProductSearchResult
+
+	for _, stored := range r.m.products {
+		if stored.Delete_Date != nil {
+			continue
+		}
+		p := r.m.withOwner(stored)
+		result := ProductSearchResult{Product: p, Snippet: highlightSnippet(p.Name+" "+p.Description, terms)}
+
+		if result.Rank = memFullTextRank(p, terms); result.Rank > 0 {
+			fullText = append(fullText, result)
+		} else if result.Rank = memFuzzyRank(p, query, terms); result.Rank > 0 {
+			fuzzy = append(fuzzy, result)
+		}
+	}
+
+	results, mode := fullText, searchModeFullText
+	if len(fullText) == 0 {
+		results, mode = fuzzy, searchModeFuzzy
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].ID < results[j].ID
+	})
+
+	return memPage(results, limit, offset), len(results), mode, nil
+}
+
+type memSearchField struct {
+	text   string
+	weight float64
+}
+
+// memSearchFields are the searched fields, weighted in the order of the A to
+// D weights of the search_vector
+func memSearchFields(p Product) []memSearchField {
+	return []memSearchField{{p.Name, 1}, {p.Type, 0.4}, {p.Owner_Name, 0.4}, {p.Description, 0.2}, {p.Defect, 0.1}}
+}
+
+func memFullTextRank(p Product, terms []string) float64 {
+	if len(terms) == 0 {
+		return 0
+	}
+
+	rank := 0.0
+	for _, term := range terms {
+		found := false
+		for _, field := range memSearchFields(p) {
+			for _, word := range searchTerms(field.text) {
+				if word == term {
+					rank += field.weight
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return 0
+		}
+	}
+	return rank
+}
+
+// memFuzzyRank is the similarity of the worst matching term, 0 below the
+// threshold. A product containing the whole query ranks 1.
+func memFuzzyRank(p Product, query string, terms []string) float64 {
+	var words []string
+	var text strings.Builder
+	for _, field := range memSearchFields(p) {
+		words = append(words, searchTerms(field.text)...)
+		text.WriteString(strings.ToLower(field.text) + " ")
+	}
+
+	if strings.Contains(text.String(), strings.ToLower(strings.TrimSpace(query))) {
+		return 1
+	}
+	if len(terms) == 0 {
+		return 0
+	}
+
+	rank := 1.0
+	for _, term := range terms {
+		best := 0.0
+		for _, word := range words {
+			best = max(best, trigramSimilarity(term, word))
+		}
+		rank = min(rank, best)
+	}
+
+	if rank < fuzzySearchThreshold {
+		return 0
+	}
+	return rank
+}
+
+// trigramSimilarity works like pg_trgm's similarity for single words
+func trigramSimilarity(a, b string) float64 {
+	trigrams := func(word string) map[string]bool {
+		runes := []rune("  " + word + " ")
+		set := map[string]bool{}
+		for i := 0; i+3 <= len(runes); i++ {
+			set[string(runes[i:i+3])] = true
+		}
+		return set
+	}
+
+	ta, tb := trigrams(a), trigrams(b)
+	shared := 0
+	for t := range ta {
+		if tb[t] {
+			shared++
+		}
+	}
+
+	union := len(ta) + len(tb) - shared
+	if union == 0 {
+		return 0
+	}
+	return float64(shared) / float64(union)
+}
+
+func (r *memProductRepo) Get(id int, includeDeleted bool) (Product, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	return r.m.product(id, includeDeleted)
+}
+
+func (r *memProductRepo) Create(product *Product) error {
+	if err := checkNewProductStatus(product); err != nil {
+		return err
+	}
+
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	p := *product
+	p.ID = r.m.id()
+	p.Image = append([]string(nil), product.Image...)
+	p.Create_Date = memNow()
+	p.Update_Date = p.Create_Date
+	p.Version = 1
+	p.Delete_Date = nil
+	r.m.products[p.ID] = p
+
+	return nil
+}
+
+func (r *memProductRepo) Update(id int, product *Product, expectedVersion int) (Product, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	return r.m.update(id, product, expectedVersion)
+}
+
+func (r *memProductRepo) Patch(id int, values []columnValue, expectedVersion int) (Product, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	current, err := r.m.product(id, false)
+	if err != nil {
+		return Product{}, err
+	}
+	if expectedVersion != 0 && current.Version != expectedVersion {
+		return Product{}, errVersionMismatch
+	}
+	if len(values) == 0 {
+		return current, nil
+	}
+
+	merged := applyProductPatch(current, values)
+	if err := validateProductPatch(memRefs{r.m}, &merged, values); err != nil {
+		return Product{}, err
+	}
+
+	return r.m.update(id, &merged, 0)
+}
+
+func (r *memProductRepo) UpdateMany(products []Product, mode string) ([]BulkUpdateResult, bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	snapshot := make(map[int]Product, len(r.m.products))
+	for id, p := range r.m.products {
+		snapshot[id] = p
+	}
+
+	results := make([]BulkUpdateResult, 0, len(products))
+	seen := map[int]bool{}
+	failed := false
+
+	for i := range products {
+		product := products[i]
+		result := BulkUpdateResult{ID: product.ID}
+
+		if msg := checkBulkProduct(&product, seen); msg != "" {
+			result.Status = bulkStatusInvalid
+			result.Error = msg
+			results = append(results, result)
+			failed = true
+			continue
+		}
+		seen[product.ID] = true
+
+		if err := validateProduct(memRefs{r.m}, &product); err != nil {
+			invalid, ok := invalidBulkResult(product.ID, err)
+			if !ok {
+				return nil, false, err
+			}
+
+			results = append(results, invalid)
+			failed = true
+			continue
+		}
+
+		updated, err := r.m.update(product.ID, &product, product.Version)
+		if err != nil {
+			failed = true
+			result.Status, result.Error = bulkErrorStatus(err)
+			results = append(results, result)
+			continue
+		}
+
+		result.Status = bulkStatusUpdated
+		result.Product = &updated
+		results = append(results, result)
+	}
+
+	if failed && mode == bulkModeAtomic {
+		r.m.products = snapshot
+		rollBackResults(results)
+		return results, false, nil
+	}
+
+	return results, true, nil
+}
+
+func (r *memProductRepo) Delete(id int) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	current, err := r.m.product(id, false)
+	if err != nil {
+		return err
+	}
+	if err := checkDeletable(current); err != nil {
+		return err
+	}
+
+	p := r.m.products[id]
+	now := memNow()
+	p.Delete_Date = &now
+	p.Update_Date = now
+	p.Version++
+	r.m.products[id] = p
+
+	return nil
+}
+
+func (r *memProductRepo) Restore(id int) (Product, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	p, ok := r.m.products[id]
+	if !ok || p.Delete_Date == nil {
+		return Product{}, notFoundf("no deleted product found with id %d", id)
+	}
+
+	p.Delete_Date = nil
+	p.Update_Date = memNow()
+	p.Version++
+	r.m.products[id] = p
+
+	return r.m.withOwner(p), nil
+}
+
+func (r *memProductRepo) Transition(id int, change StatusTransition, userID int, expectedVersion int) (Product, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	return r.m.transition(id, change, userID, 0, expectedVersion)
+}
+
+// transition is Transition for callers that already hold the lock, orderID
+// is the order moving the product like in transitionProduct
+func (m *memoryStore) transition(id int, change StatusTransition, userID, orderID int, expectedVersion int) (Product, error) {
+	current, err := m.product(id, false)
+	if err != nil {
+		return Product{}, err
+	}
+	if expectedVersion != 0 && current.Version != expectedVersion {
+		return Product{}, errVersionMismatch
+	}
+	if current.Status == statusReserved {
+		if err := checkOrderHold(current, m.reservingOrder(id), orderID); err != nil {
+			return Product{}, err
+		}
+	}
+	if err := checkTransition(id, current.Status, change.Status); err != nil {
+		return Product{}, err
+	}
+
+	p := m.products[id]
+	p.StatusID = findMemLookup(m.statuses, 0, change.Status).ID
+	p.Update_Date = memNow()
+	p.Version++
+	m.products[id] = p
+
+	m.history = append(m.history, StatusChange{
+		ID: m.id(), ProductID: id, From: current.Status, To: change.Status,
+		ChangedBy: userID, Note: change.Note, ChangedAt: p.Update_Date,
+	})
+	m.recordLedgerEntry(current, change, p.Update_Date)
+
+	// Only available products are held, whoever held it lost it
+	if current.Status == statusAvailable {
+		delete(m.holds, id)
+	}
+
+	return m.withOwner(p), nil
+}
+
+func (r *memProductRepo) History(id int) ([]StatusChange, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if _, err := r.m.product(id, true); err != nil {
+		return nil, err
+	}
+
+	changes := []StatusChange{}
+	for _, sc := range r.m.history {
+		if sc.ProductID == id {
+			changes = append(changes, sc)
+		}
+	}
+
+	return changes, nil
+}
+
+func (r *memOwnerRepo) List() ([]Owner, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	var owners []Owner
+	for _, o := range r.m.owners {
+		owners = append(owners, o)
+	}
+	sort.Slice(owners, func(i, j int) bool { return owners[i].ID < owners[j].ID })
+
+	return owners, nil
+}
+
+func (r *memOwnerRepo) Get(id int) (Owner, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	o, ok := r.m.owners[id]
+	if !ok {
+		return Owner{}, notFoundf("no owner found with id %d", id)
+	}
+
+	return o, nil
+}
+
+func (r *memOwnerRepo) FindByUser(userID int) (Owner, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for _, o := range r.m.owners {
+		if userID != 0 && o.UserID == userID {
+			return o, nil
+		}
+	}
+
+	return Owner{}, notFoundf("no owner is linked to user %d", userID)
+}
+
+// ownerUserTaken mirrors the unique owner.user_id
+func (m *memoryStore) ownerUserTaken(userID, exceptID int) bool {
+	for _, o := range m.owners {
+		if userID != 0 && o.UserID == userID && o.ID != exceptID {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *memOwnerRepo) Create(owner *Owner) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if r.m.ownerUserTaken(owner.UserID, 0) {
+		return conflictf("user %d is already linked to another owner", owner.UserID)
+	}
+
+	o := Owner{ID: r.m.id(), Name: owner.Name, Commission: owner.Commission, UserID: owner.UserID}
+	r.m.owners[o.ID] = o
+
+	return nil
+}
+
+func (r *memOwnerRepo) Update(id int, owner *Owner) (Owner, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if _, ok := r.m.owners[id]; !ok {
+		return Owner{}, notFoundf("no owner found with id %d", id)
+	}
+
+	if r.m.ownerUserTaken(owner.UserID, id) {
+		return Owner{}, conflictf("user %d is already linked to another owner", owner.UserID)
+	}
+
+	o := Owner{ID: id, Name: owner.Name, Commission: owner.Commission, UserID: owner.UserID}
+	r.m.owners[id] = o
+
+	return o, nil
+}
+
+func withoutPassword(u User) User {
+	u.Password = ""
+	return u
+}
+
+func (m *memoryStore) emailTaken(email string, exceptID int) bool {
+	for _, u := range m.users {
+		if u.Email == email && u.ID != exceptID {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *memUserRepo) List() ([]User, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	var users []User
+	for _, u := range r.m.users {
+		users = append(users, withoutPassword(u))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	return users, nil
+}
+
+func (r *memUserRepo) Get(id int) (User, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	u, ok := r.m.users[id]
+	if !ok {
+		return User{}, notFoundf("no user found with id %d", id)
+	}
+
+	return withoutPassword(u), nil
+}
+
+func (r *memUserRepo) Create(user *User) (User, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if r.m.emailTaken(user.Email, 0) {
+		return User{}, errEmailTaken
+	}
+
+	u := *user
+	u.ID = r.m.id()
+	r.m.users[u.ID] = u
+
+	return withoutPassword(u), nil
+}
+
+func (r *memUserRepo) Update(id int, user *User) (User, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	current, ok := r.m.users[id]
+	if !ok {
+		return User{}, notFoundf("no user found with id %d", id)
+	}
+	if r.m.emailTaken(user.Email, id) {
+		return User{}, errEmailTaken
+	}
+
+	u := *user
+	u.ID = id
+	if u.Password == "" {
+		u.Password = current.Password
+	}
+	r.m.users[id] = u
+
+	return withoutPassword(u), nil
+}
+
+func (r *memUserRepo) Delete(id int) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if _, ok := r.m.users[id]; !ok {
+		return notFoundf("no user found with id %d", id)
+	}
+	delete(r.m.users, id)
+
+	// Sessions go with the user like ON DELETE CASCADE
+	tokens := r.m.refreshTokens[:0]
+	for _, rt := range r.m.refreshTokens {
+		if rt.UserID != id {
+			tokens = append(tokens, rt)
+		}
+	}
+	r.m.refreshTokens = tokens
+
+	// and the status history and payouts forget them like ON DELETE SET NULL
+	for i := range r.m.history {
+		if r.m.history[i].ChangedBy == id {
+			r.m.history[i].ChangedBy = 0
+		}
+	}
+	for i := range r.m.batches {
+		if r.m.batches[i].CreatedBy == id {
+			r.m.batches[i].CreatedBy = 0
+		}
+	}
+	for ownerID, o := range r.m.owners {
+		if o.UserID == id {
+			o.UserID = 0
+			r.m.owners[ownerID] = o
+		}
+	}
+	for orderID, o := range r.m.orders {
+		if o.UserID == id {
+			o.UserID = 0
+		}
+		for i := range o.History {
+			if o.History[i].ChangedBy == id {
+				o.History[i].ChangedBy = 0
+			}
+		}
+		r.m.orders[orderID] = o
+	}
+	for i, p := range r.m.payments {
+		if p.ConfirmedBy == id {
+			r.m.payments[i].ConfirmedBy = 0
+		}
+	}
+	for productID, h := range r.m.holds {
+		if h.UserID == id {
+			delete(r.m.holds, productID)
+		}
+	}
+	for i, w := range r.m.withdrawals {
+		if w.RequestedBy == id {
+			r.m.withdrawals[i].RequestedBy = 0
+		}
+		if w.DecidedBy == id {
+			r.m.withdrawals[i].DecidedBy = 0
+		}
+	}
+
+	return nil
+}
+
+func (r *memUserRepo) FindByEmail(email string) (User, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for _, u := range r.m.users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+
+	return User{}, notFoundf("no user found with email %s", email)
+}
+
+func (r *memUserRepo) SetPassword(id int, hash string) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	u, ok := r.m.users[id]
+	if !ok {
+		return notFoundf("no user found with id %d", id)
+	}
+	u.Password = hash
+	r.m.users[id] = u
+
+	return nil
+}
+
+func (r *memUserRepo) CreateRefreshToken(token RefreshToken) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	r.m.refreshTokens = append(r.m.refreshTokens, memRefreshToken{RefreshToken: token})
+
+	return nil
+}
+
+func (r *memUserRepo) RotateRefreshToken(oldHash string, next RefreshToken) (User, RefreshToken, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.refreshTokens {
+		rt := &r.m.refreshTokens[i]
+		if rt.Hash != oldHash {
+			continue
+		}
+
+		if rt.revoked || time.Now().After(rt.ExpiresAt) {
+			return User{}, RefreshToken{}, errInvalidRefreshToken
+		}
+		if rt.used {
+			r.m.revokeFamily(rt.FamilyID)
+			return User{}, RefreshToken{}, errInvalidRefreshToken
+		}
+
+		rt.used = true
+		next.UserID = rt.UserID
+		next.FamilyID = rt.FamilyID
+		r.m.refreshTokens = append(r.m.refreshTokens, memRefreshToken{RefreshToken: next})
+
+		return withoutPassword(r.m.users[next.UserID]), next, nil
+	}
+
+	return User{}, RefreshToken{}, errInvalidRefreshToken
+}
+
+func (m *memoryStore) revokeFamily(family string) {
+	for i := range m.refreshTokens {
+		if m.refreshTokens[i].FamilyID == family {
+			m.refreshTokens[i].revoked = true
+		}
+	}
+}
+
+func (r *memUserRepo) RevokeSession(family, jti string, expiresAt time.Time) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	r.m.revokeFamily(family)
+
+	for k, exp := range r.m.revoked {
+		if exp.Before(time.Now()) {
+			delete(r.m.revoked, k)
+		}
+	}
+	r.m.revoked[jti] = expiresAt
+
+	return nil
+}
+
+func (r *memUserRepo) RevokeUserSessions(userID int) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.refreshTokens {
+		if r.m.refreshTokens[i].UserID == userID {
+			r.m.refreshTokens[i].revoked = true
+		}
+	}
+
+	return nil
+}
+
+func (r *memUserRepo) IsAccessTokenRevoked(jti, family string) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if _, ok := r.m.revoked[jti]; ok {
+		return true, nil
+	}
+	found := false
+	for _, rt := range r.m.refreshTokens {
+		if rt.FamilyID != family {
+			continue
+		}
+		if rt.revoked {
+			return true, nil
+		}
+		found = true
+	}
+
+	return !found, nil
+}
+
+// Types and statuses share these helpers, Status converts to Type and back
+
+func findMemLookup[T Type | Status](rows []T, id int, name string) Type {
+	for _, row := range rows {
+		t := Type(row)
+		if (id != 0 && t.ID == id) || (id == 0 && t.Name == name) {
+			return t
+		}
+	}
+	return Type{}
+}
+
+func (m *memoryStore) lookupUsed(table string, id int) bool {
+	for _, p := range m.products {
+		if (table == "type" && p.TypeID == id) || (table == "status" && p.StatusID == id) {
+			return true
+		}
+	}
+	return false
+}
+
+func memLookupNameTaken[T Type | Status](rows []T, name string, exceptID int) bool {
+	for _, row := range rows {
+		if t := Type(row); t.Name == name && t.ID != exceptID {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *memLookupRepo) ListTypes() ([]Type, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	return append([]Type(nil), r.m.types...), nil
+}
+
+func (r *memLookupRepo) GetType(id int) (Type, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	t := findMemLookup(r.m.types, id, "")
+	if t.ID == 0 {
+		return Type{}, notFoundf("no type found with id %d", id)
+	}
+
+	return t, nil
+}
+
+func (r *memLookupRepo) CreateType(name string) (Type, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if memLookupNameTaken(r.m.types, name, 0) {
+		return Type{}, conflictf("type %q already exists", name)
+	}
+
+	t := Type{ID: r.m.id(), Name: name}
+	r.m.types = append(r.m.types, t)
+
+	return t, nil
+}
+
+func (r *memLookupRepo) UpdateType(id int, name string) (Type, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if memLookupNameTaken(r.m.types, name, id) {
+		return Type{}, conflictf("type %q already exists", name)
+	}
+
+	for i := range r.m.types {
+		if r.m.types[i].ID == id {
+			r.m.types[i].Name = name
+			return r.m.types[i], nil
+		}
+	}
+
+	return Type{}, notFoundf("no type found with id %d", id)
+}
+
+func (r *memLookupRepo) DeleteType(id int) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for i := range r.m.types {
+		if r.m.types[i].ID != id {
+			continue
+		}
+		if r.m.lookupUsed("type", id) {
+			return conflictf("type %d is still used by products", id)
+		}
+		r.m.types = append(r.m.types[:i], r.m.types[i+1:]...)
+		return nil
+	}
+
+	return notFoundf("no type found with id %d", id)
+}
+
+func (r *memLookupRepo) ListStatuses() ([]Status, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	return append([]Status(nil), r.m.statuses...), nil
+}
+
+func (r *memLookupRepo) GetStatus(id int) (Status, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	t := findMemLookup(r.m.statuses, id, "")
+	if t.ID == 0 {
+		return Status{}, notFoundf("no status found with id %d", id)
+	}
+
+	return Status(t), nil
+}
+
+func (r *memLookupRepo) CreateStatus(name string) (Status, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if memLookupNameTaken(r.m.statuses, name, 0) {
+		return Status{}, conflictf("status %q already exists", name)
+	}
+
+	s := Status{ID: r.m.id(), Name: name}
+	r.m.statuses = append(r.m.statuses, s)
+
+	return s, nil
+}
+
+func (r *memLookupRepo) UpdateStatus(id int, name string) (Status, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if err := checkStatusEditable(Status(findMemLookup(r.m.statuses, id, ""))); err != nil {
+		return Status{}, err
+	}
+
+	if memLookupNameTaken(r.m.statuses, name, id) {
+		return Status{}, conflictf("status %q already exists", name)
+	}
+
+	for i := range r.m.statuses {
+		if r.m.statuses[i].ID == id {
+			r.m.statuses[i].Name = name
+			return r.m.statuses[i], nil
+		}
+	}
+
+	return Status{}, notFoundf("no status found with id %d", id)
+}
+
+func (r *memLookupRepo) DeleteStatus(id int) error {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if err := checkStatusEditable(Status(findMemLookup(r.m.statuses, id, ""))); err != nil {
+		return err
+	}
+
+	for i := range r.m.statuses {
+		if r.m.statuses[i].ID != id {
+			continue
+		}
+		if r.m.lookupUsed("status", id) {
+			return conflictf("status %d is still used by products", id)
+		}
+		r.m.statuses = append(r.m.statuses[:i], r.m.statuses[i+1:]...)
+		return nil
+	}
+
+	return notFoundf("no status found with id %d", id)
+}
+
+func (r *memLookupRepo) ProductReferences(p *Product) (ProductRefs, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	return memRefs{r.m}.ProductReferences(p)
+}
+
+func (r memRefs) ProductReferences(p *Product) (ProductRefs, error) {
+	var refs ProductRefs
+
+	refs.Type = findMemLookup(r.m.types, p.TypeID, p.Type)
+	refs.Status = Status(findMemLookup(r.m.statuses, p.StatusID, p.Status))
+	_, refs.Owner = r.m.owners[p.Owner]
+
+	return refs, nil
+}
+
+// productImages returns the images of a live product in display order
+func (m *memoryStore) productImages(productID int) ([]ProductImage, error) {
+	if _, err := m.product(productID, false); err != nil {
+		return nil, err
+	}
+
+	images := []ProductImage{}
+	for _, pi := range m.images {
+		if pi.ProductID == productID {
+			images = append(images, pi)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Position < images[j].Position
+	})
+
+	return images, nil
+}
+
+func (r *memImageRepo) List(productID int) ([]ProductImage, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	return r.m.productImages(productID)
+}
+
+func (r *memImageRepo) Add(productID int, images []ProductImage) ([]ProductImage, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	current, err := r.m.productImages(productID)
+	if err != nil {
+		return nil, err
+	}
+
+	last := 0
+	if len(current) > 0 {
+		last = current[len(current)-1].Position
+	}
+
+	added := make([]ProductImage, 0, len(images))
+	for i, pi := range images {
+		pi.ID = r.m.id()
+		pi.ProductID = productID
+		pi.Position = last + i + 1
+		pi.Create_Date = memNow()
+		r.m.images[pi.ID] = pi
+		added = append(added, pi)
+	}
+
+	return added, nil
+}
+
+func (r *memImageRepo) Reorder(productID int, order []int) ([]ProductImage, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	current, err := r.m.productImages(productID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(current))
+	for _, pi := range current {
+		ids = append(ids, pi.ID)
+	}
+	if err := checkImageOrder(ids, order); err != nil {
+		return nil, err
+	}
+
+	for i, id := range order {
+		pi := r.m.images[id]
+		pi.Position = i + 1
+		r.m.images[id] = pi
+	}
+
+	return r.m.productImages(productID)
+}
+
+func (r *memImageRepo) Delete(productID, imageID int) (ProductImage, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if _, err := r.m.product(productID, false); err != nil {
+		return ProductImage{}, err
+	}
+
+	pi, ok := r.m.images[imageID]
+	if !ok || pi.ProductID != productID {
+		return ProductImage{}, notFoundf("no image %d on product %d", imageID, productID)
+	}
+	delete(r.m.images, imageID)
+
+	return pi, nil
+}
+
+// recordLedgerEntry mirrors the Postgres one, the caller holds the lock
+func (m *memoryStore) recordLedgerEntry(current Product, change StatusTransition, at string) {
+	switch {
+	case change.Status == statusSold:
+		owner := m.owners[current.Owner]
+		price := salePrice(current)
+		m.ledger = append(m.ledger, LedgerEntry{
+			ID: m.id(), OwnerID: owner.ID, Kind: ledgerSale, ProductID: current.ID,
+			SalePrice: price, Commission: owner.Commission, Amount: ownerShare(price, owner.Commission),
+			Note: change.Note, CreatedAt: at,
+		})
+	case current.Status == statusSold && change.Status == statusReturned:
+		for i := len(m.ledger) - 1; i >= 0; i-- {
+			sale := m.ledger[i]
+			if sale.ProductID != current.ID || sale.Kind != ledgerSale {
+				continue
+			}
+			m.ledger = append(m.ledger, LedgerEntry{
+				ID: m.id(), OwnerID: sale.OwnerID, Kind: ledgerReturn, ProductID: sale.ProductID,
+				SalePrice: sale.SalePrice, Commission: sale.Commission, Amount: -sale.Amount,
+				Note: change.Note, CreatedAt: at,
+			})
+			break
+		}
+	}
+}
+
+func (r *memLedgerRepo) Balance(ownerID int) (OwnerBalance, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	o, ok := r.m.owners[ownerID]
+	if !ok {
+		return OwnerBalance{}, notFoundf("no owner found with id %d", ownerID)
+	}
+
+	b := OwnerBalance{OwnerID: ownerID, Commission: o.Commission}
+	for _, e := range r.m.ledger {
+		switch {
+		case e.OwnerID != ownerID:
+		case e.Kind == ledgerPayout:
+			b.PaidOut -= e.Amount
+		default:
+			b.Earned += e.Amount
+		}
+	}
+	b.Balance = b.Earned - b.PaidOut
+
+	return b, nil
+}
+
+func (r *memLedgerRepo) Statements(ownerID int) ([]OwnerStatement, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if _, ok := r.m.owners[ownerID]; !ok {
+		return nil, notFoundf("no owner found with id %d", ownerID)
+	}
+
+	var payouts []Payout
+	for _, p := range r.m.payouts {
+		if p.OwnerID == ownerID {
+			payouts = append(payouts, p)
+		}
+	}
+
+	var entries []LedgerEntry
+	for _, e := range r.m.ledger {
+		if e.OwnerID == ownerID {
+			e.ProductName = r.m.products[e.ProductID].Name
+			entries = append(entries, e)
+		}
+	}
+
+	return buildStatements(payouts, entries), nil
+}
+
+func (r *memLedgerRepo) CreatePayoutBatch(req PayoutRequest, userID int) (PayoutBatch, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	var owners []int
+	for id := range r.m.owners {
+		if len(req.Owners) == 0 || slices.Contains(req.Owners, id) {
+			owners = append(owners, id)
+		}
+	}
+	sort.Ints(owners)
+	if err := checkPayoutOwners(req.Owners, owners); err != nil {
+		return PayoutBatch{}, err
+	}
+
+	now := memNow()
+	batch := PayoutBatch{ID: r.m.id(), Note: req.Note, CreatedBy: userID, CreatedAt: now}
+
+	var payouts []Payout
+	settled := map[int]bool{}
+	for _, ownerID := range owners {
+		amount := 0
+		for _, e := range r.m.ledger {
+			if e.OwnerID == ownerID && e.PayoutID == 0 {
+				amount += e.Amount
+			}
+		}
+		if amount <= 0 {
+			continue
+		}
+
+		p := Payout{ID: r.m.id(), BatchID: batch.ID, OwnerID: ownerID, Amount: amount, CreatedAt: now}
+		for i, e := range r.m.ledger {
+			if e.OwnerID == ownerID && e.PayoutID == 0 {
+				r.m.ledger[i].PayoutID = p.ID
+				if e.Kind == ledgerSale {
+					settled[e.ProductID] = true
+				}
+			}
+		}
+		r.m.ledger = append(r.m.ledger, LedgerEntry{
+			ID: r.m.id(), OwnerID: ownerID, PayoutID: p.ID, Kind: ledgerPayout,
+			Amount: -amount, Note: req.Note, CreatedAt: now,
+		})
+		payouts = append(payouts, p)
+	}
+
+	if len(payouts) == 0 {
+		return PayoutBatch{}, conflictf("no owner has a balance to pay out")
+	}
+
+	paidOut := findMemLookup(r.m.statuses, 0, statusPaidOut)
+	for id := range settled {
+		p := r.m.products[id]
+		if r.m.withOwner(p).Status != statusSold {
+			continue
+		}
+		p.StatusID = paidOut.ID
+		p.Update_Date = now
+		p.Version++
+		r.m.products[id] = p
+
+		r.m.history = append(r.m.history, StatusChange{
+			ID: r.m.id(), ProductID: id, From: statusSold, To: statusPaidOut,
+			ChangedBy: userID, Note: payoutNote(batch.ID), ChangedAt: now,
+		})
+	}
+
+	r.m.payouts = append(r.m.payouts, payouts...)
+	r.m.batches = append(r.m.batches, batch)
+
+	return r.m.payoutBatch(batch), nil
+}
+
+func (r *memLedgerRepo) GetPayoutBatch(id int) (PayoutBatch, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	for _, b := range r.m.batches {
+		if b.ID == id {
+			return r.m.payoutBatch(b), nil
+		}
+	}
+
+	return PayoutBatch{}, notFoundf("no payout batch found with id %d", id)
+}
+
+// payoutBatch fills in the payouts of a batch like queryPayoutBatch
+func (m *memoryStore) payoutBatch(b PayoutBatch) PayoutBatch {
+	b.Payouts = []Payout{}
+	b.Total = 0
+	for _, p := range m.payouts {
+		if p.BatchID == b.ID {
+			p.OwnerName = m.owners[p.OwnerID].Name
+			b.Payouts = append(b.Payouts, p)
+			b.Total += p.Amount
+		}
+	}
+	return b
+}
+
+// withdrawal fills in the product name like the join in withdrawalSelect
+func (m *memoryStore) withdrawal(w WithdrawalRequest) WithdrawalRequest {
+	w.ProductName = m.products[w.ProductID].Name
+	return w
+}
+
+func (r *memWithdrawalRepo) Create(ownerID int, req NewWithdrawal, userID int) (WithdrawalRequest, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	p, err := r.m.product(req.ProductID, false)
+	if err != nil {
+		return WithdrawalRequest{}, err
+	}
+	if p.Owner != ownerID {
+		return WithdrawalRequest{}, notFoundf("no product found with id %d", req.ProductID)
+	}
+	if err := checkWithdrawable(p); err != nil {
+		return WithdrawalRequest{}, err
+	}
+	for _, w := range r.m.withdrawals {
+		if w.ProductID == p.ID && w.Status == withdrawalPending {
+			return WithdrawalRequest{}, conflictf("product %d already has a pending withdrawal request", p.ID)
+		}
+	}
+
+	w := WithdrawalRequest{
+		ID: r.m.id(), ProductID: p.ID, OwnerID: ownerID, Status: withdrawalPending,
+		Note: req.Note, RequestedBy: userID, CreatedAt: memNow(),
+	}
+	r.m.withdrawals = append(r.m.withdrawals, w)
+
+	return r.m.withdrawal(w), nil
+}
+
+func (r *memWithdrawalRepo) List(ownerID int, status string) ([]WithdrawalRequest, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	requests := []WithdrawalRequest{}
+	for i := len(r.m.withdrawals) - 1; i >= 0; i-- {
+		w := r.m.withdrawals[i]
+		if (ownerID == 0 || w.OwnerID == ownerID) && (status == "" || w.Status == status) {
+			requests = append(requests, r.m.withdrawal(w))
+		}
+	}
+
+	return requests, nil
+}
+
+func (r *memWithdrawalRepo) Decide(id int, approve bool, decision WithdrawalDecision, userID int) (WithdrawalRequest, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	i := slices.IndexFunc(r.m.withdrawals, func(w WithdrawalRequest) bool { return w.ID == id })
+	if i < 0 {
+		return WithdrawalRequest{}, notFoundf("no withdrawal request found with id %d", id)
+	}
+	w := r.m.withdrawals[i]
+	if w.Status != withdrawalPending {
+		return WithdrawalRequest{}, conflictf("withdrawal request %d is already %s", id, w.Status)
+	}
+
+	w.Status = withdrawalRejected
+	if approve {
+		w.Status = withdrawalApproved
+
+		current, err := r.m.product(w.ProductID, false)
+		if err != nil {
+			return WithdrawalRequest{}, err
+		}
+		if err := checkWithdrawable(current); err != nil {
+			return WithdrawalRequest{}, err
+		}
+		if _, err := r.m.transition(w.ProductID, withdrawalTransition(id, decision.Note), userID, 0, 0); err != nil {
+			return WithdrawalRequest{}, err
+		}
+	}
+	w.DecidedBy = userID
+	w.DecisionNote = decision.Note
+	w.DecidedAt = memNow()
+	r.m.withdrawals[i] = w
+
+	return r.m.withdrawal(w), nil
+}
+
+// order copies a stored order with the current product names, the history
+// and payment only when asked like Get
+func (m *memoryStore) order(o Order, withHistory bool) Order {
+	items := make([]OrderItem, len(o.Items))
+	for i, item := range o.Items {
+		item.ProductName = m.products[item.ProductID].Name
+		items[i] = item
+	}
+	o.Items = items
+
+	if !withHistory {
+		o.History = nil
+		return o
+	}
+
+	o.History = slices.Clone(o.History)
+	for _, p := range m.payments {
+		if p.OrderID == o.ID {
+			o.Payment = &p
+		}
+	}
+	return o
+}
+
+func (r *memOrderRepo) Checkout(userID int, checkout Checkout) (Order, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	ids := checkoutOrder(checkout.ProductIDs)
+	for _, id := range ids {
+		p, err := r.m.product(id, false)
+		if err != nil {
+			return Order{}, err
+		}
+		if err := checkOrderable(p); err != nil {
+			return Order{}, err
+		}
+		if err := checkHolder(id, r.m.holder(id), userID); err != nil {
+			return Order{}, err
+		}
+	}
+
+	now := memNow()
+	o := Order{ID: r.m.id(), UserID: userID, Status: orderPending, Note: checkout.Note, CreatedAt: now, UpdatedAt: now}
+	for _, id := range ids {
+		price := salePrice(r.m.products[id])
+		change := StatusTransition{Status: statusReserved, Note: orderNote(o.ID, "")}
+		if _, err := r.m.transition(id, change, userID, o.ID, 0); err != nil {
+			return Order{}, err
+		}
+		o.Items = append(o.Items, OrderItem{ID: r.m.id(), ProductID: id, Price: price})
+		o.Total += price
+	}
+	o.History = []OrderChange{{To: orderPending, ChangedBy: userID, Note: checkout.Note, ChangedAt: now}}
+	r.m.orders[o.ID] = o
+
+	return r.m.order(o, true), nil
+}
+
+func (r *memOrderRepo) Get(id int) (Order, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	o, ok := r.m.orders[id]
+	if !ok {
+		return Order{}, notFoundf("no order found with id %d", id)
+	}
+
+	return r.m.order(o, true), nil
+}
+
+func (r *memOrderRepo) List(filter OrderFilter, limit, offset int) ([]Order, int, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	matched := []Order{}
+	for _, o := range r.m.orders {
+		if (filter.UserID == 0 || o.UserID == filter.UserID) && (filter.Status == "" || o.Status == filter.Status) {
+			matched = append(matched, r.m.order(o, false))
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].ID > matched[j].ID })
+
+	return memPage(matched, limit, offset), len(matched), nil
+}
+
+func (r *memOrderRepo) Transition(id int, change OrderTransition, userID int) (Order, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	o, ok := r.m.orders[id]
+	if !ok {
+		return Order{}, notFoundf("no order found with id %d", id)
+	}
+	if err := checkOrderTransition(id, o.Status, change.Status); err != nil {
+		return Order{}, err
+	}
+
+	return r.m.moveOrder(o, change, userID)
+}
+
+// moveOrder checks every product move before making any, since the memory
+// store has no transaction to roll back
+// reservingOrder mirrors the Postgres one, the caller holds the lock
+func (m *memoryStore) reservingOrder(productID int) int {
+	holder := 0
+	for _, o := range m.orders {
+		if o.Status != orderPending || o.ID < holder {
+			continue
+		}
+		for _, item := range o.Items {
+			if item.ProductID == productID {
+				holder = o.ID
+			}
+		}
+	}
+	return holder
+}
+
+func (m *memoryStore) moveOrder(o Order, change OrderTransition, userID int) (Order, error) {
+	if status, ok := orderProductStatus(o.Status, change.Status); ok {
+		for _, item := range o.Items {
+			p, err := m.product(item.ProductID, false)
+			if err != nil {
+				return Order{}, err
+			}
+			if err := checkTransition(p.ID, p.Status, status); err != nil {
+				return Order{}, err
+			}
+		}
+		for _, item := range o.Items {
+			pc := StatusTransition{Status: status, Note: orderNote(o.ID, change.Note)}
+			if _, err := m.transition(item.ProductID, pc, userID, o.ID, 0); err != nil {
+				return Order{}, err
+			}
+		}
+	}
+
+	now := memNow()
+	o.History = append(slices.Clone(o.History), OrderChange{
+		From: o.Status, To: change.Status, ChangedBy: userID, Note: change.Note, ChangedAt: now,
+	})
+	o.Status = change.Status
+	o.UpdatedAt = now
+	m.orders[o.ID] = o
+
+	return m.order(o, true), nil
+}
+
+func (r *memOrderRepo) ConfirmPayment(id int, payment PaymentConfirmation, userID int) (Order, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	o, ok := r.m.orders[id]
+	if !ok {
+		return Order{}, notFoundf("no order found with id %d", id)
+	}
+
+	current := r.m.order(o, true)
+	done, err := checkPayment(current, payment)
+	if err != nil || done {
+		return current, err
+	}
+	for _, p := range r.m.payments {
+		if p.Reference == payment.Reference {
+			return Order{}, conflictf("payment reference %s was already used for another order", payment.Reference)
+		}
+	}
+
+	updated, err := r.m.moveOrder(o, paymentTransition(payment), userID)
+	if err != nil {
+		return Order{}, err
+	}
+
+	r.m.payments = append(r.m.payments, OrderPayment{
+		ID: r.m.id(), OrderID: id, Amount: payment.Amount, Source: payment.Source, Reference: payment.Reference,
+		ConfirmedBy: userID, Note: payment.Note, CreatedAt: updated.UpdatedAt,
+	})
+
+	return r.m.order(r.m.orders[id], true), nil
+}
+
+// cart lists the live holds of a user, like queryCart
+func (m *memoryStore) cart(userID int) Cart {
+	var held []int
+	for productID, h := range m.holds {
+		p, ok := m.products[productID]
+		if h.UserID == userID && h.active() && ok && p.Delete_Date == nil {
+			held = append(held, productID)
+		}
+	}
+	sort.Slice(held, func(i, j int) bool {
+		a, b := m.holds[held[i]], m.holds[held[j]]
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return held[i] < held[j]
+	})
+
+	items := make([]CartItem, len(held))
+	for i, productID := range held {
+		p := m.products[productID]
+		items[i] = CartItem{
+			ProductID:   productID,
+			ProductName: p.Name,
+			Price:       salePrice(p),
+			HeldUntil:   m.holds[productID].ExpiresAt.Format(time.RFC3339),
+		}
+	}
+	return newCart(items)
+}
+
+func (r *memCartRepo) Get(userID int) (Cart, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	return r.m.cart(userID), nil
+}
+
+func (r *memCartRepo) Add(userID, productID int, ttl time.Duration) (Cart, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	p, err := r.m.product(productID, false)
+	if err != nil {
+		return Cart{}, err
+	}
+	if err := checkHoldable(p, r.m.holder(productID), userID); err != nil {
+		return Cart{}, err
+	}
+	if err := checkCartSize(len(r.m.cart(userID).Items)); err != nil {
+		return Cart{}, err
+	}
+
+	now := time.Now()
+	r.m.holds[productID] = memHold{UserID: userID, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+
+	return r.m.cart(userID), nil
+}
+
+func (r *memCartRepo) Remove(userID, productID int) (Cart, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	if r.m.holder(productID) != userID {
+		return Cart{}, notFoundf("product %d isn't in your cart", productID)
+	}
+	delete(r.m.holds, productID)
+
+	return r.m.cart(userID), nil
+}
+
+func (r *memCartRepo) ReleaseExpired() (int, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	released := 0
+	for productID, h := range r.m.holds {
+		if !h.active() {
+			delete(r.m.holds, productID)
+			released++
+		}
+	}
+	return released, nil
+}
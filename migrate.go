@@ -0,0 +1,300 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID keeps two instances starting at once from applying the same
+// migration twice, any constant works as long as nothing else uses it.
+const migrationLockID = 727_001
+
+// migration is one pair of files, migrations/0002_name.up.sql and
+// migrations/0002_name.down.sql.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+type migrationStatus struct {
+	migration
+	appliedAt *time.Time
+}
+
+func loadMigrations(files fs.FS) ([]migration, error) {
+	names, err := fs.Glob(files, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+
+	for _, file := range names {
+		base := path.Base(file)
+
+		rest, direction, ok := cutSuffixes(base, ".up.sql", ".down.sql")
+		if !ok {
+			return nil, fmt.Errorf("migration %s must end in .up.sql or .down.sql", base)
+		}
+
+		num, name, ok := strings.Cut(rest, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s must start with a version like 0001_", base)
+		}
+
+		data, err := fs.ReadFile(files, file)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if m.name != name {
+			return nil, fmt.Errorf("migration version %d is used by %s and %s", version, m.name, name)
+		}
+
+		if direction == ".up.sql" {
+			m.up = string(data)
+		} else {
+			m.down = string(data)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+	return migrations, nil
+}
+
+func cutSuffixes(s string, suffixes ...string) (string, string, bool) {
+	for _, suffix := range suffixes {
+		if rest, ok := strings.CutSuffix(s, suffix); ok {
+			return rest, suffix, true
+		}
+	}
+	return s, "", false
+}
+
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS public.schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+
+	return err
+}
+
+func appliedMigrations(q dbtx) (map[int]time.Time, error) {
+	rows, err := q.Query("SELECT version, applied_at FROM public.schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var (
+			version int
+			at      time.Time
+		)
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+
+	return applied, rows.Err()
+}
+
+// migrateUp applies every pending migration, each in its own transaction,
+// and returns the ones it applied.
+func migrateUp(db *sql.DB, migrations []migration) ([]migration, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+
+	var done []migration
+
+	for _, m := range migrations {
+		applied, err := runMigration(db, m, true)
+		if err != nil {
+			return done, fmt.Errorf("migration %04d_%s: %w", m.version, m.name, err)
+		}
+		if applied {
+			done = append(done, m)
+		}
+	}
+
+	return done, nil
+}
+
+// migrateDown reverts the latest applied migration, it returns false when
+// there was nothing to revert.
+func migrateDown(db *sql.DB, migrations []migration) (migration, bool, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return migration{}, false, err
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return migration{}, false, err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+
+		if _, err := runMigration(db, m, false); err != nil {
+			return m, false, fmt.Errorf("migration %04d_%s: %w", m.version, m.name, err)
+		}
+		return m, true, nil
+	}
+
+	return migration{}, false, nil
+}
+
+// runMigration applies or reverts one migration under an advisory lock. The
+// applied check happens after taking the lock, so a migration another
+// instance just ran is skipped instead of run twice.
+func runMigration(db *sql.DB, m migration, up bool) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return false, err
+	}
+
+	var applied bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM public.schema_migrations WHERE version = $1)", m.version).Scan(&applied)
+	if err != nil {
+		return false, err
+	}
+	if applied == up {
+		return false, nil
+	}
+
+	if up {
+		if _, err := tx.Exec(m.up); err != nil {
+			return false, err
+		}
+		_, err = tx.Exec("INSERT INTO public.schema_migrations(version, name) VALUES ($1, $2)", m.version, m.name)
+	} else {
+		if _, err := tx.Exec(m.down); err != nil {
+			return false, err
+		}
+		_, err = tx.Exec("DELETE FROM public.schema_migrations WHERE version = $1", m.version)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func migrationStatuses(db *sql.DB, migrations []migration) ([]migrationStatus, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]migrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		s := migrationStatus{migration: m}
+		if at, ok := applied[m.version]; ok {
+			s.appliedAt = &at
+		}
+		statuses = append(statuses, s)
+	}
+
+	return statuses, nil
+}
+
+// runMigrateCommand handles `migrate up|down|status`
+func runMigrateCommand(db *sql.DB, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: migrate up|down|status")
+	}
+
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		done, err := migrateUp(db, migrations)
+		for _, m := range done {
+			fmt.Fprintf(out, "applied %04d_%s\n", m.version, m.name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			fmt.Fprintln(out, "already up to date")
+		}
+
+	case "down":
+		m, reverted, err := migrateDown(db, migrations)
+		if err != nil {
+			return err
+		}
+		if !reverted {
+			fmt.Fprintln(out, "nothing to revert")
+			return nil
+		}
+		fmt.Fprintf(out, "reverted %04d_%s\n", m.version, m.name)
+
+	case "status":
+		statuses, err := migrationStatuses(db, migrations)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.appliedAt != nil {
+				state = "applied " + s.appliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(out, "%04d_%s\t%s\n", s.version, s.name, state)
+		}
+
+	default:
+		return fmt.Errorf("unknown migrate command %q, use up, down or status", args[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %04d_%s: want version %d, versions must have no gaps", m.version, m.name, i+1)
+		}
+	}
+}
+
+func TestLoadMigrationsRejectsBadFiles(t *testing.T) {
+	cases := map[string]fstest.MapFS{
+		"missing down": {
+			"migrations/0001_a.up.sql": {Data: []byte("SELECT 1")},
+		},
+		"no version": {
+			"migrations/a.up.sql":   {Data: []byte("SELECT 1")},
+			"migrations/a.down.sql": {Data: []byte("SELECT 1")},
+		},
+		"duplicate version": {
+			"migrations/0001_a.up.sql":   {Data: []byte("SELECT 1")},
+			"migrations/0001_a.down.sql": {Data: []byte("SELECT 1")},
+			"migrations/0001_b.up.sql":   {Data: []byte("SELECT 1")},
+			"migrations/0001_b.down.sql": {Data: []byte("SELECT 1")},
+		},
+		"unknown suffix": {
+			"migrations/0001_a.sql": {Data: []byte("SELECT 1")},
+		},
+	}
+
+	for name, files := range cases {
+		if _, err := loadMigrations(files); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+}
+
+func TestRunMigrateCommandUsage(t *testing.T) {
+	var out strings.Builder
+
+	for _, args := range [][]string{nil, {"sideways"}, {"up", "extra"}} {
+		if err := runMigrateCommand(nil, args, &out); err == nil {
+			t.Errorf("migrate %v: want an error", args)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS public.users;
+DROP TABLE IF EXISTS public."user";
+DROP TABLE IF EXISTS public.product;
+DROP TABLE IF EXISTS public.status;
+DROP TABLE IF EXISTS public.type;
+DROP TABLE IF EXISTS public.owner;
@@ -0,0 +1,56 @@
+-- The tables that used to be created by hand through pgAdmin. IF NOT EXISTS
+-- lets an existing database adopt the migrations without losing data.
+
+CREATE TABLE IF NOT EXISTS public.owner (
+    id   SERIAL PRIMARY KEY,
+    name TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS public.type (
+    id   SERIAL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS public.status (
+    id   SERIAL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS public.product (
+    id          SERIAL PRIMARY KEY,
+    name        TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    defect      TEXT NOT NULL DEFAULT '',
+    type        TEXT NOT NULL,
+    waist       INTEGER NOT NULL DEFAULT 0,
+    length      INTEGER NOT NULL DEFAULT 0,
+    chest       INTEGER NOT NULL DEFAULT 0,
+    owner       INTEGER NOT NULL REFERENCES public.owner (id),
+    status      TEXT NOT NULL,
+    price       INTEGER NOT NULL DEFAULT 0,
+    saleprice   INTEGER NOT NULL DEFAULT 0,
+    image       TEXT[] NOT NULL DEFAULT '{}',
+    createdate  TIMESTAMP NOT NULL DEFAULT now(),
+    updatedate  TIMESTAMP NOT NULL DEFAULT now()
+);
+
+-- Login accounts
+CREATE TABLE IF NOT EXISTS public."user" (
+    id        SERIAL PRIMARY KEY,
+    email     TEXT NOT NULL UNIQUE,
+    password  TEXT NOT NULL,
+    firstname TEXT NOT NULL DEFAULT '',
+    lastname  TEXT NOT NULL DEFAULT '',
+    phone     INTEGER NOT NULL DEFAULT 0,
+    address   TEXT NOT NULL DEFAULT '',
+    role      TEXT,
+    country   TEXT NOT NULL DEFAULT '',
+    zipcode   INTEGER NOT NULL DEFAULT 0
+);
+
+-- Users managed by admins through /users
+CREATE TABLE IF NOT EXISTS public.users (
+    id        SERIAL PRIMARY KEY,
+    firstname TEXT NOT NULL,
+    lastname  TEXT NOT NULL
+);
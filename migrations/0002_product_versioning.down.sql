@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS public.product_live_idx;
+
+ALTER TABLE public.product DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE public.product DROP COLUMN IF EXISTS version;
@@ -0,0 +1,5 @@
+-- version backs the ETag/If-Match checks, deleted_at the soft delete
+ALTER TABLE public.product ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE public.product ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS product_live_idx ON public.product (id) WHERE deleted_at IS NULL;
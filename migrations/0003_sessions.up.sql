@@ -0,0 +1,21 @@
+-- Only the sha256 of a refresh token is stored. Tokens of one login share a
+-- family_id, so a replayed token can revoke the whole session.
+CREATE TABLE IF NOT EXISTS public.refresh_token (
+    id         SERIAL PRIMARY KEY,
+    user_id    INTEGER NOT NULL REFERENCES public."user" (id) ON DELETE CASCADE,
+    family_id  TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at    TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS refresh_token_family_idx ON public.refresh_token (family_id);
+CREATE INDEX IF NOT EXISTS refresh_token_user_idx ON public.refresh_token (user_id);
+
+-- Access tokens revoked on logout, kept until they would have expired anyway
+CREATE TABLE IF NOT EXISTS public.revoked_token (
+    jti        TEXT PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,38 @@
+-- Splits the accounts back out. Sessions can't be mapped back and are dropped,
+-- users without an email stay in public.users only.
+
+CREATE TABLE public."user" (
+    id        SERIAL PRIMARY KEY,
+    email     TEXT NOT NULL UNIQUE,
+    password  TEXT NOT NULL,
+    firstname TEXT NOT NULL DEFAULT '',
+    lastname  TEXT NOT NULL DEFAULT '',
+    phone     INTEGER NOT NULL DEFAULT 0,
+    address   TEXT NOT NULL DEFAULT '',
+    role      TEXT,
+    country   TEXT NOT NULL DEFAULT '',
+    zipcode   INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT INTO public."user" (email, password, firstname, lastname, phone, address, role, country, zipcode)
+SELECT email, password, firstname, lastname, phone, address, role, country, zipcode
+FROM public.users
+WHERE email IS NOT NULL AND password IS NOT NULL;
+
+DELETE FROM public.refresh_token;
+
+ALTER TABLE public.refresh_token DROP CONSTRAINT IF EXISTS refresh_token_user_id_fkey;
+ALTER TABLE public.refresh_token
+    ADD CONSTRAINT refresh_token_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES public."user" (id) ON DELETE CASCADE;
+
+DELETE FROM public.users WHERE email IS NOT NULL AND password IS NOT NULL;
+
+ALTER TABLE public.users
+    DROP COLUMN email,
+    DROP COLUMN password,
+    DROP COLUMN phone,
+    DROP COLUMN address,
+    DROP COLUMN role,
+    DROP COLUMN country,
+    DROP COLUMN zipcode;
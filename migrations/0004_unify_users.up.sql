@@ -0,0 +1,35 @@
+-- Login accounts lived in public."user" and admin managed users in
+-- public.users, neither had every field. Everything moves into public.users.
+
+ALTER TABLE public.users
+    ADD COLUMN IF NOT EXISTS email          TEXT UNIQUE,
+    ADD COLUMN IF NOT EXISTS password       TEXT,
+    ADD COLUMN IF NOT EXISTS phone          INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS address        TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS role           TEXT NOT NULL DEFAULT 'customer',
+    ADD COLUMN IF NOT EXISTS country        TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS zipcode        INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS legacy_user_id INTEGER;
+
+INSERT INTO public.users (email, password, firstname, lastname, phone, address, role, country, zipcode, legacy_user_id)
+SELECT email, password, COALESCE(firstname, ''), COALESCE(lastname, ''), COALESCE(phone, 0),
+       COALESCE(address, ''), COALESCE(NULLIF(role, ''), 'customer'), COALESCE(country, ''),
+       COALESCE(zipcode, 0), id
+FROM public."user";
+
+-- Access tokens carry the old id in their uid claim, so the sessions are
+-- moved to the new ids and revoked, everyone logs in again once.
+ALTER TABLE public.refresh_token DROP CONSTRAINT IF EXISTS refresh_token_user_id_fkey;
+
+UPDATE public.refresh_token rt
+SET user_id = u.id, revoked_at = COALESCE(rt.revoked_at, now())
+FROM public.users u
+WHERE u.legacy_user_id = rt.user_id;
+
+ALTER TABLE public.refresh_token
+    ADD CONSTRAINT refresh_token_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES public.users (id) ON DELETE CASCADE;
+
+ALTER TABLE public.users DROP COLUMN legacy_user_id;
+
+DROP TABLE public."user";
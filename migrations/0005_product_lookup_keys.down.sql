@@ -0,0 +1,13 @@
+ALTER TABLE public.product
+    ADD COLUMN type   TEXT,
+    ADD COLUMN status TEXT;
+
+UPDATE public.product p
+SET type   = (SELECT t.name FROM public.type t WHERE t.id = p.type_id),
+    status = (SELECT s.name FROM public.status s WHERE s.id = p.status_id);
+
+ALTER TABLE public.product
+    ALTER COLUMN type SET NOT NULL,
+    ALTER COLUMN status SET NOT NULL,
+    DROP COLUMN type_id,
+    DROP COLUMN status_id;
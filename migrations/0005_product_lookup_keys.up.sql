@@ -0,0 +1,31 @@
+-- Products pointed at type and status by name only. Names that aren't in the
+-- lookup tables yet are added first so every product gets an id, products
+-- without one end up as 'unknown'.
+
+INSERT INTO public.type (name)
+SELECT DISTINCT COALESCE(NULLIF(p.type, ''), 'unknown')
+FROM public.product p
+WHERE NOT EXISTS (SELECT 1 FROM public.type t WHERE t.name = COALESCE(NULLIF(p.type, ''), 'unknown'));
+
+INSERT INTO public.status (name)
+SELECT DISTINCT COALESCE(NULLIF(p.status, ''), 'unknown')
+FROM public.product p
+WHERE NOT EXISTS (SELECT 1 FROM public.status s WHERE s.name = COALESCE(NULLIF(p.status, ''), 'unknown'));
+
+ALTER TABLE public.product
+    ADD COLUMN type_id   INTEGER REFERENCES public.type (id),
+    ADD COLUMN status_id INTEGER REFERENCES public.status (id);
+
+-- MIN(id) because tables created by hand may hold the same name twice
+UPDATE public.product p
+SET type_id   = (SELECT MIN(t.id) FROM public.type t WHERE t.name = COALESCE(NULLIF(p.type, ''), 'unknown')),
+    status_id = (SELECT MIN(s.id) FROM public.status s WHERE s.name = COALESCE(NULLIF(p.status, ''), 'unknown'));
+
+ALTER TABLE public.product
+    ALTER COLUMN type_id SET NOT NULL,
+    ALTER COLUMN status_id SET NOT NULL,
+    DROP COLUMN type,
+    DROP COLUMN status;
+
+CREATE INDEX IF NOT EXISTS product_type_id_idx ON public.product (type_id);
+CREATE INDEX IF NOT EXISTS product_status_id_idx ON public.product (status_id);
@@ -0,0 +1,2 @@
+-- The lifecycle statuses stay, products may still point at them
+DROP TABLE IF EXISTS public.product_status_history;
@@ -0,0 +1,20 @@
+-- The statuses of the product lifecycle, see lifecycle.go for the transitions
+-- between them. Existing statuses with other names are kept.
+
+INSERT INTO public.status (name)
+SELECT v.name
+FROM (VALUES ('draft'), ('available'), ('reserved'), ('sold'), ('paid-out'), ('withdrawn'), ('returned')) v(name)
+WHERE NOT EXISTS (SELECT 1 FROM public.status s WHERE s.name = v.name);
+
+CREATE TABLE IF NOT EXISTS public.product_status_history (
+    id             SERIAL PRIMARY KEY,
+    product_id     INTEGER NOT NULL REFERENCES public.product (id) ON DELETE CASCADE,
+    from_status_id INTEGER REFERENCES public.status (id) ON DELETE SET NULL,
+    to_status_id   INTEGER NOT NULL REFERENCES public.status (id),
+    changed_by     INTEGER REFERENCES public.users (id) ON DELETE SET NULL,
+    note           TEXT NOT NULL DEFAULT '',
+    changed_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS product_status_history_product_idx
+    ON public.product_status_history (product_id, changed_at);
@@ -0,0 +1,2 @@
+-- Only the records go, the files stay in storage
+DROP TABLE IF EXISTS public.product_image;
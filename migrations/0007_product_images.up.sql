@@ -0,0 +1,18 @@
+-- Images uploaded through /product/:id/images, the files are in the storage
+-- configured under storage: and the keys point at them. Position is deferred
+-- so a reorder can swap two images inside one transaction.
+
+CREATE TABLE IF NOT EXISTS public.product_image (
+    id           SERIAL PRIMARY KEY,
+    product_id   INTEGER NOT NULL REFERENCES public.product (id) ON DELETE CASCADE,
+    position     INTEGER NOT NULL,
+    content_type TEXT NOT NULL,
+    size         BIGINT NOT NULL,
+    width        INTEGER NOT NULL,
+    height       INTEGER NOT NULL,
+    storage_key  TEXT NOT NULL UNIQUE,
+    web_key      TEXT NOT NULL,
+    thumb_key    TEXT NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT product_image_position_key UNIQUE (product_id, position) DEFERRABLE INITIALLY DEFERRED
+);
@@ -0,0 +1,10 @@
+-- pg_trgm stays installed, dropping an extension may break other users of it
+DROP TRIGGER IF EXISTS owner_search_rename ON public.owner;
+DROP TRIGGER IF EXISTS type_search_rename ON public.type;
+DROP TRIGGER IF EXISTS product_search_refresh ON public.product;
+DROP FUNCTION IF EXISTS public.product_search_rename();
+DROP FUNCTION IF EXISTS public.product_search_refresh();
+
+ALTER TABLE public.product
+    DROP COLUMN IF EXISTS search_vector,
+    DROP COLUMN IF EXISTS search_text;
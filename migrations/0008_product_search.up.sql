@@ -0,0 +1,63 @@
+-- Search columns for /product/search. search_vector holds the weighted words
+-- of the name, type, owner, description and defect, search_text the same text
+-- lowercased for trigram matching of typos and Thai, which has no spaces
+-- between words for the full text parser to split on. Both are kept up to
+-- date by triggers, also when a type or owner is renamed.
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE public.product
+    ADD COLUMN search_vector TSVECTOR,
+    ADD COLUMN search_text   TEXT;
+
+CREATE OR REPLACE FUNCTION public.product_search_refresh() RETURNS TRIGGER AS $$
+DECLARE
+    type_name  TEXT;
+    owner_name TEXT;
+BEGIN
+    SELECT name INTO type_name FROM public.type WHERE id = NEW.type_id;
+    SELECT name INTO owner_name FROM public.owner WHERE id = NEW.owner;
+
+    NEW.search_vector :=
+        setweight(to_tsvector('simple', coalesce(NEW.name, '')), 'A') ||
+        setweight(to_tsvector('simple', coalesce(type_name, '')), 'B') ||
+        setweight(to_tsvector('simple', coalesce(owner_name, '')), 'B') ||
+        setweight(to_tsvector('simple', coalesce(NEW.description, '')), 'C') ||
+        setweight(to_tsvector('simple', coalesce(NEW.defect, '')), 'D');
+    NEW.search_text := lower(concat_ws(' ', NEW.name, type_name, owner_name, NEW.description, NEW.defect));
+
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER product_search_refresh
+    BEFORE INSERT OR UPDATE OF name, description, defect, type_id, owner ON public.product
+    FOR EACH ROW EXECUTE FUNCTION public.product_search_refresh();
+
+-- Setting the key column to itself is enough to fire the trigger above
+CREATE OR REPLACE FUNCTION public.product_search_rename() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_TABLE_NAME = 'type' THEN
+        UPDATE public.product SET type_id = type_id WHERE type_id = NEW.id;
+    ELSE
+        UPDATE public.product SET owner = owner WHERE owner = NEW.id;
+    END IF;
+
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER type_search_rename
+    AFTER UPDATE OF name ON public.type
+    FOR EACH ROW WHEN (OLD.name IS DISTINCT FROM NEW.name)
+    EXECUTE FUNCTION public.product_search_rename();
+
+CREATE TRIGGER owner_search_rename
+    AFTER UPDATE OF name ON public.owner
+    FOR EACH ROW WHEN (OLD.name IS DISTINCT FROM NEW.name)
+    EXECUTE FUNCTION public.product_search_rename();
+
+UPDATE public.product SET name = name;
+
+CREATE INDEX product_search_vector_idx ON public.product USING GIN (search_vector);
+CREATE INDEX product_search_text_trgm_idx ON public.product USING GIN (search_text gin_trgm_ops);
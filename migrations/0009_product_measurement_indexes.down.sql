@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS public.product_price_idx;
+DROP INDEX IF EXISTS public.product_chest_idx;
+DROP INDEX IF EXISTS public.product_length_idx;
+DROP INDEX IF EXISTS public.product_waist_idx;
@@ -0,0 +1,7 @@
+-- Range and fits-me filters on /product/filter, partial like product_live_idx
+-- since deleted products are only listed to admins.
+
+CREATE INDEX IF NOT EXISTS product_waist_idx ON public.product (waist) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS product_length_idx ON public.product (length) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS product_chest_idx ON public.product (chest) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS product_price_idx ON public.product (price) WHERE deleted_at IS NULL;
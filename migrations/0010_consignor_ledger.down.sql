@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS public.owner_ledger;
+DROP TABLE IF EXISTS public.payout;
+DROP TABLE IF EXISTS public.payout_batch;
+ALTER TABLE public.owner DROP COLUMN IF EXISTS commission;
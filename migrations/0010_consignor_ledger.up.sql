@@ -0,0 +1,43 @@
+-- What the shop owes its consignors. Every sale writes the owner's share to
+-- owner_ledger, a return takes it back and a payout settles the open entries.
+-- Amounts are in the same units as product.price, positive is owed to the
+-- owner, and entries are never changed apart from being settled.
+
+ALTER TABLE public.owner ADD COLUMN IF NOT EXISTS commission INTEGER NOT NULL DEFAULT 30
+    CONSTRAINT owner_commission_check CHECK (commission BETWEEN 0 AND 100);
+
+CREATE TABLE IF NOT EXISTS public.payout_batch (
+    id         SERIAL PRIMARY KEY,
+    note       TEXT NOT NULL DEFAULT '',
+    created_by INTEGER REFERENCES public.users (id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS public.payout (
+    id         SERIAL PRIMARY KEY,
+    batch_id   INTEGER NOT NULL REFERENCES public.payout_batch (id),
+    owner_id   INTEGER NOT NULL REFERENCES public.owner (id),
+    amount     INTEGER NOT NULL CHECK (amount > 0),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (batch_id, owner_id)
+);
+
+CREATE INDEX IF NOT EXISTS payout_owner_idx ON public.payout (owner_id);
+
+CREATE TABLE IF NOT EXISTS public.owner_ledger (
+    id         SERIAL PRIMARY KEY,
+    owner_id   INTEGER NOT NULL REFERENCES public.owner (id),
+    product_id INTEGER REFERENCES public.product (id),
+    -- the payout that settled the entry, for a payout entry its own payout
+    payout_id  INTEGER REFERENCES public.payout (id),
+    kind       TEXT NOT NULL CHECK (kind IN ('sale', 'return', 'payout')),
+    sale_price INTEGER NOT NULL DEFAULT 0,
+    commission INTEGER NOT NULL DEFAULT 0,
+    amount     INTEGER NOT NULL,
+    note       TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS owner_ledger_owner_idx ON public.owner_ledger (owner_id, created_at);
+CREATE INDEX IF NOT EXISTS owner_ledger_open_idx ON public.owner_ledger (owner_id) WHERE payout_id IS NULL;
+CREATE INDEX IF NOT EXISTS owner_ledger_product_idx ON public.owner_ledger (product_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.withdrawal_request;
+ALTER TABLE public.owner DROP COLUMN IF EXISTS user_id;
@@ -0,0 +1,25 @@
+-- Lets a consignor sign in: an owner may be linked to one user account, who
+-- then sees that owner's products and ledger under /me/owner and can ask for
+-- unsold products back through withdrawal_request.
+
+ALTER TABLE public.owner ADD COLUMN IF NOT EXISTS user_id INTEGER
+    REFERENCES public.users (id) ON DELETE SET NULL
+    CONSTRAINT owner_user_id_key UNIQUE;
+
+CREATE TABLE IF NOT EXISTS public.withdrawal_request (
+    id            SERIAL PRIMARY KEY,
+    product_id    INTEGER NOT NULL REFERENCES public.product (id),
+    owner_id      INTEGER NOT NULL REFERENCES public.owner (id),
+    status        TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+    note          TEXT NOT NULL DEFAULT '',
+    requested_by  INTEGER REFERENCES public.users (id) ON DELETE SET NULL,
+    decided_by    INTEGER REFERENCES public.users (id) ON DELETE SET NULL,
+    decision_note TEXT NOT NULL DEFAULT '',
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    decided_at    TIMESTAMPTZ
+);
+
+-- One open request per product
+CREATE UNIQUE INDEX IF NOT EXISTS withdrawal_request_pending_key
+    ON public.withdrawal_request (product_id) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS withdrawal_request_owner_idx ON public.withdrawal_request (owner_id, created_at);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.order_status_history;
+DROP TABLE IF EXISTS public.order_item;
+DROP TABLE IF EXISTS public.orders;
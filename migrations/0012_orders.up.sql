@@ -0,0 +1,38 @@
+-- Orders placed through /checkout. Every product is one of a kind, so an item
+-- is a product and its price at checkout. "order" is reserved, hence orders.
+
+CREATE TABLE IF NOT EXISTS public.orders (
+    id         SERIAL PRIMARY KEY,
+    user_id    INTEGER REFERENCES public.users (id) ON DELETE SET NULL,
+    status     TEXT NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'paid', 'shipped', 'completed', 'cancelled')),
+    total      INTEGER NOT NULL,
+    note       TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS orders_user_idx ON public.orders (user_id, created_at);
+CREATE INDEX IF NOT EXISTS orders_status_idx ON public.orders (status);
+
+CREATE TABLE IF NOT EXISTS public.order_item (
+    id         SERIAL PRIMARY KEY,
+    order_id   INTEGER NOT NULL REFERENCES public.orders (id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES public.product (id),
+    price      INTEGER NOT NULL,
+    UNIQUE (order_id, product_id)
+);
+
+CREATE INDEX IF NOT EXISTS order_item_product_idx ON public.order_item (product_id);
+
+CREATE TABLE IF NOT EXISTS public.order_status_history (
+    id          SERIAL PRIMARY KEY,
+    order_id    INTEGER NOT NULL REFERENCES public.orders (id) ON DELETE CASCADE,
+    from_status TEXT NOT NULL DEFAULT '',
+    to_status   TEXT NOT NULL,
+    changed_by  INTEGER REFERENCES public.users (id) ON DELETE SET NULL,
+    note        TEXT NOT NULL DEFAULT '',
+    changed_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS order_status_history_order_idx ON public.order_status_history (order_id);
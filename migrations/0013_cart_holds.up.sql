@@ -0,0 +1,14 @@
+-- A customer's cart is the products they hold. A hold keeps a product out of
+-- everyone else's cart and checkout until expires_at; rows past it no longer
+-- count and are deleted by the sweeper. One hold per product at most.
+
+CREATE TABLE IF NOT EXISTS public.cart_hold (
+    product_id INTEGER PRIMARY KEY REFERENCES public.product (id) ON DELETE CASCADE,
+    user_id    INTEGER NOT NULL REFERENCES public.users (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    CHECK (expires_at > created_at)
+);
+
+CREATE INDEX IF NOT EXISTS cart_hold_user_idx ON public.cart_hold (user_id, created_at);
+CREATE INDEX IF NOT EXISTS cart_hold_expires_idx ON public.cart_hold (expires_at);
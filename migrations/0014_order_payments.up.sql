@@ -0,0 +1,14 @@
+-- The payment of an order, confirmed by staff from a slip or by the payment
+-- provider's webhook. A bank reference pays one order only, and an order is
+-- paid once, so a retried webhook can be told apart from a second payment.
+
+CREATE TABLE IF NOT EXISTS public.order_payment (
+    id           SERIAL PRIMARY KEY,
+    order_id     INTEGER NOT NULL UNIQUE REFERENCES public.orders (id) ON DELETE CASCADE,
+    amount       INTEGER NOT NULL CHECK (amount > 0),
+    source       TEXT NOT NULL CHECK (source IN ('staff', 'webhook')),
+    reference    TEXT NOT NULL UNIQUE,
+    confirmed_by INTEGER REFERENCES public.users (id) ON DELETE SET NULL,
+    note         TEXT NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// The states of an order. Checkout reserves the products, payment sells them
+// and a cancellation gives them back.
+const (
+	orderPending   = "pending"
+	orderPaid      = "paid"
+	orderShipped   = "shipped"
+	orderCompleted = "completed"
+	orderCancelled = "cancelled"
+)
+
+// maxOrderItems keeps a single checkout to a sensible number of row locks
+const maxOrderItems = 50
+
+// orderTransitions lists where an order may move from each state, completed
+// and cancelled are final. Only a confirmed payment moves an order to paid,
+// see checkOrderTransition.
+var orderTransitions = map[string][]string{
+	orderPending:   {orderPaid, orderCancelled},
+	orderPaid:      {orderShipped, orderCancelled},
+	orderShipped:   {orderCompleted},
+	orderCompleted: {},
+	orderCancelled: {},
+}
+
+// orderProductStatus tells where the products of an order move when the order
+// moves, false when they stay. Selling them writes the ledger like any sale.
+func orderProductStatus(from, to string) (string, bool) {
+	switch {
+	case to == orderPaid:
+		return statusSold, true
+	case to == orderCancelled && from == orderPending:
+		return statusAvailable, true
+	case to == orderCancelled && from == orderPaid:
+		return statusReturned, true
+	}
+	return "", false
+}
+
+// Order is a customer's purchase of one or more products. UserID is 0 when
+// the customer was deleted. History and Payment are only filled in for a
+// single order.
+type Order struct {
+	ID        int           `json:"id"`
+	UserID    int           `json:"userid"`
+	Status    string        `json:"status"`
+	Total     int           `json:"total"`
+	Note      string        `json:"note"`
+	Items     []OrderItem   `json:"items"`
+	History   []OrderChange `json:"history,omitempty"`
+	Payment   *OrderPayment `json:"payment,omitempty"`
+	CreatedAt string        `json:"createdat"`
+	UpdatedAt string        `json:"updatedat"`
+}
+
+// OrderItem is one product of an order. Every product is one of a kind, so
+// there is no quantity, and Price is what it cost at checkout.
+type OrderItem struct {
+	ID          int    `json:"id"`
+	ProductID   int    `json:"productid"`
+	ProductName string `json:"productname"`
+	Price       int    `json:"price"`
+}
+
+// OrderChange is one row of an order's status history, From is empty for
+// the checkout itself
+type OrderChange struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	ChangedBy int    `json:"changedby"`
+	Note      string `json:"note"`
+	ChangedAt string `json:"changedat"`
+}
+
+// Checkout is the body of POST /checkout
+type Checkout struct {
+	ProductIDs []int  `json:"productids"`
+	Note       string `json:"note"`
+}
+
+// OrderTransition is the body of POST /order/:id/status
+type OrderTransition struct {
+	Status string `json:"status"`
+	Note   string `json:"note"`
+}
+
+// OrderFilter narrows GET /order, zero values match everything
+type OrderFilter struct {
+	UserID int
+	Status string
+}
+
+func validateCheckout(c *Checkout) error {
+	v := &ValidationError{}
+
+	switch {
+	case len(c.ProductIDs) == 0:
+		v.add("productids", "must list at least one product")
+	case len(c.ProductIDs) > maxOrderItems:
+		v.add("productids", fmt.Sprintf("must list at most %d products", maxOrderItems))
+	}
+
+	seen := map[int]bool{}
+	for i, id := range c.ProductIDs {
+		if seen[id] {
+			v.add(fmt.Sprintf("productids[%d]", i), "is listed twice")
+		}
+		seen[id] = true
+	}
+
+	return v.err()
+}
+
+// checkoutOrder is the order products are locked in, so two checkouts for
+// the same products can't deadlock
+func checkoutOrder(ids []int) []int {
+	sorted := slices.Clone(ids)
+	slices.Sort(sorted)
+	return sorted
+}
+
+// checkOrderable only lets available products into an order
+func checkOrderable(p Product) error {
+	if p.Status != statusAvailable {
+		return conflictf("product %d is %s and can't be ordered", p.ID, p.Status)
+	}
+	return nil
+}
+
+// checkOrderHold keeps a product a pending order reserved with that order,
+// only moving the order moves it. holder is the order that reserved p, 0 when
+// none did, and orderID the order making the move, 0 for anyone else.
+func checkOrderHold(p Product, holder, orderID int) error {
+	if holder != 0 && holder != orderID {
+		return conflictf("product %d is reserved by order %d and only moves with that order", p.ID, holder)
+	}
+	return nil
+}
+
+func checkOrderTransition(id int, from, to string) error {
+	if _, ok := orderTransitions[to]; !ok {
+		v := &ValidationError{}
+		v.add("status", "must be one of "+strings.Join(orderStatuses(), ", "))
+		return v
+	}
+	if from == to {
+		return conflictf("order %d is already %s", id, to)
+	}
+	if to == orderPaid {
+		return conflictf("order %d is only paid by confirming its payment, see POST /order/%d/payment", id, id)
+	}
+	if !slices.Contains(orderTransitions[from], to) {
+		return conflictf("order %d can't move from %s to %s", id, from, to)
+	}
+	return nil
+}
+
+func checkOrderStatus(v *ValidationError, status string) {
+	if _, ok := orderTransitions[status]; status != "" && !ok {
+		v.add("status", "must be one of "+strings.Join(orderStatuses(), ", "))
+	}
+}
+
+func orderStatuses() []string {
+	return []string{orderPending, orderPaid, orderShipped, orderCompleted, orderCancelled}
+}
+
+// orderNote is the product history note of what an order did to it
+func orderNote(id int, note string) string {
+	if note == "" {
+		return fmt.Sprintf("order %d", id)
+	}
+	return fmt.Sprintf("order %d: %s", id, note)
+}
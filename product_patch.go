@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+type patchKind int
+
+const (
+	patchText patchKind = iota
+	patchInt
+	patchTextArray
+)
+
+type patchField struct {
+	column string
+	kind   patchKind
+	// nullable fields are reset to their empty value by an explicit null,
+	// the others can't be removed
+	nullable bool
+}
+
+// productPatchFields whitelists the JSON fields a PATCH may touch and the
+// column each one maps to. Nothing else ever reaches the SQL text. type and
+// typeid both write type_id, the same goes for status.
+var productPatchFields = map[string]patchField{
+	"name":        {column: "name", kind: patchText},
+	"description": {column: "description", kind: patchText, nullable: true},
+	"defect":      {column: "defect", kind: patchText, nullable: true},
+	"type":        {column: "type_id", kind: patchText},
+	"typeid":      {column: "type_id", kind: patchInt},
+	"waist":       {column: "waist", kind: patchInt},
+	"length":      {column: "length", kind: patchInt},
+	"chest":       {column: "chest", kind: patchInt},
+	"owner":       {column: "owner", kind: patchInt},
+	"status":      {column: "status_id", kind: patchText},
+	"statusid":    {column: "status_id", kind: patchInt},
+	"price":       {column: "price", kind: patchInt},
+	"saleprice":   {column: "saleprice", kind: patchInt},
+	"image":       {column: "image", kind: patchTextArray, nullable: true},
+}
+
+type columnValue struct {
+	field  string
+	column string
+	value  interface{}
+}
+
+// decodeProductPatch turns a JSON merge patch into the column updates it
+// describes. It only checks the JSON types, the values themselves are checked
+// by validateProduct once they are merged into the stored product.
+func decodeProductPatch(patch map[string]json.RawMessage) ([]columnValue, error) {
+	v := &ValidationError{}
+	var values []columnValue
+
+	keys := make([]string, 0, len(patch))
+	for k := range patch {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		raw := patch[key]
+
+		field, ok := productPatchFields[key]
+		if !ok {
+			v.add(key, "unknown or read-only field")
+			continue
+		}
+
+		if string(raw) == "null" {
+			if !field.nullable {
+				v.add(key, "can't be removed")
+				continue
+			}
+
+			switch field.kind {
+			case patchText:
+				values = append(values, columnValue{key, field.column, ""})
+			case patchTextArray:
+				values = append(values, columnValue{key, field.column, []string{}})
+			}
+			continue
+		}
+
+		switch field.kind {
+		case patchText:
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				v.add(key, "must be a string")
+				continue
+			}
+			values = append(values, columnValue{key, field.column, s})
+
+		case patchInt:
+			var n int
+			if err := json.Unmarshal(raw, &n); err != nil {
+				v.add(key, "must be an integer")
+				continue
+			}
+			values = append(values, columnValue{key, field.column, n})
+
+		case patchTextArray:
+			var arr []string
+			if err := json.Unmarshal(raw, &arr); err != nil {
+				v.add(key, "must be an array of strings")
+				continue
+			}
+			if arr == nil {
+				arr = []string{}
+			}
+			values = append(values, columnValue{key, field.column, arr})
+		}
+	}
+
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// applyProductPatch merges decoded patch values into a copy of the product.
+// Patching only the name or only the id of a type or status clears the other
+// one, validateProduct then looks it up again.
+func applyProductPatch(p Product, values []columnValue) Product {
+	fields := map[string]bool{}
+	for _, cv := range values {
+		fields[cv.field] = true
+	}
+
+	if fields["type"] && !fields["typeid"] {
+		p.TypeID = 0
+	}
+	if fields["typeid"] && !fields["type"] {
+		p.Type = ""
+	}
+	if fields["status"] && !fields["statusid"] {
+		p.StatusID = 0
+	}
+	if fields["statusid"] && !fields["status"] {
+		p.Status = ""
+	}
+
+	for _, cv := range values {
+		switch cv.field {
+		case "name":
+			p.Name = cv.value.(string)
+		case "description":
+			p.Description = cv.value.(string)
+		case "defect":
+			p.Defect = cv.value.(string)
+		case "type":
+			p.Type = cv.value.(string)
+		case "typeid":
+			p.TypeID = cv.value.(int)
+		case "status":
+			p.Status = cv.value.(string)
+		case "statusid":
+			p.StatusID = cv.value.(int)
+		case "waist":
+			p.Waist = cv.value.(int)
+		case "length":
+			p.Length = cv.value.(int)
+		case "chest":
+			p.Chest = cv.value.(int)
+		case "owner":
+			p.Owner = cv.value.(int)
+		case "price":
+			p.Price = cv.value.(int)
+		case "saleprice":
+			p.SalePrice = cv.value.(int)
+		case "image":
+			p.Image = cv.value.([]string)
+		}
+	}
+
+	return p
+}
+
+// productColumn returns what a validated product stores in a column, so the
+// UPDATE writes the resolved type_id even when the patch only named the type.
+func productColumn(p *Product, column string) interface{} {
+	switch column {
+	case "name":
+		return p.Name
+	case "description":
+		return p.Description
+	case "defect":
+		return p.Defect
+	case "type_id":
+		return p.TypeID
+	case "status_id":
+		return p.StatusID
+	case "waist":
+		return p.Waist
+	case "length":
+		return p.Length
+	case "chest":
+		return p.Chest
+	case "owner":
+		return p.Owner
+	case "price":
+		return p.Price
+	case "saleprice":
+		return p.SalePrice
+	case "image":
+		return p.Image
+	}
+
+	return nil
+}
+
+// patchedFields lists the fields whose errors a PATCH should report. Rows
+// created before validation existed may break rules on fields the client
+// didn't touch, those shouldn't block an unrelated change.
+func patchedFields(values []columnValue) map[string]bool {
+	fields := map[string]bool{}
+	for _, cv := range values {
+		fields[cv.field] = true
+	}
+
+	// price and saleprice are checked against each other
+	if fields["price"] || fields["saleprice"] {
+		fields["price"] = true
+		fields["saleprice"] = true
+	}
+
+	// errors about typeid and statusid are reported on type and status
+	if fields["typeid"] {
+		fields["type"] = true
+	}
+	if fields["statusid"] {
+		fields["status"] = true
+	}
+
+	return fields
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// The webhook drivers, see newPaymentWebhook
+const (
+	webhookDriverHMAC  = "hmac"
+	webhookDriverLocal = "local"
+)
+
+// webhookSignatureHeader carries the hex HMAC-SHA256 of the webhook body,
+// optionally prefixed with "sha256="
+const webhookSignatureHeader = "X-Signature"
+
+// The payment sources, who told us the money arrived
+const (
+	paymentSourceStaff   = "staff"
+	paymentSourceWebhook = "webhook"
+)
+
+// maxPaymentReference is longer than any bank transaction reference we've seen
+const maxPaymentReference = 100
+
+// promptPayAID is the application id of a PromptPay credit transfer
+const promptPayAID = "A000000677010111"
+
+var errPromptPayOff error = &DomainError{Kind: ErrConflict, Message: "PromptPay payments aren't set up"}
+
+// PromptPayQR is the body of GET /me/orders/:id/promptpay, Payload is what
+// the QR code encodes
+type PromptPayQR struct {
+	OrderID int    `json:"orderid"`
+	Amount  int    `json:"amount"`
+	Payload string `json:"payload"`
+}
+
+// OrderPayment is the money that paid for an order. Reference is the bank's
+// or provider's transaction reference, each one pays one order only.
+// ConfirmedBy is 0 for the webhook and when the user was deleted.
+type OrderPayment struct {
+	ID          int    `json:"id"`
+	OrderID     int    `json:"orderid"`
+	Amount      int    `json:"amount"`
+	Source      string `json:"source"`
+	Reference   string `json:"reference"`
+	ConfirmedBy int    `json:"confirmedby"`
+	Note        string `json:"note"`
+	CreatedAt   string `json:"createdat"`
+}
+
+// PaymentConfirmation is the body of POST /order/:id/payment and of the
+// webhook, which names the order itself. Source is filled in by the handler.
+type PaymentConfirmation struct {
+	OrderID   int    `json:"orderid"`
+	Amount    int    `json:"amount"`
+	Reference string `json:"reference"`
+	Note      string `json:"note"`
+	Source    string `json:"-"`
+}
+
+// PaymentWebhook reads the payment out of a provider's notification, after
+// making sure the provider sent it
+type PaymentWebhook interface {
+	Verify(signature string, body []byte) (PaymentConfirmation, error)
+}
+
+// hmacWebhook accepts bodies signed with the shared secret. Without a secret
+// nothing is accepted.
+type hmacWebhook struct {
+	secret []byte
+}
+
+// localWebhook stands in for a provider during development, anyone who can
+// reach it can mark orders paid
+type localWebhook struct{}
+
+func newPaymentWebhook(c PromptPayConfig) PaymentWebhook {
+	if c.WebhookDriver == webhookDriverLocal {
+		return localWebhook{}
+	}
+	return hmacWebhook{secret: []byte(c.WebhookSecret)}
+}
+
+func (w hmacWebhook) Verify(signature string, body []byte) (PaymentConfirmation, error) {
+	if len(w.secret) == 0 {
+		return PaymentConfirmation{}, unauthorized("payment webhook is not set up")
+	}
+
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return PaymentConfirmation{}, unauthorized("invalid webhook signature")
+	}
+
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return PaymentConfirmation{}, unauthorized("invalid webhook signature")
+	}
+
+	return parseWebhookBody(body)
+}
+
+func (localWebhook) Verify(signature string, body []byte) (PaymentConfirmation, error) {
+	return parseWebhookBody(body)
+}
+
+func parseWebhookBody(body []byte) (PaymentConfirmation, error) {
+	var payment PaymentConfirmation
+	if err := json.Unmarshal(body, &payment); err != nil {
+		return PaymentConfirmation{}, badRequest("Invalid request body")
+	}
+	payment.Source = paymentSourceWebhook
+	return payment, nil
+}
+
+func validatePaymentConfirmation(p *PaymentConfirmation) error {
+	v := &ValidationError{}
+
+	if p.OrderID <= 0 {
+		v.add("orderid", "is required")
+	}
+	if p.Amount <= 0 {
+		v.add("amount", "must be greater than 0")
+	}
+	if strings.TrimSpace(p.Reference) == "" {
+		v.add("reference", "is required")
+	}
+	if utf8.RuneCountInString(p.Reference) > maxPaymentReference {
+		v.add("reference", fmt.Sprintf("must be at most %d characters", maxPaymentReference))
+	}
+
+	return v.err()
+}
+
+// checkPayment tells whether the payment may pay order o. Reporting the same
+// reference again is not an error but done is true, so a webhook retry gets
+// the order back instead of a conflict.
+func checkPayment(o Order, payment PaymentConfirmation) (done bool, err error) {
+	if o.Payment != nil {
+		if o.Payment.Reference == payment.Reference {
+			return true, nil
+		}
+		return false, conflictf("order %d is already paid", o.ID)
+	}
+	if o.Status != orderPending {
+		return false, conflictf("order %d is %s and can't be paid", o.ID, o.Status)
+	}
+	if payment.Amount != o.Total {
+		return false, conflictf("payment of %d doesn't match the order total of %d", payment.Amount, o.Total)
+	}
+	return false, nil
+}
+
+// paymentTransition is what confirming a payment does to its order
+func paymentTransition(payment PaymentConfirmation) OrderTransition {
+	note := "PromptPay " + payment.Reference
+	if payment.Note != "" {
+		note += ": " + payment.Note
+	}
+	return OrderTransition{Status: orderPaid, Note: note}
+}
+
+// promptPayPayload builds the EMVCo merchant presented QR payload that makes
+// a banking app transfer amount baht to target
+func promptPayPayload(target string, amount int) (string, error) {
+	account, err := promptPayAccount(target)
+	if err != nil {
+		return "", err
+	}
+
+	payload := emvField("00", "01") + // payload format indicator
+		emvField("01", "12") + // dynamic, used once for this amount
+		emvField("29", emvField("00", promptPayAID)+account) +
+		emvField("53", "764") + // THB
+		emvField("54", fmt.Sprintf("%d.00", amount)) +
+		emvField("58", "TH") +
+		"6304" // the CRC covers its own id and length
+
+	return payload + fmt.Sprintf("%04X", crc16CCITT([]byte(payload))), nil
+}
+
+// promptPayAccount is the account sub-field of the PromptPay target: a
+// mobile number as 0066 and the number without its leading 0, a 13 digit
+// national or tax id or a 15 digit e-wallet id
+func promptPayAccount(target string) (string, error) {
+	digits := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, target)
+
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return "", fmt.Errorf("PromptPay id %q must only have digits", target)
+		}
+	}
+
+	switch {
+	case len(digits) == 10 && digits[0] == '0':
+		return emvField("01", "0066"+digits[1:]), nil
+	case len(digits) == 13:
+		return emvField("02", digits), nil
+	case len(digits) == 15:
+		return emvField("03", digits), nil
+	}
+	return "", fmt.Errorf("PromptPay id %q must be a 10 digit mobile number, a 13 digit id or a 15 digit e-wallet id", target)
+}
+
+// emvField is one id, length, value field of an EMVCo payload
+func emvField(id, value string) string {
+	return fmt.Sprintf("%s%02d%s", id, len(value), value)
+}
+
+// crc16CCITT is the CRC-16/CCITT-FALSE checksum EMVCo payloads end with
+func crc16CCITT(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
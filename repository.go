@@ -0,0 +1,204 @@
+package main
+
+import "time"
+
+// ProductRepository is everything the product handlers need from storage.
+// Not found rows come back as ErrNotFound, version mismatches as
+// ErrPreconditionFailed and invalid payloads as *ValidationError.
+type ProductRepository interface {
+	List(limit, offset int, includeDeleted bool) ([]Product, int, error)
+	// ListFiltered returns a page of the products matching filter, ordered by
+	// id or, in fits-me mode, by closeness of fit
+	ListFiltered(filter ProductFilter, limit, offset int) ([]Product, int, error)
+	// Search returns a page of matching products, the total and which search
+	// mode found them, searchModeFullText or searchModeFuzzy
+	Search(query string, limit, offset int) ([]ProductSearchResult, int, string, error)
+	Get(id int, includeDeleted bool) (Product, error)
+	// Create refuses products that don't start the lifecycle as draft or available
+	Create(product *Product) error
+	// Update overwrites a product, expectedVersion 0 skips the version check.
+	// Neither Update, Patch nor UpdateMany may change the status.
+	Update(id int, product *Product, expectedVersion int) (Product, error)
+	// Patch merges the values into the stored product and validates the result
+	Patch(id int, values []columnValue, expectedVersion int) (Product, error)
+	UpdateMany(products []Product, mode string) ([]BulkUpdateResult, bool, error)
+	// Delete returns ErrConflict unless the product is draft, available or
+	// withdrawn, so no open order loses its products
+	Delete(id int) error
+	Restore(id int) (Product, error)
+	// Transition moves a product along the lifecycle in lifecycle.go and
+	// records the change, an illegal move returns ErrConflict. userID 0 means
+	// the change isn't tied to a user. Moving to sold writes the owner's share
+	// to the ledger and moving from sold to returned takes it back. Moving
+	// away from available ends any hold on the product.
+	Transition(id int, change StatusTransition, userID int, expectedVersion int) (Product, error)
+	// History returns the status changes of a product, oldest first
+	History(id int) ([]StatusChange, error)
+}
+
+// OwnerRepository returns ErrConflict from Create and Update when the user
+// is already linked to another owner.
+type OwnerRepository interface {
+	List() ([]Owner, error)
+	Get(id int) (Owner, error)
+	// FindByUser returns the owner linked to a user account, ErrNotFound when
+	// there is none
+	FindByUser(userID int) (Owner, error)
+	Create(owner *Owner) error
+	Update(id int, owner *Owner) (Owner, error)
+}
+
+// RefreshToken is the server side record of a refresh token, only its hash is stored
+type RefreshToken struct {
+	UserID    int
+	FamilyID  string
+	Hash      string
+	ExpiresAt time.Time
+}
+
+// UserRepository never returns the stored password except from FindByEmail.
+// Passwords passed in must already be hashed.
+type UserRepository interface {
+	List() ([]User, error)
+	Get(id int) (User, error)
+	// Create stores a new user, a taken email returns errEmailTaken
+	Create(user *User) (User, error)
+	// Update overwrites every field of a user, the password only when it isn't empty
+	Update(id int, user *User) (User, error)
+	Delete(id int) error
+	// FindByEmail returns the login account including the stored password
+	FindByEmail(email string) (User, error)
+	SetPassword(id int, hash string) error
+
+	CreateRefreshToken(token RefreshToken) error
+	// RotateRefreshToken marks the token with oldHash as used and stores next
+	// in the same family, it returns the owner and next as stored. Reusing a
+	// token that was already rotated revokes the whole family and returns
+	// errInvalidRefreshToken.
+	RotateRefreshToken(oldHash string, next RefreshToken) (User, RefreshToken, error)
+	// RevokeSession revokes a refresh token family and denylists one access token
+	RevokeSession(family, jti string, expiresAt time.Time) error
+	RevokeUserSessions(userID int) error
+	IsAccessTokenRevoked(jti, family string) (bool, error)
+}
+
+type LookupRepository interface {
+	ListTypes() ([]Type, error)
+	GetType(id int) (Type, error)
+	CreateType(name string) (Type, error)
+	UpdateType(id int, name string) (Type, error)
+	// DeleteType refuses with ErrConflict while products still use the type
+	DeleteType(id int) error
+
+	ListStatuses() ([]Status, error)
+	GetStatus(id int) (Status, error)
+	CreateStatus(name string) (Status, error)
+	// UpdateStatus refuses with ErrConflict to rename a lifecycle status
+	UpdateStatus(id int, name string) (Status, error)
+	// DeleteStatus refuses with ErrConflict while products still use the
+	// status and for the lifecycle statuses
+	DeleteStatus(id int) error
+
+	// ProductReferences looks up the rows a product points at. Type and status
+	// are found by id when one is set and by name otherwise.
+	ProductReferences(p *Product) (ProductRefs, error)
+}
+
+// ImageRepository keeps the records of uploaded product images, the files
+// themselves live in a Storage. Every method returns ErrNotFound for a
+// product that doesn't exist or is deleted.
+type ImageRepository interface {
+	// List returns the images of a product in display order
+	List(productID int) ([]ProductImage, error)
+	// Add appends the images after the existing ones and returns them as stored
+	Add(productID int, images []ProductImage) ([]ProductImage, error)
+	// Reorder takes every image id of the product in the new order, anything
+	// else is a *ValidationError
+	Reorder(productID int, order []int) ([]ProductImage, error)
+	// Delete removes one image and returns it, so its files can be deleted too
+	Delete(productID, imageID int) (ProductImage, error)
+}
+
+// LedgerRepository reads what the shop owes its owners and pays it out, the
+// entries themselves are written by ProductRepository.Transition.
+type LedgerRepository interface {
+	// Balance and Statements return ErrNotFound for an unknown owner
+	Balance(ownerID int) (OwnerBalance, error)
+	Statements(ownerID int) ([]OwnerStatement, error)
+	// CreatePayoutBatch pays every requested owner with a positive balance and
+	// moves the products it settles from sold to paid-out. It returns
+	// ErrConflict when nobody has anything to be paid.
+	CreatePayoutBatch(req PayoutRequest, userID int) (PayoutBatch, error)
+	GetPayoutBatch(id int) (PayoutBatch, error)
+}
+
+// WithdrawalRepository keeps the requests consignors make to get unsold
+// products back.
+type WithdrawalRepository interface {
+	// Create returns ErrNotFound when the product doesn't belong to the owner,
+	// so a consignor can't learn about other owners' products, and
+	// ErrConflict when it can't be withdrawn or a request is already pending
+	Create(ownerID int, req NewWithdrawal, userID int) (WithdrawalRequest, error)
+	// List returns requests newest first, ownerID 0 and status "" match all
+	List(ownerID int, status string) ([]WithdrawalRequest, error)
+	// Decide approves or rejects a pending request, approving withdraws the
+	// product like ProductRepository.Transition in the same transaction
+	Decide(id int, approve bool, decision WithdrawalDecision, userID int) (WithdrawalRequest, error)
+}
+
+// OrderRepository keeps the orders placed through checkout. The products of
+// an order move through the lifecycle with it, like
+// ProductRepository.Transition and in the same transaction.
+type OrderRepository interface {
+	// Checkout reserves every product and creates a pending order, or does
+	// nothing when any of them isn't available: ErrNotFound for a product
+	// that doesn't exist and ErrConflict for one that isn't available or is
+	// held by another customer. The customer's own holds on them end.
+	Checkout(userID int, checkout Checkout) (Order, error)
+	// Get includes the status history and payment of the order
+	Get(id int) (Order, error)
+	// List returns a page of orders newest first and the total
+	List(filter OrderFilter, limit, offset int) ([]Order, int, error)
+	// Transition moves an order along orderTransitions in orders.go, an
+	// illegal move returns ErrConflict
+	Transition(id int, change OrderTransition, userID int) (Order, error)
+	// ConfirmPayment records the payment of a pending order and moves it to
+	// paid in the same transaction, see checkPayment in promptpay.go.
+	// Confirming the same reference again returns the order as it is.
+	ConfirmPayment(id int, payment PaymentConfirmation, userID int) (Order, error)
+}
+
+// CartRepository keeps the products customers hold in their carts. A hold
+// only counts until it expires, whether or not it has been swept yet.
+type CartRepository interface {
+	Get(userID int) (Cart, error)
+	// Add holds an available product for ttl, ErrConflict when it isn't
+	// available, is held already or the cart is full
+	Add(userID, productID int, ttl time.Duration) (Cart, error)
+	// Remove ends a hold of the user, ErrNotFound when they don't hold it
+	Remove(userID, productID int) (Cart, error)
+	// ReleaseExpired deletes the holds that have run out and returns how many
+	ReleaseExpired() (int, error)
+}
+
+// ProductRefs holds the rows found for a product, zero values for the ones
+// that don't exist.
+type ProductRefs struct {
+	Type   Type
+	Status Status
+	Owner  bool
+}
+
+// Store groups the repositories so they can be swapped together, Postgres
+// when serving and the in-memory store in tests.
+type Store struct {
+	Products    ProductRepository
+	Owners      OwnerRepository
+	Users       UserRepository
+	Lookups     LookupRepository
+	Images      ImageRepository
+	Ledger      LedgerRepository
+	Withdrawals WithdrawalRepository
+	Orders      OrderRepository
+	Carts       CartRepository
+}
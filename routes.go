@@ -0,0 +1,139 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+)
+
+func newApp(store Store, files Storage) *fiber.App {
+	app := fiber.New(fiber.Config{
+		ErrorHandler: errorHandler,
+		// Room for a full image upload, the handlers check every file again
+		BodyLimit: maxImagesPerUpload*maxImageBytes + 1<<20,
+	})
+
+	app.Use(requestid.New())
+
+	// Browsers only let the frontend read ETag when it is exposed
+	app.Use(cors.New(cors.Config{
+		ExposeHeaders: fiber.HeaderETag,
+	}))
+
+	if local, ok := files.(*localStorage); ok {
+		app.Static(localStoragePath, local.dir)
+	}
+
+	setupRoutes(app, store, files)
+
+	return app
+}
+
+// setupRoutes registers every route exactly once under /api/v1. Protected
+// routes get the JWT middleware per route instead of through a group, so a
+// public route can't accidentally shadow a protected one with the same path.
+func setupRoutes(app *fiber.App, store Store, files Storage) {
+	auth := newJWTMiddleware(store.Users)
+	optionalAuth := newOptionalJWTMiddleware(store.Users)
+	staff := requireRole(roleAdmin, roleStaff)
+	admin := requireRole(roleAdmin)
+	consignorRole := requireRole(roleConsignor)
+
+	users := &authHandler{users: store.Users}
+	products := &productHandler{products: store.Products, lookups: store.Lookups}
+	owners := &ownerHandler{owners: store.Owners, users: store.Users, ledger: store.Ledger}
+	consignor := &consignorHandler{products: store.Products, ledger: store.Ledger, withdrawals: store.Withdrawals}
+	withdrawals := &withdrawalHandler{withdrawals: store.Withdrawals}
+	orders := &orderHandler{orders: store.Orders, webhook: newPaymentWebhook(cfg.PromptPay)}
+	carts := &cartHandler{carts: store.Carts, orders: store.Orders}
+	payouts := &payoutHandler{ledger: store.Ledger}
+	lookups := &lookupHandler{lookups: store.Lookups}
+	images := &imageHandler{images: store.Images, files: files}
+
+	api := app.Group("/api/v1")
+
+	api.Post("/login", users.loginHandler)
+	api.Post("/register", users.registerHandler)
+	api.Post("/refresh", users.refreshHandler)
+	api.Post("/logout", auth, users.logoutHandler)
+	api.Get("/me", auth, users.getMeHandler)
+	api.Put("/me", auth, users.updateMeHandler)
+
+	// A consignor only ever sees the owner their account is linked to
+	ownAccount := requireOwnerAccount(store.Owners)
+	api.Get("/me/owner", auth, consignorRole, ownAccount, consignor.getMyOwnerHandler)
+	api.Get("/me/owner/products", auth, consignorRole, ownAccount, consignor.getMyProductsHandler)
+	api.Get("/me/owner/balance", auth, consignorRole, ownAccount, consignor.getMyBalanceHandler)
+	api.Get("/me/owner/statements", auth, consignorRole, ownAccount, consignor.getMyStatementsHandler)
+	api.Get("/me/owner/withdrawals", auth, consignorRole, ownAccount, consignor.getMyWithdrawalsHandler)
+	api.Post("/me/owner/withdrawals", auth, consignorRole, ownAccount, consignor.createWithdrawalHandler)
+
+	api.Get("/me/cart", auth, carts.getMyCartHandler)
+	api.Post("/me/cart", auth, carts.addToCartHandler)
+	api.Delete("/me/cart/:productid", auth, carts.removeFromCartHandler)
+	api.Post("/me/cart/checkout", auth, carts.checkoutCartHandler)
+
+	api.Post("/checkout", auth, orders.checkoutHandler)
+	api.Get("/me/orders", auth, orders.getMyOrdersHandler)
+	api.Get("/me/orders/:id", auth, orders.getMyOrderHandler)
+	api.Post("/me/orders/:id/cancel", auth, orders.cancelMyOrderHandler)
+	api.Get("/me/orders/:id/promptpay", auth, orders.getMyPromptPayHandler)
+	api.Get("/me/orders/:id/promptpay.png", auth, orders.getMyPromptPayPNGHandler)
+
+	// The provider signs its requests instead of sending a token
+	api.Post("/payment/promptpay/webhook", orders.promptPayWebhookHandler)
+
+	api.Get("/product", optionalAuth, products.getProductsHandler)
+	api.Get("/product/filter", optionalAuth, products.getProductWithFilterHandler)
+	api.Get("/product/search", products.searchProductsHandler)
+	api.Get("/product/:id", optionalAuth, products.getProductByIdHandle)
+	api.Post("/product", auth, staff, products.createProductHandler)
+	api.Put("/product", auth, staff, products.updateMultipleProductsHandle)
+	api.Put("/product/:id", auth, staff, products.updateProductHandle)
+	api.Patch("/product/:id", auth, staff, products.patchProductHandler)
+	api.Delete("/product/:id", auth, admin, products.deleteProductHandler)
+	api.Post("/product/:id/restore", auth, admin, products.restoreProductHandler)
+	api.Post("/product/:id/transition", auth, staff, products.transitionProductHandler)
+	api.Get("/product/:id/history", auth, staff, products.getProductHistoryHandler)
+	api.Get("/product/:id/images", images.getImagesHandler)
+	api.Post("/product/:id/images", auth, staff, images.uploadImagesHandler)
+	api.Put("/product/:id/images", auth, staff, images.reorderImagesHandler)
+	api.Delete("/product/:id/images/:imageid", auth, staff, images.deleteImageHandler)
+
+	api.Get("/owner", auth, staff, owners.getOwnersHandler)
+	api.Post("/owner", auth, admin, owners.createOwnerHandler)
+	api.Put("/owner/:id", auth, admin, owners.updateOwnerHandler)
+	api.Get("/owner/:id/balance", auth, staff, owners.getOwnerBalanceHandler)
+	api.Get("/owner/:id/statements", auth, staff, owners.getOwnerStatementsHandler)
+
+	api.Post("/payout", auth, admin, payouts.createPayoutBatchHandler)
+	api.Get("/payout/:id", auth, admin, payouts.getPayoutBatchHandler)
+
+	api.Get("/withdrawal", auth, staff, withdrawals.getWithdrawalsHandler)
+	api.Post("/withdrawal/:id/approve", auth, staff, withdrawals.approveWithdrawalHandler)
+	api.Post("/withdrawal/:id/reject", auth, staff, withdrawals.rejectWithdrawalHandler)
+
+	api.Get("/order", auth, staff, orders.getOrdersHandler)
+	api.Get("/order/:id", auth, staff, orders.getOrderHandler)
+	api.Post("/order/:id/status", auth, staff, orders.transitionOrderHandler)
+	api.Post("/order/:id/payment", auth, staff, orders.confirmPaymentHandler)
+
+	api.Get("/type", lookups.getTypesHandler)
+	api.Get("/type/:id", lookups.getTypeHandler)
+	api.Post("/type", auth, admin, lookups.createTypeHandler)
+	api.Put("/type/:id", auth, admin, lookups.updateTypeHandler)
+	api.Delete("/type/:id", auth, admin, lookups.deleteTypeHandler)
+
+	api.Get("/status", lookups.getStatusHandler)
+	api.Get("/status/:id", lookups.getStatusByIdHandler)
+	api.Post("/status", auth, admin, lookups.createStatusHandler)
+	api.Put("/status/:id", auth, admin, lookups.updateStatusHandler)
+	api.Delete("/status/:id", auth, admin, lookups.deleteStatusHandler)
+
+	api.Get("/users", auth, admin, users.getUsersHandler)
+	api.Post("/users", auth, admin, users.createUserHandler)
+	api.Get("/users/:id", auth, admin, users.getUserHandler)
+	api.Put("/users/:id", auth, admin, users.updateUserHandler)
+	api.Delete("/users/:id", auth, admin, users.deleteUserHandler)
+	api.Post("/users/:id/revoke", auth, admin, users.revokeUserSessionsHandler)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/lib/pq"
+)
+
+type routeCase struct {
+	method string
+	path   string
+	auth   bool
+}
+
+// routeTable lists every route the API exposes and whether it needs a token.
+// TestEveryRouteIsListed fails when a route is added without updating it.
+var routeTable = []routeCase{
+	{fiber.MethodPost, "/api/v1/login", false},
+	{fiber.MethodPost, "/api/v1/register", false},
+	{fiber.MethodPost, "/api/v1/refresh", false},
+	{fiber.MethodPost, "/api/v1/logout", true},
+	{fiber.MethodGet, "/api/v1/me", true},
+	{fiber.MethodPut, "/api/v1/me", true},
+	{fiber.MethodGet, "/api/v1/me/owner", true},
+	{fiber.MethodGet, "/api/v1/me/owner/products", true},
+	{fiber.MethodGet, "/api/v1/me/owner/balance", true},
+	{fiber.MethodGet, "/api/v1/me/owner/statements", true},
+	{fiber.MethodGet, "/api/v1/me/owner/withdrawals", true},
+	{fiber.MethodPost, "/api/v1/me/owner/withdrawals", true},
+
+	{fiber.MethodGet, "/api/v1/me/cart", true},
+	{fiber.MethodPost, "/api/v1/me/cart", true},
+	{fiber.MethodDelete, "/api/v1/me/cart/:productid", true},
+	{fiber.MethodPost, "/api/v1/me/cart/checkout", true},
+	{fiber.MethodPost, "/api/v1/checkout", true},
+	{fiber.MethodGet, "/api/v1/me/orders", true},
+	{fiber.MethodGet, "/api/v1/me/orders/:id", true},
+	{fiber.MethodPost, "/api/v1/me/orders/:id/cancel", true},
+	{fiber.MethodGet, "/api/v1/me/orders/:id/promptpay", true},
+	{fiber.MethodGet, "/api/v1/me/orders/:id/promptpay.png", true},
+
+	{fiber.MethodGet, "/api/v1/product", false},
+	{fiber.MethodGet, "/api/v1/product/filter", false},
+	{fiber.MethodGet, "/api/v1/product/search", false},
+	{fiber.MethodGet, "/api/v1/product/:id", false},
+	{fiber.MethodPost, "/api/v1/product", true},
+	{fiber.MethodPut, "/api/v1/product", true},
+	{fiber.MethodPut, "/api/v1/product/:id", true},
+	{fiber.MethodPatch, "/api/v1/product/:id", true},
+	{fiber.MethodDelete, "/api/v1/product/:id", true},
+	{fiber.MethodPost, "/api/v1/product/:id/restore", true},
+	{fiber.MethodPost, "/api/v1/product/:id/transition", true},
+	{fiber.MethodGet, "/api/v1/product/:id/history", true},
+	{fiber.MethodGet, "/api/v1/product/:id/images", false},
+	{fiber.MethodPost, "/api/v1/product/:id/images", true},
+	{fiber.MethodPut, "/api/v1/product/:id/images", true},
+	{fiber.MethodDelete, "/api/v1/product/:id/images/:imageid", true},
+
+	{fiber.MethodGet, "/api/v1/owner", true},
+	{fiber.MethodPost, "/api/v1/owner", true},
+	{fiber.MethodPut, "/api/v1/owner/:id", true},
+	{fiber.MethodGet, "/api/v1/owner/:id/balance", true},
+	{fiber.MethodGet, "/api/v1/owner/:id/statements", true},
+
+	{fiber.MethodPost, "/api/v1/payout", true},
+	{fiber.MethodGet, "/api/v1/payout/:id", true},
+
+	{fiber.MethodGet, "/api/v1/withdrawal", true},
+	{fiber.MethodPost, "/api/v1/withdrawal/:id/approve", true},
+	{fiber.MethodPost, "/api/v1/withdrawal/:id/reject", true},
+
+	{fiber.MethodGet, "/api/v1/order", true},
+	{fiber.MethodGet, "/api/v1/order/:id", true},
+	{fiber.MethodPost, "/api/v1/order/:id/status", true},
+	{fiber.MethodPost, "/api/v1/order/:id/payment", true},
+	{fiber.MethodPost, "/api/v1/payment/promptpay/webhook", false},
+
+	{fiber.MethodGet, "/api/v1/type", false},
+	{fiber.MethodGet, "/api/v1/type/:id", false},
+	{fiber.MethodPost, "/api/v1/type", true},
+	{fiber.MethodPut, "/api/v1/type/:id", true},
+	{fiber.MethodDelete, "/api/v1/type/:id", true},
+
+	{fiber.MethodGet, "/api/v1/status", false},
+	{fiber.MethodGet, "/api/v1/status/:id", false},
+	{fiber.MethodPost, "/api/v1/status", true},
+	{fiber.MethodPut, "/api/v1/status/:id", true},
+	{fiber.MethodDelete, "/api/v1/status/:id", true},
+
+	{fiber.MethodGet, "/api/v1/users", true},
+	{fiber.MethodPost, "/api/v1/users", true},
+	{fiber.MethodGet, "/api/v1/users/:id", true},
+	{fiber.MethodPut, "/api/v1/users/:id", true},
+	{fiber.MethodDelete, "/api/v1/users/:id", true},
+	{fiber.MethodPost, "/api/v1/users/:id/revoke", true},
+}
+
+func newTestApp(t *testing.T) *fiber.App {
+	t.Helper()
+
+	return newTestAppWithStore(t, newMemoryStore())
+}
+
+func newTestAppWithStore(t *testing.T, m *memoryStore) *fiber.App {
+	t.Helper()
+
+	return newTestAppWithFiles(t, m, newLocalStorage(t.TempDir(), localStoragePath))
+}
+
+func newTestAppWithFiles(t *testing.T, m *memoryStore, files Storage) *fiber.App {
+	t.Helper()
+
+	cfg = defaultConfig()
+	jwtSecret = []byte("test_secret")
+
+	return newApp(m.Store(), files)
+}
+
+func requestPath(path string) string {
+	return strings.ReplaceAll(path, ":id", "1")
+}
+
+func TestEveryRouteIsListed(t *testing.T) {
+	app := newTestApp(t)
+
+	listed := map[string]bool{}
+	for _, rc := range routeTable {
+		listed[rc.method+" "+rc.path] = true
+	}
+
+	for _, r := range app.GetRoutes(true) {
+		if r.Method == fiber.MethodHead {
+			continue
+		}
+		if !listed[r.Method+" "+r.Path] {
+			t.Errorf("route %s %s is not in routeTable", r.Method, r.Path)
+		}
+	}
+}
+
+func TestRouteAuth(t *testing.T) {
+	app := newTestApp(t)
+
+	for _, rc := range routeTable {
+		req := httptest.NewRequest(rc.method, requestPath(rc.path), strings.NewReader("{}"))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("%s %s: %v", rc.method, rc.path, err)
+		}
+
+		var body ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&body)
+
+		// A public handler may still answer 401 itself, e.g. login with bad credentials
+		rejected := resp.StatusCode == http.StatusUnauthorized && body.Error.Message == "missing or invalid token"
+
+		if rc.auth && !rejected {
+			t.Errorf("%s %s without token: got %d, want 401", rc.method, rc.path, resp.StatusCode)
+		}
+		if !rc.auth && rejected {
+			t.Errorf("%s %s should be public but returned 401", rc.method, rc.path)
+		}
+	}
+}
+
+func TestUnversionedRoutesAreGone(t *testing.T) {
+	app := newTestApp(t)
+
+	for _, path := range []string{"/owner", "/owner/1", "/product", "/login"} {
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodPost, path, nil), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("POST %s: got %d, want 404", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	cases := []struct {
+		role string
+		want int
+	}{
+		{roleAdmin, http.StatusOK},
+		{roleStaff, http.StatusOK},
+		{roleCustomer, http.StatusForbidden},
+		{"", http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		app := fiber.New(fiber.Config{ErrorHandler: errorHandler})
+		app.Get("/", func(c *fiber.Ctx) error {
+			c.Locals("user", &jwt.Token{Claims: jwt.MapClaims{"role": tc.role}})
+			return c.Next()
+		}, requireRole(roleAdmin, roleStaff), func(c *fiber.Ctx) error {
+			return c.SendStatus(http.StatusOK)
+		})
+
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/", nil), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.want {
+			t.Errorf("role %q: got %d, want %d", tc.role, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestIncludeDeletedRequiresAdmin(t *testing.T) {
+	app := newTestApp(t)
+
+	for _, path := range []string{"/api/v1/product", "/api/v1/product/filter", "/api/v1/product/1"} {
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, path+"?includeDeleted=true", nil), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("GET %s?includeDeleted=true without token: got %d, want 403", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	m, owner := seedStore(t)
+	app := newTestAppWithStore(t, m)
+	anon := &testClient{t: t, app: app}
+	staff := loginAs(t, app, roleStaff)
+	p := createTestProduct(t, staff, owner)
+	path := "/api/v1/product/" + strconv.Itoa(p.ID)
+
+	cases := []struct {
+		name    string
+		client  *testClient
+		method  string
+		path    string
+		body    interface{}
+		headers map[string]string
+		status  int
+		code    string
+		details bool
+	}{
+		{"bad request", anon, fiber.MethodGet, "/api/v1/product/abc", nil, nil, http.StatusBadRequest, "bad_request", false},
+		{"unauthorized", anon, fiber.MethodDelete, path, nil, nil, http.StatusUnauthorized, "unauthorized", false},
+		{"no route", anon, fiber.MethodGet, "/api/v1/nope", nil, nil, http.StatusNotFound, "not_found", false},
+		{"not found", anon, fiber.MethodGet, "/api/v1/product/999", nil, nil, http.StatusNotFound, "not_found", false},
+		{"forbidden", staff, fiber.MethodDelete, path, nil, nil, http.StatusForbidden, "forbidden", false},
+		{"conflict", staff, fiber.MethodPost, path + "/transition", StatusTransition{Status: statusPaidOut}, anyVersion, http.StatusConflict, "conflict", false},
+		{"precondition failed", staff, fiber.MethodPatch, path, map[string]string{"name": "x"}, map[string]string{fiber.HeaderIfMatch: `"9"`}, http.StatusPreconditionFailed, "precondition_failed", false},
+		{"precondition required", staff, fiber.MethodPatch, path, map[string]string{"name": "x"}, nil, http.StatusPreconditionRequired, "precondition_required", false},
+		{"validation", staff, fiber.MethodPost, "/api/v1/product", Product{}, nil, http.StatusUnprocessableEntity, "validation_error", true},
+	}
+
+	for _, tc := range cases {
+		resp, data := tc.client.do(tc.method, tc.path, tc.body, tc.headers)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, resp.StatusCode, tc.status, data)
+			continue
+		}
+
+		// Exactly {"error": {...}}, and details only on validation errors
+		var envelope map[string]map[string]json.RawMessage
+		if err := json.Unmarshal(data, &envelope); err != nil || len(envelope) != 1 || envelope["error"] == nil {
+			t.Errorf("%s: not an error envelope: %s", tc.name, data)
+			continue
+		}
+
+		var body ErrorResponse
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Fatal(err)
+		}
+		e := body.Error
+		if e.Code != tc.code || e.Message == "" {
+			t.Errorf("%s: got code %q message %q, want code %q", tc.name, e.Code, e.Message, tc.code)
+		}
+		if e.RequestID == "" || e.RequestID != resp.Header.Get(fiber.HeaderXRequestID) {
+			t.Errorf("%s: requestid %q doesn't match the %s header %q", tc.name, e.RequestID, fiber.HeaderXRequestID, resp.Header.Get(fiber.HeaderXRequestID))
+		}
+		if _, ok := envelope["error"]["details"]; ok != tc.details || (tc.details && len(e.Details) == 0) {
+			t.Errorf("%s: details %s", tc.name, envelope["error"]["details"])
+		}
+	}
+
+	// None of the refused requests wrote anything
+	stored, err := m.Store().Products.Get(p.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Version != p.Version || stored.Name != p.Name || stored.Status != p.Status || stored.Delete_Date != nil {
+		t.Fatalf("stored product changed: %+v", stored)
+	}
+	if total, _, _ := m.Store().Products.List(maxPageLimit, 0, true); len(total) != 1 {
+		t.Fatalf("got %d products, want 1", len(total))
+	}
+}
+
+func TestErrorResponseHidesInternalErrors(t *testing.T) {
+	const driverText = `constraint "product_owner_fkey" on table "product"`
+
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{fmt.Errorf("query product: %w", errors.New(driverText)), http.StatusInternalServerError, "internal_error"},
+		{&pq.Error{Code: "23505", Message: driverText}, http.StatusConflict, "conflict"},
+		{&pq.Error{Code: "23503", Message: driverText}, http.StatusConflict, "conflict"},
+		{&pq.Error{Code: "23514", Message: driverText}, http.StatusBadRequest, "bad_request"},
+		{&pq.Error{Code: "23502", Message: driverText}, http.StatusBadRequest, "bad_request"},
+		{&pq.Error{Code: "22P02", Message: driverText}, http.StatusBadRequest, "bad_request"},
+		{&pq.Error{Code: "40001", Message: driverText}, http.StatusInternalServerError, "internal_error"},
+	}
+
+	for _, tc := range cases {
+		status, body := errorResponse(tc.err)
+		if status != tc.status || body.Code != tc.code {
+			t.Errorf("%v: got %d %q, want %d %q", tc.err, status, body.Code, tc.status, tc.code)
+		}
+		if body.Message == "" || strings.Contains(body.Message, "product") {
+			t.Errorf("%v: message %q is empty or leaks the driver's", tc.err, body.Message)
+		}
+	}
+}
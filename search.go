@@ -0,0 +1,148 @@
+package main
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	searchModeFullText = "fulltext"
+	searchModeFuzzy    = "fuzzy"
+
+	maxSearchLength = 200
+	// fuzzySearchThreshold is the word similarity a fuzzy match needs
+	fuzzySearchThreshold = 0.3
+	// snippetLength is roughly how many characters a fuzzy snippet shows
+	snippetLength = 160
+)
+
+// The full text search marks matches with these, they are swapped for <mark>
+// after the snippet is HTML escaped.
+const (
+	headlineStart = "\x02"
+	headlineStop  = "\x03"
+)
+
+// ProductSearchResult is a product with how well it matched and an HTML
+// escaped snippet where the matched words are wrapped in <mark>.
+type ProductSearchResult struct {
+	Product
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet"`
+}
+
+// ProductSearchResponse tells which search produced the results, fuzzy only
+// runs when the full text search found nothing.
+type ProductSearchResponse struct {
+	Total   int                   `json:"total"`
+	Mode    string                `json:"mode"`
+	Results []ProductSearchResult `json:"results"`
+}
+
+func validateSearchQuery(q string) error {
+	v := &ValidationError{}
+
+	switch {
+	case strings.TrimSpace(q) == "":
+		v.add("q", "is required")
+	case utf8.RuneCountInString(q) > maxSearchLength:
+		v.add("q", "must be at most 200 characters")
+	}
+
+	return v.err()
+}
+
+// searchTerms splits a query into lowercase words
+func searchTerms(q string) []string {
+	return strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && !unicode.Is(unicode.Mn, r)
+	})
+}
+
+// headlineHTML escapes a ts_headline result and turns its markers into <mark>
+func headlineHTML(headline string) string {
+	escaped := html.EscapeString(headline)
+	escaped = strings.ReplaceAll(escaped, headlineStart, "<mark>")
+	return strings.ReplaceAll(escaped, headlineStop, "</mark>")
+}
+
+// highlightSnippet cuts an excerpt of text around the first term found and
+// marks every term in it, for results that ts_headline can't highlight.
+func highlightSnippet(text string, terms []string) string {
+	lower := strings.ToLower(text)
+
+	// Lowercasing can change the byte length of some runes, then the offsets
+	// found in lower don't fit text and we only return an excerpt
+	if len(lower) != len(text) {
+		return html.EscapeString(excerpt(text, 0))
+	}
+
+	type match struct{ start, end int }
+	var matches []match
+	for i := 0; i < len(lower); {
+		found := false
+		for _, term := range terms {
+			if term != "" && strings.HasPrefix(lower[i:], term) {
+				matches = append(matches, match{i, i + len(term)})
+				i += len(term)
+				found = true
+				break
+			}
+		}
+		if !found {
+			_, size := utf8.DecodeRuneInString(lower[i:])
+			i += size
+		}
+	}
+
+	start := 0
+	if len(matches) > 0 {
+		start = matches[0].start
+	}
+	from, to := excerptBounds(text, start)
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("... ")
+	}
+	pos := from
+	for _, m := range matches {
+		if m.start < from || m.end > to {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[pos:m.start]))
+		b.WriteString("<mark>" + html.EscapeString(text[m.start:m.end]) + "</mark>")
+		pos = m.end
+	}
+	b.WriteString(html.EscapeString(text[pos:to]))
+	if to < len(text) {
+		b.WriteString(" ...")
+	}
+
+	return b.String()
+}
+
+func excerpt(text string, around int) string {
+	from, to := excerptBounds(text, around)
+	return text[from:to]
+}
+
+// excerptBounds picks about snippetLength characters of text starting a
+// little before byte offset around, without splitting a rune.
+func excerptBounds(text string, around int) (int, int) {
+	from := around
+	for n := 0; from > 0 && n < snippetLength/4; n++ {
+		_, size := utf8.DecodeLastRuneInString(text[:from])
+		from -= size
+	}
+
+	to := from
+	for n := 0; to < len(text) && n < snippetLength; n++ {
+		_, size := utf8.DecodeRuneInString(text[to:])
+		to += size
+	}
+
+	return from, to
+}
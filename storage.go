@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	storageDriverLocal = "local"
+	storageDriverS3    = "s3"
+
+	// localStoragePath is where the app serves files of the local driver
+	localStoragePath = "/uploads"
+)
+
+// Storage keeps uploaded files. Keys are slash separated paths like
+// products/7/<uuid>.jpg, URL turns one into the address clients load it from.
+type Storage interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Delete succeeds when the file is already gone
+	Delete(ctx context.Context, key string) error
+	URL(key string) string
+}
+
+func newStorage(ctx context.Context, c StorageConfig) (Storage, error) {
+	switch c.Driver {
+	case storageDriverLocal:
+		baseURL := c.PublicURL
+		if baseURL == "" {
+			baseURL = localStoragePath
+		}
+		return newLocalStorage(c.LocalDir, baseURL), nil
+	case storageDriverS3:
+		return newS3Storage(ctx, c)
+	}
+	return nil, fmt.Errorf("unknown storage driver %q", c.Driver)
+}
+
+// localStorage writes files below dir, newApp serves them under
+// localStoragePath.
+type localStorage struct {
+	dir     string
+	baseURL string
+}
+
+func newLocalStorage(dir, baseURL string) *localStorage {
+	return &localStorage{dir: dir, baseURL: strings.TrimRight(baseURL, "/")}
+}
+
+func (s *localStorage) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if filepath.IsAbs(clean) || clean == "." || strings.HasPrefix(clean, "..") {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(s.dir, clean), nil
+}
+
+// Put writes to a temporary file first, so a reader never sees half a file
+func (s *localStorage) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localStorage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *localStorage) URL(key string) string {
+	return s.baseURL + "/" + key
+}
+
+// s3Storage keeps files in a bucket of any S3 compatible service, MinIO in
+// docker-compose.yml. Images are loaded straight from the bucket, so it must
+// allow anonymous reads unless PublicURL points at something that serves it.
+type s3Storage struct {
+	client  *minio.Client
+	bucket  string
+	baseURL string
+}
+
+// newS3Storage creates the bucket, readable by anyone, when it doesn't exist yet
+func newS3Storage(ctx context.Context, c StorageConfig) (*s3Storage, error) {
+	client, err := minio.New(c.S3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(c.S3AccessKey, c.S3SecretKey, ""),
+		Secure: c.S3UseSSL,
+		Region: c.S3Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 storage: %w", err)
+	}
+
+	exists, err := client.BucketExists(ctx, c.S3Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("s3 storage: check bucket %s: %w", c.S3Bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, c.S3Bucket, minio.MakeBucketOptions{Region: c.S3Region}); err != nil {
+			return nil, fmt.Errorf("s3 storage: create bucket %s: %w", c.S3Bucket, err)
+		}
+		if err := client.SetBucketPolicy(ctx, c.S3Bucket, publicReadPolicy(c.S3Bucket)); err != nil {
+			return nil, fmt.Errorf("s3 storage: make bucket %s readable: %w", c.S3Bucket, err)
+		}
+	}
+
+	baseURL := c.PublicURL
+	if baseURL == "" {
+		u := url.URL{Scheme: "http", Host: c.S3Endpoint, Path: "/" + c.S3Bucket}
+		if c.S3UseSSL {
+			u.Scheme = "https"
+		}
+		baseURL = u.String()
+	}
+
+	return &s3Storage{client: client, bucket: c.S3Bucket, baseURL: strings.TrimRight(baseURL, "/")}, nil
+}
+
+// publicReadPolicy lets anyone download objects but not list the bucket
+func publicReadPolicy(bucket string) string {
+	return fmt.Sprintf(`{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"AWS":["*"]},`+
+		`"Action":["s3:GetObject"],"Resource":["arn:aws:s3:::%s/*"]}]}`, bucket)
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *s3Storage) URL(key string) string {
+	return s.baseURL + "/" + key
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestLocalStorageKeys(t *testing.T) {
+	s := newLocalStorage(t.TempDir(), "/uploads/")
+	ctx := context.Background()
+
+	for _, key := range []string{"../escape.jpg", "/etc/passwd", ""} {
+		if err := s.Put(ctx, key, []byte("x"), "image/jpeg"); err == nil {
+			t.Errorf("Put(%q): want an error", key)
+		}
+	}
+
+	if err := s.Put(ctx, "products/1/a.jpg", []byte("x"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.URL("products/1/a.jpg"); got != "/uploads/products/1/a.jpg" {
+		t.Errorf("URL: got %q", got)
+	}
+	if err := s.Delete(ctx, "products/1/a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "products/1/a.jpg"); err != nil {
+		t.Errorf("deleting a missing file: %v", err)
+	}
+}
+
+// TestS3Storage runs against the MinIO from docker-compose.yml, e.g.
+// S3_TEST_ENDPOINT=localhost:9000 go test -run S3 ./...
+func TestS3Storage(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT is not set")
+	}
+
+	ctx := context.Background()
+	s, err := newS3Storage(ctx, StorageConfig{
+		S3Endpoint:  endpoint,
+		S3Region:    "us-east-1",
+		S3Bucket:    "wearlab-test",
+		S3AccessKey: "wearlab",
+		S3SecretKey: "wearlabbro30102001",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "products/1/test.txt"
+	if err := s.Put(ctx, key, []byte("hello"), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(s.URL(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("GET %s: got %d %q", s.URL(key), resp.StatusCode, body)
+	}
+
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+}
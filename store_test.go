@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+)
+
+// The tests in this file run the same scenario against every Store, so the
+// in-memory store can't drift from the Postgres one it stands in for. The
+// Postgres runs only happen when DATABASE_TEST_URL names a database they may
+// empty, see the README.
+
+// storeFixture is a store with an owner, a customer and a staff member
+type storeFixture struct {
+	store    Store
+	owner    Owner
+	customer User
+	staff    User
+}
+
+func forEachStore(t *testing.T, test func(t *testing.T, f storeFixture)) {
+	t.Run("memory", func(t *testing.T) {
+		m := newMemoryStore()
+		m.addType("shirt")
+		test(t, newStoreFixture(t, m.Store()))
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		url := os.Getenv("DATABASE_TEST_URL")
+		if url == "" {
+			t.Skip("DATABASE_TEST_URL is not set")
+		}
+		test(t, newStoreFixture(t, openTestDatabase(t, url)))
+	})
+}
+
+// openTestDatabase migrates the database and empties every table the
+// scenarios write to
+func openTestDatabase(t *testing.T, url string) Store {
+	t.Helper()
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrateUp(db, migrations); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`TRUNCATE public.users, public.owner, public.product, public.orders, public.payout_batch,
+		public.withdrawal_request, public.refresh_token, public.revoked_token RESTART IDENTITY CASCADE`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := newPostgresStore(db)
+	types, err := store.Lookups.ListTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ty := range types {
+		if ty.Name == "shirt" {
+			return store
+		}
+	}
+	if _, err := store.Lookups.CreateType("shirt"); err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+func newStoreFixture(t *testing.T, store Store) storeFixture {
+	t.Helper()
+
+	f := storeFixture{store: store}
+	if err := store.Owners.Create(&Owner{Name: "Somchai", Commission: 30}); err != nil {
+		t.Fatal(err)
+	}
+	owners, err := store.Owners.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.owner = owners[len(owners)-1]
+
+	for _, u := range []*User{&f.customer, &f.staff} {
+		role := roleCustomer
+		if u == &f.staff {
+			role = roleStaff
+		}
+		created, err := store.Users.Create(&User{Email: role + "@example.com", Password: "hash", Firstname: role, Lastname: "test", Role: role})
+		if err != nil {
+			t.Fatal(err)
+		}
+		*u = created
+	}
+
+	return f
+}
+
+// product creates an available product and returns it as stored
+func (f storeFixture) product(t *testing.T) Product {
+	t.Helper()
+
+	p := testProduct(f.owner)
+	if err := validateProduct(f.store.Lookups, &p); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.store.Products.Create(&p); err != nil {
+		t.Fatal(err)
+	}
+
+	products, _, err := f.store.Products.List(maxPageLimit, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := products[0]
+	for _, p := range products {
+		if p.ID > created.ID {
+			created = p
+		}
+	}
+	return created
+}
+
+// status is the stored status of product id
+func (f storeFixture) status(t *testing.T, id int) string {
+	t.Helper()
+
+	p, err := f.store.Products.Get(id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Status
+}
+
+func (f storeFixture) sell(t *testing.T, id int) {
+	t.Helper()
+
+	if _, err := f.store.Products.Transition(id, StatusTransition{Status: statusSold}, f.staff.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreOrders(t *testing.T) {
+	forEachStore(t, func(t *testing.T, f storeFixture) {
+		a, b := f.product(t), f.product(t)
+
+		order, err := f.store.Orders.Checkout(f.customer.ID, Checkout{ProductIDs: []int{a.ID, b.ID}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if order.Status != orderPending || order.Total != salePrice(a)+salePrice(b) || len(order.Items) != 2 {
+			t.Fatalf("checkout: got %+v", order)
+		}
+		for _, id := range []int{a.ID, b.ID} {
+			if got := f.status(t, id); got != statusReserved {
+				t.Fatalf("product %d after checkout: %s", id, got)
+			}
+		}
+
+		// The reserved products only move with their order
+		if _, err := f.store.Orders.Checkout(f.staff.ID, Checkout{ProductIDs: []int{a.ID}}); !errors.Is(err, ErrConflict) {
+			t.Fatalf("second checkout: got %v, want ErrConflict", err)
+		}
+		if _, err := f.store.Products.Transition(a.ID, StatusTransition{Status: statusAvailable}, f.staff.ID, 0); !errors.Is(err, ErrConflict) {
+			t.Fatalf("manual transition: got %v, want ErrConflict", err)
+		}
+		if err := f.store.Products.Delete(a.ID); !errors.Is(err, ErrConflict) {
+			t.Fatalf("delete: got %v, want ErrConflict", err)
+		}
+
+		payment := PaymentConfirmation{Amount: order.Total, Reference: "SLIP-1", Source: paymentSourceStaff}
+		paid, err := f.store.Orders.ConfirmPayment(order.ID, payment, f.staff.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paid.Status != orderPaid || paid.Payment == nil || paid.Payment.Reference != "SLIP-1" {
+			t.Fatalf("paid: got %+v", paid)
+		}
+		if again, err := f.store.Orders.ConfirmPayment(order.ID, payment, f.staff.ID); err != nil || again.Status != orderPaid {
+			t.Fatalf("confirming again: got %+v, %v", again, err)
+		}
+
+		share := ownerShare(salePrice(a), f.owner.Commission) + ownerShare(salePrice(b), f.owner.Commission)
+		balance, err := f.store.Ledger.Balance(f.owner.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.status(t, a.ID) != statusSold || balance.Balance != share {
+			t.Fatalf("after payment: status %s, balance %+v, want %d", f.status(t, a.ID), balance, share)
+		}
+
+		cancelled, err := f.store.Orders.Transition(order.ID, OrderTransition{Status: orderCancelled}, f.staff.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cancelled.Status != orderCancelled || len(cancelled.History) == 0 || cancelled.History[len(cancelled.History)-1].To != orderCancelled {
+			t.Fatalf("cancelled: got %+v", cancelled)
+		}
+
+		balance, _ = f.store.Ledger.Balance(f.owner.ID)
+		if f.status(t, b.ID) != statusReturned || balance.Balance != 0 {
+			t.Fatalf("after cancelling: status %s, balance %+v", f.status(t, b.ID), balance)
+		}
+	})
+}
+
+func TestStorePayouts(t *testing.T) {
+	forEachStore(t, func(t *testing.T, f storeFixture) {
+		a, b, unsold := f.product(t), f.product(t), f.product(t)
+		f.sell(t, a.ID)
+		f.sell(t, b.ID)
+
+		share := ownerShare(salePrice(a), f.owner.Commission) + ownerShare(salePrice(b), f.owner.Commission)
+		batch, err := f.store.Ledger.CreatePayoutBatch(PayoutRequest{Note: "week 1"}, f.staff.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if batch.Total != share || len(batch.Payouts) != 1 || batch.Payouts[0].OwnerID != f.owner.ID {
+			t.Fatalf("batch: got %+v, want a total of %d", batch, share)
+		}
+
+		for id, want := range map[int]string{a.ID: statusPaidOut, b.ID: statusPaidOut, unsold.ID: statusAvailable} {
+			if got := f.status(t, id); got != want {
+				t.Errorf("product %d after payout: got %s, want %s", id, got, want)
+			}
+		}
+
+		balance, err := f.store.Ledger.Balance(f.owner.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance.Balance != 0 || balance.PaidOut != share {
+			t.Fatalf("balance after payout: got %+v", balance)
+		}
+
+		if _, err := f.store.Ledger.CreatePayoutBatch(PayoutRequest{}, f.staff.ID); !errors.Is(err, ErrConflict) {
+			t.Fatalf("nothing to pay: got %v, want ErrConflict", err)
+		}
+		got, err := f.store.Ledger.GetPayoutBatch(batch.ID)
+		if err != nil || got.Total != share {
+			t.Fatalf("get batch: got %+v, %v", got, err)
+		}
+	})
+}
+
+func TestStoreWithdrawals(t *testing.T) {
+	forEachStore(t, func(t *testing.T, f storeFixture) {
+		p := f.product(t)
+
+		w, err := f.store.Withdrawals.Create(f.owner.ID, NewWithdrawal{ProductID: p.ID}, f.staff.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.store.Withdrawals.Create(f.owner.ID, NewWithdrawal{ProductID: p.ID}, f.staff.ID); !errors.Is(err, ErrConflict) {
+			t.Fatalf("second request: got %v, want ErrConflict", err)
+		}
+
+		// A customer ordered it after the request was made
+		order, err := f.store.Orders.Checkout(f.customer.ID, Checkout{ProductIDs: []int{p.ID}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.store.Withdrawals.Decide(w.ID, true, WithdrawalDecision{}, f.staff.ID); !errors.Is(err, ErrConflict) {
+			t.Fatalf("approving a reserved product: got %v, want ErrConflict", err)
+		}
+		pending, err := f.store.Withdrawals.List(f.owner.ID, withdrawalPending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 1 || pending[0].ID != w.ID || f.status(t, p.ID) != statusReserved {
+			t.Fatalf("refused approval changed something: %+v, product %s", pending, f.status(t, p.ID))
+		}
+
+		if _, err := f.store.Orders.Transition(order.ID, OrderTransition{Status: orderCancelled}, f.staff.ID); err != nil {
+			t.Fatal(err)
+		}
+		approved, err := f.store.Withdrawals.Decide(w.ID, true, WithdrawalDecision{Note: "picked up"}, f.staff.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if approved.Status != withdrawalApproved || approved.DecidedBy != f.staff.ID || f.status(t, p.ID) != statusWithdrawn {
+			t.Fatalf("approved: got %+v, product %s", approved, f.status(t, p.ID))
+		}
+
+		if _, err := f.store.Withdrawals.Decide(w.ID, false, WithdrawalDecision{}, f.staff.ID); !errors.Is(err, ErrConflict) {
+			t.Fatalf("deciding twice: got %v, want ErrConflict", err)
+		}
+		if _, err := f.store.Withdrawals.Create(f.owner.ID, NewWithdrawal{ProductID: p.ID}, f.staff.ID); !errors.Is(err, ErrConflict) {
+			t.Fatalf("withdrawing a withdrawn product: got %v, want ErrConflict", err)
+		}
+	})
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxNameLength = 255
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects every problem with a payload, so the client can
+// fix them all in one go instead of one per request.
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (v *ValidationError) Error() string {
+	msgs := make([]string, 0, len(v.Errors))
+	for _, fe := range v.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", fe.Field, fe.Message))
+	}
+	return strings.Join(msgs, ", ")
+}
+
+func (v *ValidationError) Unwrap() error {
+	return ErrValidation
+}
+
+func (v *ValidationError) add(field, message string) {
+	v.Errors = append(v.Errors, FieldError{Field: field, Message: message})
+}
+
+func (v *ValidationError) has(field string) bool {
+	for _, fe := range v.Errors {
+		if fe.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// err returns nil when nothing was added, so callers can return it directly
+func (v *ValidationError) err() error {
+	if len(v.Errors) == 0 {
+		return nil
+	}
+	return v
+}
+
+// only keeps the errors of the given fields, image[2] counts as image
+func (v *ValidationError) only(fields map[string]bool) *ValidationError {
+	filtered := &ValidationError{}
+	for _, fe := range v.Errors {
+		field, _, _ := strings.Cut(fe.Field, "[")
+		if fields[field] {
+			filtered.Errors = append(filtered.Errors, fe)
+		}
+	}
+	return filtered
+}
+
+// asValidationError reports whether err carries field errors for a 422
+func asValidationError(err error) (*ValidationError, bool) {
+	var verr *ValidationError
+	ok := errors.As(err, &verr)
+	return verr, ok
+}
+
+func checkName(v *ValidationError, field, value string) {
+	switch {
+	case strings.TrimSpace(value) == "":
+		v.add(field, "is required")
+	case utf8.RuneCountInString(value) > maxNameLength:
+		v.add(field, fmt.Sprintf("must be at most %d characters", maxNameLength))
+	}
+}
+
+// productReferences checks the rows a product points at, LookupRepository
+// implements it.
+type productReferences interface {
+	ProductReferences(p *Product) (ProductRefs, error)
+}
+
+// validateProduct checks the struct rules and then that type, status and
+// owner point at existing rows, filling in the ids and names of type and
+// status. Inside a transaction refs should run on that transaction so it sees
+// the same rows as the write that follows.
+func validateProduct(refs productReferences, p *Product) error {
+	v := &ValidationError{}
+
+	checkName(v, "name", p.Name)
+
+	if p.Waist <= 0 {
+		v.add("waist", "must be greater than 0")
+	}
+	if p.Length <= 0 {
+		v.add("length", "must be greater than 0")
+	}
+	if p.Chest <= 0 {
+		v.add("chest", "must be greater than 0")
+	}
+	if p.Price < 0 {
+		v.add("price", "can't be negative")
+	}
+	if p.SalePrice < 0 {
+		v.add("saleprice", "can't be negative")
+	} else if p.SalePrice > p.Price {
+		v.add("saleprice", "can't be greater than price")
+	}
+	if p.TypeID == 0 && strings.TrimSpace(p.Type) == "" {
+		v.add("type", "is required")
+	}
+	if p.StatusID == 0 && strings.TrimSpace(p.Status) == "" {
+		v.add("status", "is required")
+	}
+	if p.Owner <= 0 {
+		v.add("owner", "is required")
+	}
+	for i, img := range p.Image {
+		if strings.TrimSpace(img) == "" {
+			v.add(fmt.Sprintf("image[%d]", i), "can't be empty")
+		}
+	}
+
+	found, err := refs.ProductReferences(p)
+	if err != nil {
+		return err
+	}
+
+	if !v.has("type") {
+		checkLookupRef(v, "type", p.TypeID, p.Type, found.Type.ID, found.Type.Name)
+	}
+	if !v.has("status") {
+		checkLookupRef(v, "status", p.StatusID, p.Status, found.Status.ID, found.Status.Name)
+	}
+	if !found.Owner && !v.has("owner") {
+		v.add("owner", fmt.Sprintf("no owner with id %d", p.Owner))
+	}
+
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	// The client may send either the id or the name, store and return both
+	p.TypeID, p.Type = found.Type.ID, found.Type.Name
+	p.StatusID, p.Status = found.Status.ID, found.Status.Name
+
+	return nil
+}
+
+// checkLookupRef reports a type or status that wasn't found, or an id and
+// name that point at different rows.
+func checkLookupRef(v *ValidationError, field string, id int, name string, foundID int, foundName string) {
+	switch {
+	case foundID == 0 && id != 0:
+		v.add(field, fmt.Sprintf("no %s with id %d", field, id))
+	case foundID == 0:
+		v.add(field, fmt.Sprintf("unknown %s %q", field, name))
+	case id != 0 && name != "" && name != foundName:
+		v.add(field, fmt.Sprintf("%s %q doesn't match %sid %d", field, name, field, id))
+	}
+}
+
+// validateProductPatch validates a patched product but only reports errors
+// on the fields the patch touched.
+func validateProductPatch(refs productReferences, merged *Product, values []columnValue) error {
+	err := validateProduct(refs, merged)
+	if err == nil {
+		return nil
+	}
+
+	verr, ok := asValidationError(err)
+	if !ok {
+		return err
+	}
+
+	return verr.only(patchedFields(values)).err()
+}
+
+func validateLookupName(name string) error {
+	v := &ValidationError{}
+
+	checkName(v, "name", name)
+
+	return v.err()
+}
+
+func validateOwner(o *Owner) error {
+	v := &ValidationError{}
+
+	checkName(v, "name", o.Name)
+	checkCommission(v, o.Commission)
+
+	return v.err()
+}
+
+// validateOwnerUser checks that the account an owner is linked to exists and
+// belongs to a consignor
+func validateOwnerUser(users UserRepository, o *Owner) error {
+	if o.UserID == 0 {
+		return nil
+	}
+
+	v := &ValidationError{}
+
+	u, err := users.Get(o.UserID)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		v.add("userid", "must be an existing user")
+	case err != nil:
+		return err
+	case u.Role != roleConsignor:
+		v.add("userid", "must be a user with the consignor role")
+	}
+
+	return v.err()
+}
+
+// checkUser checks the fields every user payload shares
+func checkUser(v *ValidationError, u *User, passwordRequired bool) {
+	if _, err := mail.ParseAddress(u.Email); err != nil || strings.Contains(u.Email, "<") {
+		v.add("email", "must be a valid email address")
+	}
+	if (passwordRequired || u.Password != "") && utf8.RuneCountInString(u.Password) < 8 {
+		v.add("password", "must be at least 8 characters")
+	}
+	checkName(v, "firstname", u.Firstname)
+	checkName(v, "lastname", u.Lastname)
+	if u.Phone < 0 {
+		v.add("phone", "can't be negative")
+	}
+	if u.Zipcode < 0 {
+		v.add("zipcode", "can't be negative")
+	}
+}
+
+// validateRegistration checks a self sign up, the role is set by the server
+func validateRegistration(u *User) error {
+	v := &ValidationError{}
+
+	checkUser(v, u, true)
+
+	return v.err()
+}
+
+// validateUser checks a user written by an admin, who picks the role. On
+// update an empty password keeps the current one.
+func validateUser(u *User, passwordRequired bool) error {
+	v := &ValidationError{}
+
+	checkUser(v, u, passwordRequired)
+	if !isValidRole(u.Role) {
+		v.add("role", "must be one of admin, staff, consignor or customer")
+	}
+
+	return v.err()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+)
+
+// A withdrawal request waits for staff, approving it withdraws the product
+const (
+	withdrawalPending  = "pending"
+	withdrawalApproved = "approved"
+	withdrawalRejected = "rejected"
+)
+
+// WithdrawalRequest is a consignor asking for an unsold product back. Note is
+// theirs, DecisionNote the staff member's. RequestedBy and DecidedBy are 0
+// when the user was deleted, DecidedBy also while the request is pending.
+type WithdrawalRequest struct {
+	ID           int    `json:"id"`
+	ProductID    int    `json:"productid"`
+	ProductName  string `json:"productname"`
+	OwnerID      int    `json:"ownerid"`
+	Status       string `json:"status"`
+	Note         string `json:"note"`
+	RequestedBy  int    `json:"requestedby"`
+	DecidedBy    int    `json:"decidedby"`
+	DecisionNote string `json:"decisionnote"`
+	CreatedAt    string `json:"createdat"`
+	DecidedAt    string `json:"decidedat,omitempty"`
+}
+
+// NewWithdrawal is the body of POST /me/owner/withdrawals
+type NewWithdrawal struct {
+	ProductID int    `json:"productid"`
+	Note      string `json:"note"`
+}
+
+// WithdrawalDecision is the body of the approve and reject routes
+type WithdrawalDecision struct {
+	Note string `json:"note"`
+}
+
+// checkWithdrawable only lets a consignor ask for products the lifecycle
+// could withdraw, the ones that haven't been sold. A reserved product belongs
+// to a customer's order until the order is paid or cancelled.
+func checkWithdrawable(p Product) error {
+	if p.Status == statusReserved {
+		return conflictf("product %d is reserved for an order and can't be withdrawn", p.ID)
+	}
+	if !slices.Contains(statusTransitions[p.Status], statusWithdrawn) {
+		return conflictf("product %d is %s and can't be withdrawn", p.ID, p.Status)
+	}
+	return nil
+}
+
+func checkWithdrawalStatus(v *ValidationError, status string) {
+	switch status {
+	case "", withdrawalPending, withdrawalApproved, withdrawalRejected:
+	default:
+		v.add("status", "must be one of pending, approved or rejected")
+	}
+}
+
+// withdrawalTransition is what approving request id does to its product
+func withdrawalTransition(id int, note string) StatusTransition {
+	if note == "" {
+		note = "withdrawal request " + strconv.Itoa(id)
+	}
+	return StatusTransition{Status: statusWithdrawn, Note: note}
+}